@@ -1,12 +1,12 @@
 package main
 
 import (
+	"expvar"
 	"html/template"
 	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/jwtauth"
 )
 
 func (s *APIServer) adminRouter() chi.Router {
@@ -16,19 +16,24 @@ func (s *APIServer) adminRouter() chi.Router {
 	r.Get("/games", s.handleAdminGames)
 	r.Get("/users", s.handleAdminUsers)
 	r.Get("/clips", s.handleAdminClips)
+	r.Get("/duplicates", makeHTTPHandleFunc(s.handleAdminDuplicates))
+	r.Get("/quotas", makeHTTPHandleFunc(s.handleAdminQuotas))
+	r.Post("/quotas", makeHTTPHandleFunc(s.handleUpdateRoleQuota))
+	r.Post("/users/quota", makeHTTPHandleFunc(s.handleUpdateUserQuota))
+	r.Post("/users/role", makeHTTPHandleFunc(s.handleUpdateUserRole))
+	r.Post("/users/sessions/revoke", makeHTTPHandleFunc(s.handleRevokeUserSessions))
+	r.Get("/invites", makeHTTPHandleFunc(s.handleAdminInvites))
+	r.Get("/metrics", expvar.Handler().ServeHTTP)
+	r.Post("/invites/new", makeHTTPHandleFunc(s.handleCreateInvite))
+	r.Post("/invites/revoke", makeHTTPHandleFunc(s.handleRevokeInvite))
 
 	return r
 }
 
 // Admin Handlers
 func (s *APIServer) handleAdminIndex(w http.ResponseWriter, r *http.Request) {
-	_, claims, _ := jwtauth.FromContext(r.Context())
-
-	// Create user struct
-	user := User{
-		Username: claims["username"].(string),
-		Email:    claims["email"].(string),
-	}
+	// Loaded by RequirePermission
+	user, _ := userFromContext(r.Context())
 
 	t, err := template.ParseFiles("./templates/admin/index.html")
 	if err != nil {
@@ -47,7 +52,7 @@ func (s *APIServer) handleAdminGames(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	t, err := template.ParseFiles("./templates/admin/games.html")
+	t, err := s.parsePage(r, "./templates/admin/games.html", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -64,12 +69,25 @@ func (s *APIServer) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	t, err := template.ParseFiles("./templates/admin/users.html")
+	roleChanges, err := s.store.GetRoleChanges(50)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data := struct {
+		Users       []User
+		RoleChanges []RoleChange
+	}{
+		Users:       users,
+		RoleChanges: roleChanges,
+	}
+
+	t, err := s.parsePage(r, "./templates/admin/users.html", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := t.Execute(w, users); err != nil {
+	if err := t.Execute(w, data); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -81,7 +99,21 @@ func (s *APIServer) handleAdminClips(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	t, err := template.ParseFiles("./templates/admin/clips.html")
+	captions, err := s.store.GetAllCaptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Attach captions to their clips
+	for i := range clips {
+		for _, caption := range captions {
+			if caption.ClipID == clips[i].ID {
+				clips[i].Captions = append(clips[i].Captions, caption)
+			}
+		}
+	}
+
+	t, err := s.parsePage(r, "./templates/admin/clips.html", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
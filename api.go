@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -12,54 +13,87 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/jwtauth"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/gtuk/discordwebhook"
 	"github.com/majesticbeast/lostsons.tv/logger"
 	"github.com/majesticbeast/lostsons.tv/mux"
 )
 
-var tokenAuth *jwtauth.JWTAuth
-
 type APIServer struct {
-	store Storage
-	log   logger.Logger
+	store      Storage
+	log        logger.Logger
+	rateLimits rateLimitStore
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
-type ApiError struct {
-	Error string `json:"error"`
-}
-
 func NewAPIServer(store Storage, log logger.Logger) *APIServer {
-	return &APIServer{
+	s := &APIServer{
 		store: store,
 		log:   log,
 	}
+	s.rateLimits = s.newRateLimitStore()
+
+	return s
 }
 
+// Adapt a handler, checking the request against the spec if validateRequests marked it,
+// and writing the error it returns with the status code its type calls for
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := f(w, r); err != nil {
-			responseWithJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		err := validateRequest(r)
+		if err == nil {
+			err = f(w, r)
+		}
+
+		if err != nil {
+			apiErr := asAPIError(err)
+			if apiErr.Status >= 500 {
+				log.Printf("request %s: %s", middleware.GetReqID(r.Context()), apiErr)
+			}
+			writeAPIError(w, apiErr)
 		}
 	}
 }
 
 func (s *APIServer) Run() {
-	tokenAuth = jwtauth.New("HS256", []byte(os.Getenv("JWT_SECRET")), nil)
+	ring, err := loadKeyRing()
+	if err != nil {
+		log.Fatal(err)
+	}
+	signingKeys.Store(ring)
+	go s.reloadKeyRing()
+
+	r := s.routes()
+
+	// Start background job workers
+	s.runJobWorkers(jobWorkerCount())
+	go s.sweepRateLimits()
 
-	// Initialize main router and routes
+	// Start server
+	s.log.Info("Starting server on port 3000")
+	s.log.Error(http.ListenAndServe(":3000", r).Error())
+}
+
+// The main router. Every route added here needs an entry in apiOperations.
+func (s *APIServer) routes() chi.Router {
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(requestIDHeader)
 	r.Get("/", makeHTTPHandleFunc(s.handleIndex))
 	r.Get("/healthDB", makeHTTPHandleFunc(s.handleHealthDB))
 	r.Get("/healthHTTP", makeHTTPHandleFunc(s.handleHealthHTTP))
+	r.Get("/.well-known/jwks.json", makeHTTPHandleFunc(s.handleJWKS))
+	r.Get("/api/openapi.json", makeHTTPHandleFunc(s.handleOpenAPI))
+	r.Get("/api/docs", s.handleAPIDocs)
 
 	// Mux webhook route
-	r.Post("/mux-webhook", makeHTTPHandleFunc(s.handleMuxWebhook))
+	r.With(s.rateLimit(webhookRatePolicy)).Post("/mux-webhook", makeHTTPHandleFunc(s.handleMuxWebhook))
 
 	/********************
 	 * Mount subrouters *
@@ -67,22 +101,46 @@ func (s *APIServer) Run() {
 
 	// Protected subroutes
 	r.Group(func(r chi.Router) {
-		// Seek, verify, and validate JWT tokens
-		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(jwtauth.Authenticator)
-		r.Use(s.isAdmin)
+		// Seek and validate the session JWT or API token
+		r.Use(s.authenticate)
+		r.Use(s.requireAuth)
+		r.Use(s.RequirePermission(PermAdminAccess))
 		r.Mount("/admin", s.adminRouter())
 	})
 
+	// GraphQL, for clients that want their own shape of the clip graph
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Get("/graphql", makeHTTPHandleFunc(s.handleGraphQL))
+		r.Post("/graphql", makeHTTPHandleFunc(s.handleGraphQL))
+	})
+	r.Get("/graphql/schema", s.handleGraphQLSchema)
+
 	// Unprotected subroutes (they may have their own protected routes)
 	r.Mount("/clips", s.clipsRouter())
 	r.Mount("/users", s.usersRouter())
 	r.Mount("/games", s.gamesRouter())
 	r.Mount("/auth", s.authRouter())
+	r.Mount("/settings", s.settingsRouter())
+
+	// The JSON API. Responses are wrapped in a {data, error, meta} envelope; the routes
+	// above stay as they were for the HTML forms that post to them.
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(envelopeResponses)
+		r.Use(validateRequests)
+		r.NotFound(makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return errNotFound("route")
+		}))
+		r.MethodNotAllowed(makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "method not allowed"}
+		}))
+		r.Mount("/clips", s.clipsRouter())
+		r.Mount("/users", s.usersRouter())
+		r.Mount("/games", s.gamesRouter())
+		r.Mount("/auth", s.authRouter())
+	})
 
-	// Start server
-	s.log.Info("Starting server on port 3000")
-	s.log.Error(http.ListenAndServe(":3000", r).Error())
+	return r
 }
 
 // Routes
@@ -101,7 +159,7 @@ func (s *APIServer) handleIndex(w http.ResponseWriter, r *http.Request) error {
 
 func (s *APIServer) handleHealthDB(w http.ResponseWriter, r *http.Request) error {
 	if !s.store.IsAlive() {
-		return responseWithError(w, http.StatusInternalServerError, "dead")
+		return &APIError{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: "dead"}
 	}
 	return responseWithJSON(w, http.StatusOK, map[string]string{"db": "alive"})
 
@@ -114,33 +172,56 @@ func (s *APIServer) handleHealthHTTP(w http.ResponseWriter, r *http.Request) err
 func (s *APIServer) handleMuxWebhook(w http.ResponseWriter, r *http.Request) error {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		err = fmt.Errorf("error reading mux webhook response body: %w", err)
-		return responseWithError(w, http.StatusBadRequest, err.Error())
+		return errBadRequest("error reading mux webhook response body: %s", err)
 	}
 
-	// TODO: This doesn't work. Fix it.
-	// err = IsValidMuxSignature(r, body)
-	// if err != nil {
-	// 	err = fmt.Errorf("error validating mux signature: %w", err)
-	// 	return responseWithError(w, http.StatusBadRequest, err.Error())
-	// }
+	// Nothing in the body is trusted until its signature checks out
+	if err := IsValidMuxSignature(r, body); err != nil {
+		s.log.Warn(fmt.Sprintf("rejected mux webhook: %s", err))
+		return errUnauthorized()
+	}
 
 	assetResponse := mux.WebhookResponse{}
 	if err := json.Unmarshal(body, &assetResponse); err != nil {
-		err = fmt.Errorf("error unmarshalling mux webhook response body: %w", err)
-		return responseWithError(w, http.StatusBadRequest, err.Error())
+		return errBadRequest("error unmarshalling mux webhook response body: %s", err)
 	}
 
-	err = PostToDiscordWebhook(assetResponse)
-	if err != nil {
+	// MP4 renditions are ready to download
+	if assetResponse.Type == "video.asset.static_renditions.ready" {
+		rendition := mux.BestMP4Rendition(assetResponse)
+		if err := s.store.UpdateClipMP4Rendition(assetResponse.Data.ID, rendition); err != nil {
+			s.log.Warn(err.Error())
+			return errInternal(err)
+		}
+
+		return nil
+	}
+
+	// Other events have nothing to do
+	if assetResponse.Type != "video.asset.ready" {
+		return nil
+	}
+
+	// Fingerprint the clip for duplicate detection now Mux can serve thumbnails
+	if _, err := s.enqueueJob(jobTypeFingerprint, defaultJobQueue, fingerprintJobPayload{AssetID: assetResponse.Data.ID}); err != nil {
+		s.log.Warn(err.Error())
+		return errInternal(err)
+	}
+
+	// Notify from the job queue so a slow or failing Discord doesn't make Mux redeliver
+	if _, err := s.enqueueJob(jobTypeNotify, defaultJobQueue, assetResponse); err != nil {
 		s.log.Warn(err.Error())
-		return responseWithError(w, http.StatusInternalServerError, err.Error())
+		return errInternal(err)
 	}
 
 	return nil
 }
 
 func PostToDiscordWebhook(assetResponse mux.WebhookResponse) error {
+	if len(assetResponse.Data.PlaybackIds) == 0 {
+		return nil
+	}
+
 	username := "lostsons.tv"
 	content := fmt.Sprintf("New clip { %s }\nPlaybackID: %s", assetResponse.Type, assetResponse.Data.PlaybackIds[0].ID)
 	url := os.Getenv("DISCORD_WEBHOOK_URL")
@@ -165,67 +246,93 @@ func generateHmacSignature(webhookSecret, payload string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// IsValidMuxSignature validates the mux webhook signature
+// How old a webhook's signed timestamp may be, so a captured event can't be replayed later
+const muxWebhookTolerance = 5 * time.Minute
+
+// IsValidMuxSignature checks the Mux-Signature header, "t=<unix time>,v1=<hex hmac>",
+// against the raw body. There may be several v1 values while Mux rotates secrets.
 func IsValidMuxSignature(r *http.Request, body []byte) error {
-	muxSignature := r.Header.Get("Mux-Signature")
+	webhookSecret := os.Getenv("MUX_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		return errors.New("MUX_WEBHOOK_SECRET is not set")
+	}
 
+	muxSignature := r.Header.Get("Mux-Signature")
 	if muxSignature == "" {
 		return errors.New("no Mux-Signature in request header")
 	}
 
-	muxSignatureArr := strings.Split(muxSignature, ",")
+	timestamp := ""
+	signatures := []string{}
+	for _, part := range strings.Split(muxSignature, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
 
-	if len(muxSignatureArr) != 2 {
-		return fmt.Errorf("Mux-Signature in request header should be 2 values long: %s", muxSignatureArr)
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
 	}
 
-	timestampArr := strings.Split(muxSignatureArr[0], "=")
-	v1SignatureArr := strings.Split(muxSignatureArr[1], "=")
-
-	if len(timestampArr) != 2 || len(v1SignatureArr) != 2 {
-		return fmt.Errorf("missing timestamp: %s or missing v1Signature: %s", timestampArr, v1SignatureArr)
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("Mux-Signature is missing its timestamp or v1 signature: %s", muxSignature)
 	}
 
-	timestamp := timestampArr[1]
-	v1Signature := v1SignatureArr[1]
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Mux-Signature timestamp: %s", timestamp)
+	}
 
-	webhookSecret := os.Getenv("MUX_WEBHOOK_SECRET")
-	payload := fmt.Sprintf("%s.%s", timestamp, string(body))
-	sha := generateHmacSignature(webhookSecret, payload)
+	if age := time.Since(time.Unix(unix, 0)); age > muxWebhookTolerance || age < -muxWebhookTolerance {
+		return fmt.Errorf("Mux-Signature timestamp is %s old", age.Round(time.Second))
+	}
 
-	if sha != v1Signature {
-		return errors.New("not a valid mux webhook signature")
+	expected := generateHmacSignature(webhookSecret, fmt.Sprintf("%s.%s", timestamp, body))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
 	}
 
-	return nil
+	return errors.New("not a valid mux webhook signature")
 }
 
-// JSON responses
+// JSON responses. Under /api/v1 the payload is wrapped in an envelope.
 func responseWithJSON(w http.ResponseWriter, code int, payload interface{}) error {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	return json.NewEncoder(w).Encode(payload)
-}
+	if ew, ok := w.(*envelopeWriter); ok {
+		return writeEnvelope(ew, code, payload, nil)
+	}
 
-func responseWithError(w http.ResponseWriter, code int, payload string) error {
-	return responseWithJSON(w, code, map[string]string{"error": payload})
+	return writeJSON(w, code, payload)
 }
 
-// Middleware to check if user is admin
-func (s *APIServer) isAdmin(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, claims, err := jwtauth.FromContext(r.Context())
-		if err != nil {
-			err := responseWithError(w, http.StatusUnauthorized, "unauthorized")
-			s.log.Warn(err.Error())
-		}
+// Encode body before anything is sent, so an encoding error can still be answered
+// with a 500
+func writeJSON(w http.ResponseWriter, code int, body interface{}) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(body); err != nil {
+		return fmt.Errorf("error encoding response: %w", err)
+	}
 
-		role, ok := claims["role"].(string)
-		if !ok || role != "admin" {
-			responseWithError(w, http.StatusUnauthorized, "unauthorized")
-			s.log.Warn(err.Error())
-		}
+	writeResponse(w, code, "application/json", b.Bytes())
+	return nil
+}
 
-		next.ServeHTTP(w, r)
-	})
+// Send a response rendered in full. Once the status is sent there is no other
+// response to give, so a failed write, e.g. a client that went away, is only logged.
+func writeResponse(w http.ResponseWriter, code int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("error writing response: %s", err)
+	}
+}
+
+// Error responses written by middleware, which has no handler to return an error from
+func responseWithError(w http.ResponseWriter, code int, payload string) error {
+	return writeAPIError(w, &APIError{Status: code, Code: errorCode(code), Message: payload})
 }
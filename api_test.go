@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A ResponseWriter whose client went away: every write fails
+type failingWriter struct {
+	header   http.Header
+	statuses []int
+}
+
+func (w *failingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *failingWriter) WriteHeader(code int) {
+	w.statuses = append(w.statuses, code)
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestFailedWriteSendsOneStatus(t *testing.T) {
+	handler := makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return responseWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	w := &failingWriter{header: http.Header{}}
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if len(w.statuses) != 1 || w.statuses[0] != http.StatusOK {
+		t.Errorf("statuses = %v, want just %d", w.statuses, http.StatusOK)
+	}
+}
+
+func TestEncodeFailureIsA500(t *testing.T) {
+	handler := makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return responseWithJSON(w, http.StatusOK, map[string]interface{}{"unencodable": make(chan int)})
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+	}
+}
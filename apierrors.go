@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// An error a handler can return to pick the status code and body of the response.
+// Untyped errors are treated as errInternal: a 500 whose cause is logged, not shown,
+// so storage and upstream error text never reaches the client.
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Fields  map[string]string      `json:"fields,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+
+	RequestID string `json:"request_id,omitempty"`
+
+	// Logged but not shown, e.g. the error from Mux behind an upstream failure
+	cause error
+}
+
+func (e *APIError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.cause)
+	}
+
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.cause
+}
+
+func errBadRequest(format string, a ...interface{}) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: fmt.Sprintf(format, a...)}
+}
+
+// e.g. errNotFound("clip") is "clip does not exist"
+func errNotFound(what string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: what + " does not exist"}
+}
+
+func errConflict(message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: "conflict", Message: message}
+}
+
+func errUnauthorized() *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "unauthorized"}
+}
+
+func errForbidden(message string) *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: message}
+}
+
+// A problem with one field of a form, e.g. errValidation("email", "is invalid")
+func errValidation(field string, problem string) *APIError {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: field + " " + problem,
+		Fields:  map[string]string{field: problem},
+	}
+}
+
+// A service we depend on, such as Mux or Discord, failed
+func errUpstream(service string, err error) *APIError {
+	return &APIError{
+		Status:  http.StatusBadGateway,
+		Code:    "upstream_failed",
+		Message: fmt.Sprintf("error talking to %s", service),
+		cause:   err,
+	}
+}
+
+// Something broke on our side. The cause is logged, not shown.
+func errInternal(err error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "internal error", cause: err}
+}
+
+// Error codes for statuses written directly with responseWithError
+func errorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusUnprocessableEntity:
+		return "validation_failed"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusBadGateway:
+		return "upstream_failed"
+	}
+
+	if status >= 500 {
+		return "internal_error"
+	}
+
+	return "bad_request"
+}
+
+func asAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		return &APIError{Status: qe.Code, Code: "quota_exceeded", Message: qe.Message}
+	}
+
+	return errInternal(err)
+}
+
+/*
+ *
+ *
+ * /api/v1 envelope
+ *
+ *
+ */
+
+// Every /api/v1 response body
+type envelope struct {
+	Data  interface{}            `json:"data"`
+	Error *APIError              `json:"error"`
+	Meta  map[string]interface{} `json:"meta"`
+}
+
+// Marks a response as part of /api/v1, so responseWithJSON wraps it in an envelope
+type envelopeWriter struct {
+	http.ResponseWriter
+	requestID string
+}
+
+// Middleware for the /api/v1 routes
+func envelopeResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&envelopeWriter{ResponseWriter: w, requestID: middleware.GetReqID(r.Context())}, r)
+	})
+}
+
+// Middleware echoing the request ID, so it can be quoted when reporting a problem
+func requestIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeEnvelope(w *envelopeWriter, code int, data interface{}, apiErr *APIError) error {
+	// Bare strings like "clip deleted" become an object
+	if message, ok := data.(string); ok {
+		data = map[string]string{"message": message}
+	}
+
+	if apiErr != nil {
+		apiErr.RequestID = w.requestID
+	}
+
+	return writeJSON(w, code, envelope{
+		Data:  data,
+		Error: apiErr,
+		Meta:  map[string]interface{}{"request_id": w.requestID},
+	})
+}
+
+// Write the response for an error returned by a handler
+func writeAPIError(w http.ResponseWriter, apiErr *APIError) error {
+	if ew, ok := w.(*envelopeWriter); ok {
+		return writeEnvelope(ew, apiErr.Status, nil, apiErr)
+	}
+
+	body := map[string]interface{}{"error": apiErr.Message}
+	for key, value := range apiErr.Details {
+		body[key] = value
+	}
+
+	return writeJSON(w, apiErr.Status, body)
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -13,9 +18,22 @@ import (
 	"golang.org/x/oauth2"
 )
 
-var discordEndpoint = oauth2.Endpoint{
-	AuthURL:  "https://discord.com/api/oauth2/authorize?client_id=1083877630912249927&redirect_uri=https%3A%2F%2Flostsons.tv%2Fauth%2Fdiscord%2Fcallback&response_type=code&scope=identify%20email",
-	TokenURL: "https://discord.com/api/oauth2/token",
+// Name of the cookie carrying a login attempt's state and PKCE verifier
+const oauthStateCookie = "oauth_state"
+
+// How long a login attempt has to come back from the provider
+const oauthStateTTL = 10 * time.Minute
+
+// What a login attempt carries from its start to the provider's callback
+type oauthState struct {
+	State    string
+	Verifier string
+	Provider string
+	ReturnTo string
+	Invite   string
+
+	// Set when a logged in user is linking another account rather than logging in
+	LinkUserID string
 }
 
 // init to load env vars
@@ -25,108 +43,346 @@ func init() {
 
 func (s *APIServer) authRouter() chi.Router {
 	r := chi.NewRouter()
-	r.Get("/discord", makeHTTPHandleFunc(s.handleDiscordLogin))
-	r.Get("/discord/callback", makeHTTPHandleFunc(s.handleDiscordCallback))
+	r.With(s.rateLimit(loginRatePolicy)).Get("/{provider}/callback", makeHTTPHandleFunc(s.handleLoginCallback))
+
+	// Session routes
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.With(s.rateLimit(loginRatePolicy)).Get("/{provider}", makeHTTPHandleFunc(s.handleLogin))
+		r.Get("/csrf", makeHTTPHandleFunc(s.handleGetCSRFToken))
+		r.Post("/logout", makeHTTPHandleFunc(s.handleLogout))
+		r.Get("/sessions", makeHTTPHandleFunc(s.handleGetSessions))
+		r.Post("/sessions/revoke", makeHTTPHandleFunc(s.handleRevokeSession))
+		r.Get("/identities", makeHTTPHandleFunc(s.handleGetIdentities))
+		r.Post("/identities/unlink", makeHTTPHandleFunc(s.handleUnlinkIdentity))
+	})
 
 	return r
 }
 
-func (s *APIServer) handleDiscordLogin(w http.ResponseWriter, r *http.Request) error {
-	oauth2Config := &oauth2.Config{
-		ClientID:    os.Getenv("DISCORD_OAUTH_ID"),
-		RedirectURL: os.Getenv("DISCORD_OAUTH_REDIRECT"),
-		Endpoint:    discordEndpoint,
-		Scopes:      []string{"identify", "email"},
+// Start a login. A fresh state and PKCE verifier are kept in a short-lived signed
+// cookie so the callback can check the response belongs to this browser. With
+// ?link=1 a logged in user adds the account to their own instead of logging in.
+func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
+	name := chi.URLParam(r, "provider")
+	provider, ok := loginProviders()[name]
+	if !ok {
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "unknown login provider"}
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return fmt.Errorf("error generating oauth state: %w", err)
+	}
+
+	attempt := oauthState{
+		State:    state,
+		Verifier: oauth2.GenerateVerifier(),
+		Provider: name,
+		ReturnTo: safeReturnTo(r.URL.Query().Get("return_to")),
+		Invite:   normalizeInviteCode(r.URL.Query().Get("invite")),
+	}
+
+	if r.URL.Query().Get("link") != "" {
+		session, ok := s.currentSession(r)
+		if !ok {
+			return errUnauthorized()
+		}
+		attempt.LinkUserID = session.UserID
+	}
+
+	authURL, err := provider.AuthURL(attempt.State, attempt.Verifier)
+	if err != nil {
+		return err
 	}
 
-	url := oauth2Config.AuthCodeURL(os.Getenv("STATE"), oauth2.AccessTypeOffline)
-	http.Redirect(w, r, url, http.StatusFound)
+	cookie, err := signOAuthState(attempt)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, cookie)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
 
 	return nil
 }
 
-func (s *APIServer) handleDiscordCallback(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleLoginCallback(w http.ResponseWriter, r *http.Request) error {
+	name := chi.URLParam(r, "provider")
+	provider, ok := loginProviders()[name]
+	if !ok {
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "unknown login provider"}
+	}
+
+	// The state cookie is single use
+	cookie, err := r.Cookie(oauthStateCookie)
+	clearOAuthState(w)
+	if err != nil {
+		return errBadRequest("login expired, please try again")
+	}
+
 	// Check if state is valid #CSRF
-	state := r.URL.Query().Get("state")
-	if state != os.Getenv("STATE") {
-		return fmt.Errorf("invalid state")
+	attempt, err := parseOAuthState(cookie.Value)
+	if err != nil || attempt.Provider != name {
+		return errBadRequest("invalid state")
 	}
 
-	oauth2Config := &oauth2.Config{
-		ClientID:     os.Getenv("DISCORD_OAUTH_ID"),
-		ClientSecret: os.Getenv("DISCORD_OAUTH_SECRET"),
-		RedirectURL:  os.Getenv("DISCORD_OAUTH_REDIRECT"),
-		Endpoint:     discordEndpoint,
-		Scopes:       []string{"identify"},
+	state := r.URL.Query().Get("state")
+	if attempt.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(attempt.State)) != 1 {
+		return errBadRequest("invalid state")
 	}
 
-	code := r.URL.Query().Get("code")
-	token, err := oauth2Config.Exchange(r.Context(), code)
+	profile, token, err := provider.Callback(r, attempt.Verifier)
 	if err != nil {
-		err = fmt.Errorf("error exchanging code (%s) for token: %w", code, err)
-		return err
+		return errUpstream(name, err)
 	}
 
-	// Get users Discord info
-	req, err := http.NewRequest("GET", "https://discord.com/api/users/@me", nil)
-	if err != nil {
-		err = fmt.Errorf("error creating request to Discord API: %w", err)
-		return err
+	if attempt.LinkUserID != "" {
+		if err := s.linkIdentity(attempt.LinkUserID, profile); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, safeReturnTo(attempt.ReturnTo), http.StatusFound)
+		return nil
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
-	resp, err := http.DefaultClient.Do(req)
+	var user User
+	if name == providerDiscord {
+		// Keep people outside our Discord server out before they get a user row
+		allowed, discordRoles, reason, err := checkGuildMembership(r.Context(), token)
+		if err != nil {
+			return errUpstream("discord", fmt.Errorf("error checking discord server membership: %w", err))
+		}
+
+		if !allowed {
+			s.log.Info(fmt.Sprintf("rejected login of discord user %s (%s): %s", profile.Username, profile.ID, reason))
+			return renderLoginRejected(w, reason)
+		}
+
+		user, err = s.discordLogin(profile, attempt.Invite)
+		if err == nil {
+			user, err = s.syncDiscordRoles(user, discordRoles)
+		}
+	} else {
+		if !guildGatingEnabled() {
+			user, err = s.identityLogin(profile, attempt.Invite)
+		} else {
+			// Twitch and Steam can't vouch for server membership, so they only log in
+			// existing users whose linked Discord account is still in the server
+			user, err = s.identityLogin(profile, "")
+			if errors.Is(err, errInviteRequired) {
+				s.log.Info(fmt.Sprintf("rejected login of %s user %s (%s): no linked user", name, profile.Username, profile.ID))
+				return renderLoginRejected(w, "Sign in with Discord first, then link this account from your settings.")
+			}
+			if err != nil {
+				return err
+			}
+
+			allowed, discordRoles, reason, discordToken, err := s.checkLinkedGuildMembership(user)
+			if err != nil {
+				return errUpstream("discord", fmt.Errorf("error checking discord server membership: %w", err))
+			}
+
+			if !allowed {
+				s.log.Info(fmt.Sprintf("rejected login of %s user %s (%s): %s", name, profile.Username, profile.ID, reason))
+				return renderLoginRejected(w, reason)
+			}
+
+			token = discordToken
+			user, err = s.syncDiscordRoles(user, discordRoles)
+		}
+	}
+
+	if errors.Is(err, errInviteRequired) {
+		s.log.Info(fmt.Sprintf("rejected login of %s user %s (%s): no invite", name, profile.Username, profile.ID))
+		return renderLoginRejected(w, "You need an invite code to sign up.")
+	}
 	if err != nil {
-		err = fmt.Errorf("error getting response from Discord API: %w", err)
 		return err
 	}
-	defer resp.Body.Close()
 
-	// Create user struct for later use
-	user := User{}
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		err = fmt.Errorf("error decoding response body: %w", err)
+	if err := s.createSession(w, r, user, token); err != nil {
 		return err
 	}
 
-	// If user doesn't exist, enter into DB, then continue as normal
-	if _, err := s.store.GetUserByUsername(user.Username); err != nil {
-		if err := s.store.CreateUser(user); err != nil {
-			err = fmt.Errorf("error creating user: %w", err)
-			return err
+	http.Redirect(w, r, safeReturnTo(attempt.ReturnTo), http.StatusFound)
+
+	return nil
+
+}
+
+// Find the user for a Discord account, linking or creating them as needed, and
+// sync their profile. Accounts are matched on Discord's snowflake ID, never on
+// username, since usernames can change and be taken by someone else. New accounts
+// need an invite, unless guild gating already vouches for them.
+func (s *APIServer) discordLogin(discordUser ProviderUser, invite string) (User, error) {
+	user, err := s.store.GetUserByDiscordID(discordUser.ID)
+	if err == nil {
+		return s.syncDiscordProfile(user, discordUser)
+	}
+
+	// Rows from before Discord IDs were stored are linked by verified email
+	if discordUser.Verified && discordUser.Email != "" {
+		if user, err := s.store.GetUserByEmail(discordUser.Email); err == nil && user.DiscordID == "" {
+			s.log.Info(fmt.Sprintf("linking user %s to discord account %s", user.Username, discordUser.ID))
+			return s.syncDiscordProfile(user, discordUser)
+		}
+	}
+
+	if _, err := s.store.GetUserByUsername(discordUser.Username); err == nil {
+		return User{}, errConflict(fmt.Sprintf("username %s belongs to an account not linked to this Discord account, ask an admin to link it", discordUser.Username))
+	}
+
+	newUser := User{
+		Username:    discordUser.Username,
+		Email:       discordUser.Email,
+		DiscordID:   discordUser.ID,
+		DisplayName: discordUser.DisplayName,
+		Avatar:      discordUser.Avatar,
+	}
+
+	if invite != "" {
+		return s.registerWithInvite(newUser, invite)
+	}
+
+	if !guildGatingEnabled() {
+		return User{}, errInviteRequired
+	}
+
+	if err := s.store.CreateUser(newUser); err != nil {
+		return User{}, fmt.Errorf("error creating user: %w", err)
+	}
+
+	return s.store.GetUserByDiscordID(discordUser.ID)
+}
+
+// Copy a Discord profile onto a user and save it. A new username that another
+// account still holds is not taken; the user keeps their old one until it's free.
+func (s *APIServer) syncDiscordProfile(user User, discordUser ProviderUser) (User, error) {
+	user.DiscordID = discordUser.ID
+	user.DisplayName = discordUser.DisplayName
+	user.Avatar = discordUser.Avatar
+
+	// Only take an address Discord has verified, and never one another user holds
+	if discordUser.Verified && discordUser.Email != "" && discordUser.Email != user.Email {
+		if other, err := s.store.GetUserByEmail(discordUser.Email); err == nil && other.ID != user.ID {
+			s.log.Warn(fmt.Sprintf("not changing the email of user %s, the address is held by user %s", user.Username, other.ID))
+		} else {
+			user.Email = discordUser.Email
 		}
 	}
 
-	// Create a JWT with the access token as the claim
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"access_token": token.AccessToken,
-		"username":     user.Username,
-		"email":        user.Email,
-		"role":         user.Role,
-		"exp":          time.Now().Add(time.Hour * 24 * 7).Unix(),
+	if discordUser.Username != user.Username {
+		if other, err := s.store.GetUserByUsername(discordUser.Username); err == nil && other.ID != user.ID {
+			s.log.Warn(fmt.Sprintf("not renaming user %s to %s, the name is held by user %s", user.Username, discordUser.Username, other.ID))
+		} else {
+			user.Username = discordUser.Username
+		}
+	}
+
+	if err := s.store.UpdateUserDiscordProfile(user); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// Sign a login attempt into a cookie
+func signOAuthState(attempt oauthState) (*http.Cookie, error) {
+	value, err := jwtKeys().sign(jwt.MapClaims{
+		"typ":       jwtTypeOAuthState,
+		"state":     attempt.State,
+		"verifier":  attempt.Verifier,
+		"provider":  attempt.Provider,
+		"return_to": attempt.ReturnTo,
+		"invite":    attempt.Invite,
+		"link":      attempt.LinkUserID,
+		"exp":       time.Now().Add(oauthStateTTL).Unix(),
 	})
+	if err != nil {
+		return nil, fmt.Errorf("error signing oauth state: %w", err)
+	}
 
-	// Sign the JWT with the secret
-	jwtString, err := jwtToken.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	// Lax, not Strict: the callback is a cross-site redirect from the provider
+	return &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    value,
+		Path:     "/auth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}, nil
+}
+
+// Verify and decode a state cookie, rejecting it once expired
+func parseOAuthState(value string) (oauthState, error) {
+	claims, err := jwtKeys().parse(value, jwtTypeOAuthState)
 	if err != nil {
-		err = fmt.Errorf("error signing JWT: %w", err)
-		return err
+		return oauthState{}, fmt.Errorf("error parsing oauth state: %w", err)
 	}
 
-	// Create and set the JWT as a secure cookie
+	attempt := oauthState{}
+	attempt.State, _ = claims["state"].(string)
+	attempt.Verifier, _ = claims["verifier"].(string)
+	attempt.Provider, _ = claims["provider"].(string)
+	attempt.ReturnTo, _ = claims["return_to"].(string)
+	attempt.Invite, _ = claims["invite"].(string)
+	attempt.LinkUserID, _ = claims["link"].(string)
+
+	return attempt, nil
+}
+
+func clearOAuthState(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "jwt",
-		Value:    jwtString,
-		Path:     "/",
+		Name:     oauthStateCookie,
+		Value:    "",
+		Path:     "/auth",
+		MaxAge:   -1,
 		HttpOnly: true,
 		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
+		SameSite: http.SameSiteLaxMode,
 	})
+}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+// 32 random bytes, URL-safe base64 encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
 
-	return nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Where to send the user after logging in. Local paths are allowed, as are absolute
+// URLs on an origin listed in RETURN_TO_ORIGINS (comma separated); anything else is "/".
+func safeReturnTo(returnTo string) string {
+	if returnTo == "" {
+		return "/"
+	}
+
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return "/"
+	}
+
+	// A local path, but not a protocol-relative "//host" or "/\host"
+	if u.Scheme == "" && u.Host == "" {
+		if strings.HasPrefix(returnTo, "/") && !strings.HasPrefix(returnTo, "//") && !strings.HasPrefix(returnTo, "/\\") {
+			return returnTo
+		}
+		return "/"
+	}
+
+	origin := u.Scheme + "://" + u.Host
+	for _, allowed := range strings.Split(os.Getenv("RETURN_TO_ORIGINS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(origin, allowed) {
+			return returnTo
+		}
+	}
 
+	return "/"
 }
 
 // // function to authenticate jwt and cookie
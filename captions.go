@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/majesticbeast/lostsons.tv/mux"
+)
+
+// Largest subtitles file we accept
+const maxCaptionSize = 1 << 20
+
+// Loose BCP 47 check, e.g. "en", "pt-BR", "zh-Hant"
+var languageCodeRegexp = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// Route for listing the captions of a clip
+func (s *APIServer) handleGetClipCaptions(w http.ResponseWriter, r *http.Request) error {
+	clip, err := s.store.GetClip(chi.URLParam(r, "id"))
+	viewer, loggedIn := s.viewer(r)
+
+	if err != nil || !canViewClip(viewer, loggedIn, clip, false) {
+		return errNotFound("clip")
+	}
+
+	captions, err := s.store.GetClipCaptions(clip.ID)
+	if err != nil {
+		return fmt.Errorf("error getting captions: %w", err)
+	}
+
+	return responseWithJSON(w, http.StatusOK, captions)
+}
+
+// Route for uploading a WebVTT or SRT file and attaching it to a clip's asset
+func (s *APIServer) handleCreateCaption(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseMultipartForm(maxCaptionSize); err != nil {
+		return errBadRequest("error parsing multipart form: %s", err)
+	}
+
+	form, err := parseCaptionForm(r)
+	if err != nil {
+		return err
+	}
+
+	clip, err := s.store.GetClip(form.ClipID)
+	if err != nil {
+		return errNotFound("clip")
+	}
+
+	if !s.canModifyClip(r, clip, PermClipsEdit) {
+		viewer, _ := s.viewer(r)
+		return s.forbid(viewer, PermClipsEdit)
+	}
+
+	file, handler, err := r.FormFile("captions")
+	if err != nil {
+		return errValidation("captions", "is required")
+	}
+	defer file.Close()
+
+	if handler.Size > maxCaptionSize {
+		return errValidation("captions", "is too large")
+	}
+
+	body, err := io.ReadAll(file)
+	if err != nil {
+		return errBadRequest("error reading captions file: %s", err)
+	}
+
+	ext, err := captionFormat(handler.Filename, body)
+	if err != nil {
+		return err
+	}
+
+	caption := Caption{
+		ID:             uuid.New().String(),
+		ClipID:         clip.ID,
+		LanguageCode:   form.LanguageCode,
+		Name:           form.Name,
+		ClosedCaptions: form.ClosedCaptions,
+	}
+	caption.ObjectKey = fmt.Sprintf("captions/%s/%s%s", clip.ID, caption.ID, ext)
+
+	// Upload to Spaces for Mux to fetch
+	sess, err := NewDigitalOceanSession()
+	if err != nil {
+		return errUpstream("spaces", err)
+	}
+
+	svc, err := NewS3Client(sess)
+	if err != nil {
+		return errUpstream("spaces", err)
+	}
+
+	if err := UploadFileToSpaces(svc, bytes.NewReader(body), caption.ObjectKey); err != nil {
+		return errUpstream("spaces", err)
+	}
+
+	inputURL, err := PresignSpacesURL(svc, caption.ObjectKey)
+	if err != nil {
+		return errUpstream("spaces", err)
+	}
+
+	// Attach to the asset, undoing the upload if Mux refuses it
+	client := mux.NewMuxClient()
+	caption.TrackID, err = mux.CreateTextTrack(client, clip.AssetID, inputURL, caption.LanguageCode, caption.Name, caption.ClosedCaptions)
+	if err != nil {
+		err = fmt.Errorf("error creating mux text track: %w", err)
+		if cleanupErr := DeleteFileFromSpaces(svc, caption.ObjectKey); cleanupErr != nil {
+			err = fmt.Errorf("error deleting captions file: %w // %w", cleanupErr, err)
+		}
+		return errUpstream("mux", err)
+	}
+
+	if err := s.store.CreateCaption(caption); err != nil {
+		err = fmt.Errorf("error creating caption: %w", err)
+		if cleanupErr := mux.DeleteTrack(client, clip.AssetID, caption.TrackID); cleanupErr != nil {
+			err = fmt.Errorf("error deleting mux text track: %w // %w", cleanupErr, err)
+		}
+		if cleanupErr := DeleteFileFromSpaces(svc, caption.ObjectKey); cleanupErr != nil {
+			err = fmt.Errorf("error deleting captions file: %w // %w", cleanupErr, err)
+		}
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, caption)
+}
+
+// Route for deleting a caption
+func (s *APIServer) handleDeleteCaption(w http.ResponseWriter, r *http.Request) error {
+	caption, err := s.store.GetCaption(r.PostFormValue("id"))
+	if err != nil {
+		return errNotFound("caption")
+	}
+
+	clip, err := s.store.GetClip(caption.ClipID)
+	if err != nil {
+		return errNotFound("clip")
+	}
+
+	if !s.canModifyClip(r, clip, PermCaptionsDelete) {
+		viewer, _ := s.viewer(r)
+		return s.forbid(viewer, PermCaptionsDelete)
+	}
+
+	client := mux.NewMuxClient()
+	if err := mux.DeleteTrack(client, clip.AssetID, caption.TrackID); err != nil && !mux.IsNotFound(err) {
+		return errUpstream("mux", fmt.Errorf("error deleting mux text track: %w", err))
+	}
+
+	if err := s.store.DeleteCaption(caption.ID); err != nil {
+		return fmt.Errorf("error deleting caption: %w", err)
+	}
+
+	if _, err := s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{ObjectKey: caption.ObjectKey}); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "caption deleted")
+}
+
+func parseCaptionForm(r *http.Request) (NewCaptionForm, error) {
+	captionForm := NewCaptionForm{
+		ClipID:         r.FormValue("clip_id"),
+		LanguageCode:   strings.TrimSpace(r.FormValue("language")),
+		Name:           strings.TrimSpace(r.FormValue("name")),
+		ClosedCaptions: r.FormValue("closed_captions") == "on" || r.FormValue("closed_captions") == "true",
+	}
+
+	if err := validateCaptionForm(captionForm); err != nil {
+		return NewCaptionForm{}, err
+	}
+
+	return captionForm, nil
+}
+
+func validateCaptionForm(captionForm NewCaptionForm) error {
+	if captionForm.ClipID == "" {
+		return errValidation("clip_id", "cannot be empty")
+	}
+
+	if !languageCodeRegexp.MatchString(captionForm.LanguageCode) {
+		return errValidation("language", "is invalid")
+	}
+
+	if utf8.RuneCountInString(captionForm.Name) > 60 {
+		return errValidation("name", "is too long")
+	}
+
+	return nil
+}
+
+// Work out whether a file is WebVTT or SRT, returning the extension to store it under
+func captionFormat(filename string, body []byte) (string, error) {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+
+	if bytes.HasPrefix(body, []byte("WEBVTT")) {
+		return ".vtt", nil
+	}
+
+	// SRT files open with a cue number followed by a timing line
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	lines := []string{}
+	for scanner.Scan() && len(lines) < 2 {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if strings.EqualFold(filepath.Ext(filename), ".srt") && len(lines) == 2 && strings.Contains(lines[1], "-->") {
+		return ".srt", nil
+	}
+
+	return "", errValidation("captions", "must be a WebVTT or SRT file")
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
-	"mime/multipart"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"time"
+	"unicode/utf8"
 
 	"github.com/majesticbeast/lostsons.tv/mux"
 
@@ -15,48 +18,184 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
-	"github.com/go-chi/jwtauth"
+	"github.com/google/uuid"
 )
 
+// How long signed playback and thumbnail tokens are valid for
+const playbackTokenTTL = 15 * time.Minute
+
+// How long Mux has to start fetching an uploaded file. It fetches straight away, and a
+// retried job presigns again.
+const spacesPresignTTL = time.Hour
+
 func (s *APIServer) clipsRouter() chi.Router {
 	r := chi.NewRouter()
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins: []string{"https://*", "http://*"},
-		// AllowedOrigins:   []string{"https://lostsons.tv", "http://localhost:3000"},
+		// Only origins in CORS_ORIGINS; an empty AllowedOrigins would let in every origin
+		AllowOriginFunc:  func(r *http.Request, origin string) bool { return isCORSOrigin(origin) },
 		AllowedMethods:   []string{"GET", "POST", "DELETE"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
-	r.Post("/new", makeHTTPHandleFunc(s.handleCreateClip))
-	r.Get("/", makeHTTPHandleFunc(s.handleGetClips))
+	// Optionally authenticated routes; what is returned depends on who is asking
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Get("/", makeHTTPHandleFunc(s.handleGetClips))
+		r.Get("/{id}", makeHTTPHandleFunc(s.handleGetClip))
+		r.Get("/{id}/playback", makeHTTPHandleFunc(s.handleGetClipPlayback))
+		r.Get("/{id}/download", makeHTTPHandleFunc(s.handleDownloadClip))
+		r.Get("/{id}/captions", makeHTTPHandleFunc(s.handleGetClipCaptions))
+		r.Get("/duplicates", makeHTTPHandleFunc(s.handleGetClipDuplicates))
+	})
 
 	// Protected routes
 	r.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(jwtauth.Authenticator)
+		r.Use(s.authenticate)
+		r.Use(s.requireAuth)
+		r.With(s.RequirePermission(PermClipsCreate), s.rateLimit(uploadRatePolicy)).Post("/new", makeHTTPHandleFunc(s.handleCreateClip))
+		r.Post("/edit", makeHTTPHandleFunc(s.handleEditClip))
 		r.Post("/delete", makeHTTPHandleFunc(s.handleDeleteClip))
+		r.With(s.RequirePermission(PermCaptionsCreate)).Post("/captions/new", makeHTTPHandleFunc(s.handleCreateCaption))
+		r.Post("/captions/delete", makeHTTPHandleFunc(s.handleDeleteCaption))
+		r.Post("/duplicates/confirm", makeHTTPHandleFunc(s.handleConfirmClipDuplicate))
 	})
 
 	return r
 }
 
-// Route for getting all clips
+// Route for getting all clips the requester is allowed to see listed
 func (s *APIServer) handleGetClips(w http.ResponseWriter, r *http.Request) error {
 	clips, err := s.store.GetAllClips()
 	if err != nil {
 		return fmt.Errorf("error getting all clips: %w", err)
 	}
 
-	return responseWithJSON(w, http.StatusOK, clips)
+	return responseWithJSON(w, http.StatusOK, s.listedClips(r, clips))
 }
 
-// Route for submitting a clip
+// Route for getting one clip and its captions. Unlisted clips can be got by ID.
+func (s *APIServer) handleGetClip(w http.ResponseWriter, r *http.Request) error {
+	clip, err := s.store.GetClip(chi.URLParam(r, "id"))
+	viewer, loggedIn := s.viewer(r)
+
+	if err != nil || !canViewClip(viewer, loggedIn, clip, false) {
+		return errNotFound("clip")
+	}
+
+	clip.Captions, err = s.store.GetClipCaptions(clip.ID)
+	if err != nil {
+		return fmt.Errorf("error getting clip captions: %w", err)
+	}
+
+	return responseWithJSON(w, http.StatusOK, clip)
+}
+
+// The clips the requester may see in a listing
+func (s *APIServer) listedClips(r *http.Request, clips []Clip) []Clip {
+	viewer, loggedIn := s.viewer(r)
+	visible := []Clip{}
+	for _, clip := range clips {
+		if canViewClip(viewer, loggedIn, clip, true) {
+			visible = append(visible, clip)
+		}
+	}
+
+	return visible
+}
+
+// A query for the clips a viewer may see in a listing, for Storage to filter. It must
+// list the same clips as canViewClip.
+func listedClipsQuery(viewer User, loggedIn bool) ClipPageQuery {
+	q := ClipPageQuery{Visibilities: []string{VisibilityPublic, ""}}
+	if loggedIn {
+		q.Visibilities = append(q.Visibilities, VisibilityMembers)
+		q.PrivateOf = viewer.ID
+		if hasPermission(viewer.Role, PermClipsViewPrivate) {
+			q.Visibilities = append(q.Visibilities, VisibilityPrivate)
+		}
+	}
+
+	return q
+}
+
+// Route for getting playback details, with short-lived tokens for signed clips
+func (s *APIServer) handleGetClipPlayback(w http.ResponseWriter, r *http.Request) error {
+	clip, err := s.store.GetClip(chi.URLParam(r, "id"))
+	viewer, loggedIn := s.viewer(r)
+
+	// Clips the viewer may not see are reported as missing rather than forbidden
+	if err != nil || !canViewClip(viewer, loggedIn, clip, false) {
+		return errNotFound("clip")
+	}
+
+	playback := ClipPlayback{
+		PlaybackID:   clip.PlaybackID,
+		Visibility:   clip.Visibility,
+		PlaybackURL:  fmt.Sprintf("https://stream.mux.com/%s.m3u8", clip.PlaybackID),
+		ThumbnailURL: fmt.Sprintf("https://image.mux.com/%s/thumbnail.jpg", clip.PlaybackID),
+	}
+
+	if isSignedVisibility(clip.Visibility) {
+		playback.PlaybackToken, err = mux.SignPlaybackToken(clip.PlaybackID, mux.AudienceVideo, playbackTokenTTL, nil)
+		if err != nil {
+			return fmt.Errorf("error signing playback token: %w", err)
+		}
+
+		playback.ThumbnailToken, err = mux.SignPlaybackToken(clip.PlaybackID, mux.AudienceThumbnail, playbackTokenTTL, nil)
+		if err != nil {
+			return fmt.Errorf("error signing thumbnail token: %w", err)
+		}
+
+		playback.PlaybackURL += "?token=" + playback.PlaybackToken
+		playback.ThumbnailURL += "?token=" + playback.ThumbnailToken
+		playback.ExpiresAt = time.Now().Add(playbackTokenTTL)
+	}
+
+	return responseWithJSON(w, http.StatusOK, playback)
+}
+
+// Route for downloading a clip's MP4 rendition. Redirects to Mux once the
+// static_renditions.ready webhook has recorded which rendition exists.
+func (s *APIServer) handleDownloadClip(w http.ResponseWriter, r *http.Request) error {
+	clip, err := s.store.GetClip(chi.URLParam(r, "id"))
+	viewer, loggedIn := s.viewer(r)
+
+	if err != nil || !canViewClip(viewer, loggedIn, clip, false) {
+		return errNotFound("clip")
+	}
+
+	if !clip.Downloadable {
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "clip is not downloadable"}
+	}
+
+	if clip.MP4Rendition == "" {
+		return errConflict("download is not ready yet")
+	}
+
+	query := url.Values{}
+	query.Set("download", clip.ID)
+	if isSignedVisibility(clip.Visibility) {
+		token, err := mux.SignPlaybackToken(clip.PlaybackID, mux.AudienceVideo, playbackTokenTTL, nil)
+		if err != nil {
+			return fmt.Errorf("error signing download token: %w", err)
+		}
+		query.Set("token", token)
+	}
+
+	downloadURL := fmt.Sprintf("https://stream.mux.com/%s/%s?%s", clip.PlaybackID, clip.MP4Rendition, query.Encode())
+	http.Redirect(w, r, downloadURL, http.StatusFound)
+
+	return nil
+}
+
+// Route for submitting a clip. The file is uploaded to Spaces and the job queue
+// creates the Mux asset and inserts the clip.
 func (s *APIServer) handleCreateClip(w http.ResponseWriter, r *http.Request) error {
 	newForm := new(NewClipForm)
 	if err := r.ParseMultipartForm(45 << 20); err != nil {
-		return fmt.Errorf("error parsing multipart form: %w", err)
+		return errBadRequest("error parsing multipart form: %s", err)
 	}
 
 	newForm.Description = r.FormValue("description")
@@ -64,62 +203,123 @@ func (s *APIServer) handleCreateClip(w http.ResponseWriter, r *http.Request) err
 	newForm.Username = r.FormValue("username")
 	newForm.Tags = r.FormValue("tags")
 	newForm.FeaturedUsers = r.FormValue("featured_users")
+	newForm.Visibility = r.FormValue("visibility")
+	newForm.Downloadable = r.FormValue("downloadable") == "on" || r.FormValue("downloadable") == "true"
+
+	// Uploads are credited to the uploader unless they may upload for others
+	uploader, _ := userFromContext(r.Context())
+	if newForm.Username == "" {
+		newForm.Username = uploader.Username
+	}
+
+	if newForm.Username != uploader.Username && !s.can(r, PermClipsCreateOthers) {
+		return s.forbid(uploader, PermClipsCreateOthers)
+	}
+
+	if err := s.validateClipForm(newForm); err != nil {
+		return err
+	}
 
 	// Get file from form
 	file, handler, err := r.FormFile("clip")
 	if err != nil {
-		return fmt.Errorf("error getting file from form: %w", err)
+		return errValidation("clip", "is required")
 	}
 	defer file.Close()
 
-	// Upload file to DigitalOcean Spaces
-	sess, err := NewDigitalOceanSession()
+	// Reject a file that has already been uploaded
+	contentHash, err := hashContent(file)
 	if err != nil {
-		return fmt.Errorf("error creating new digital ocean session: %w", err)
+		return err
 	}
 
-	svc, err := NewS3Client(sess)
-	if err != nil {
-		return fmt.Errorf("error creating new s3 client: %w", err)
+	if existing, err := s.store.GetClipByContentHash(contentHash); err == nil {
+		// Only point at the existing clip if the uploader could see it anyway
+		apiErr := errConflict("clip has already been uploaded")
+		if canViewClip(uploader, true, existing, false) {
+			apiErr.Details = map[string]interface{}{
+				"clip_id": existing.ID,
+				"url":     fmt.Sprintf("/clips/%s/playback", existing.ID),
+			}
+		}
+		return apiErr
 	}
 
-	err = UploadFileToSpaces(svc, file, handler)
+	// Check the uploader has room for the clip
+	user, err := s.store.GetUserByUsername(newForm.Username)
 	if err != nil {
-		return fmt.Errorf("error uploading file to spaces: %w", err)
+		return errNotFound("user")
+	}
+
+	if err := s.checkDailyUploads(user); err != nil {
+		return err
 	}
 
-	// Create a new Mux client and asset
-	client := mux.NewMuxClient()
-	asset, err := mux.CreateAsset(client, handler.Filename)
+	if err := s.reserveQuota(user, handler.Size); err != nil {
+		return err
+	}
+
+	// Put the file in Spaces before queueing, so any worker can create the asset
+	objectKey := uuid.New().String() + filepath.Ext(handler.Filename)
+	jobID, err := s.ingestClip(file, objectKey, contentHash, handler.Size, *newForm, time.Now())
 	if err != nil {
-		return fmt.Errorf("error creating mux asset: %w", err)
+		s.releaseQuota(user.Username, handler.Size)
+		return err
 	}
 
-	// Create a new clip object
-	clip := Clip{
-		PlaybackID:    asset.Data.PlaybackIds[0].Id,
-		AssetID:       asset.Data.Id,
-		Description:   newForm.Description,
-		Game:          newForm.Game,
-		Username:      newForm.Username,
-		Tags:          newForm.Tags,
-		FeaturedUsers: newForm.FeaturedUsers,
-		DateUploaded:  time.Now(),
+	if err := s.store.RecordUpload(user.ID, handler.Size); err != nil {
+		s.log.Warn(err.Error())
 	}
 
-	// Add clip to database
-	err = s.store.CreateClip(clip)
+	return responseWithJSON(w, http.StatusAccepted, map[string]string{"status": "clip queued", "job_id": jobID})
+}
+
+// Route for editing a clip's description or game. Fields left out are unchanged.
+func (s *APIServer) handleEditClip(w http.ResponseWriter, r *http.Request) error {
+	clip, err := s.store.GetClip(r.PostFormValue("id"))
 	if err != nil {
-		err = fmt.Errorf("error creating clip: %w", err)
+		return errNotFound("clip")
+	}
 
-		// Need to delete asset from Mux if we errored out inserting data into the database
-		if err_mux := mux.DeleteAsset(client, clip.AssetID); err != nil {
-			err = fmt.Errorf("error deleting failed mux asset and error inserting into db: %w // %w", err_mux, err)
-		}
+	if !s.canModifyClip(r, clip, PermClipsEdit) {
+		viewer, _ := s.viewer(r)
+		return s.forbid(viewer, PermClipsEdit)
+	}
+
+	var description *string
+	if _, ok := r.PostForm["description"]; ok {
+		value := r.PostFormValue("description")
+		description = &value
+	}
+
+	if err := s.editClip(clip, description, r.PostFormValue("game")); err != nil {
 		return err
 	}
 
-	return responseWithJSON(w, http.StatusOK, "clip added")
+	return responseWithJSON(w, http.StatusOK, "clip updated")
+}
+
+// Change a clip's description and game, for a request already allowed to. A nil
+// description or an empty game name leaves it as it is.
+func (s *APIServer) editClip(clip Clip, description *string, gameName string) error {
+	if description == nil {
+		description = &clip.Description
+	}
+
+	if utf8.RuneCountInString(*description) > 120 {
+		return errValidation("description", "is too long")
+	}
+
+	gameID := clip.GameID
+	if gameName != "" {
+		game, err := s.store.GetGameByName(gameName)
+		if err != nil {
+			return errNotFound("game")
+		}
+		gameID = game.ID
+	}
+
+	return s.store.UpdateClipDetails(clip.ID, *description, gameID)
 }
 
 // Route for deleting a clip
@@ -130,22 +330,46 @@ func (s *APIServer) handleDeleteClip(w http.ResponseWriter, r *http.Request) err
 	// Get the clip data from the database
 	clip, err := s.store.GetClip(clipID)
 	if err != nil {
-		return fmt.Errorf("clip does not exist")
+		return errNotFound("clip")
+	}
+
+	if !s.canModifyClip(r, clip, PermClipsDelete) {
+		viewer, _ := s.viewer(r)
+		return s.forbid(viewer, PermClipsDelete)
 	}
 
-	// Delete clip from Mux
-	client := mux.NewMuxClient()
-	if err := mux.DeleteAsset(client, clip.AssetID); err != nil {
-		return fmt.Errorf("error deleting mux asset: %w", err)
+	if err := s.deleteClip(clip); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "clip deleted")
+}
+
+// Delete a clip. Rows are removed straight away; the Mux asset and bucket objects
+// are removed by cleanup jobs so a Mux outage can't block the delete.
+func (s *APIServer) deleteClip(clip Clip) error {
+	// Delete captions; their tracks go with the asset, their files are cleaned up below
+	captions, err := s.store.GetClipCaptions(clip.ID)
+	if err != nil {
+		return fmt.Errorf("error getting clip captions: %w", err)
+	}
+
+	if err := s.store.DeleteClipCaptionsClipID(clip.ID); err != nil {
+		return fmt.Errorf("error deleting clip_id from clip_captions: %w", err)
+	}
+
+	// Delete duplicate flags
+	if err := s.store.DeleteClipDuplicatesClipID(clip.ID); err != nil {
+		return fmt.Errorf("error deleting clip_id from clip_duplicates: %w", err)
 	}
 
 	// Delete clip_id from clips_users
-	if err := s.store.DeleteClipsUsersClipID(clipID); err != nil {
+	if err := s.store.DeleteClipsUsersClipID(clip.ID); err != nil {
 		return fmt.Errorf("error deleting clip_id from clips_users: %w", err)
 	}
 
 	// Delete clip_id from clips_tags
-	if err := s.store.DeleteClipsTagsClipID(clipID); err != nil {
+	if err := s.store.DeleteClipsTagsClipID(clip.ID); err != nil {
 		return fmt.Errorf("error deleting clip_id from clips_tags: %w", err)
 	}
 
@@ -154,7 +378,79 @@ func (s *APIServer) handleDeleteClip(w http.ResponseWriter, r *http.Request) err
 		return fmt.Errorf("error deleting clip: %w", err)
 	}
 
-	return responseWithJSON(w, http.StatusOK, "clip deleted")
+	// Delete asset from Mux and file from Spaces
+	_, err = s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{
+		AssetID:   clip.AssetID,
+		ObjectKey: clip.ObjectKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, caption := range captions {
+		if _, err := s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{ObjectKey: caption.ObjectKey}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check a clip form before anything is uploaded, so an unknown game or user is
+// reported now rather than by a failing background job. Fills in the default visibility.
+func (s *APIServer) validateClipForm(clipForm *NewClipForm) error {
+	if clipForm.Visibility == "" {
+		clipForm.Visibility = VisibilityPublic
+	}
+
+	if !isValidVisibility(clipForm.Visibility) {
+		return errValidation("visibility", "is invalid")
+	}
+
+	if utf8.RuneCountInString(clipForm.Description) > 120 {
+		return errValidation("description", "is too long")
+	}
+
+	if _, err := s.store.GetGameByName(clipForm.Game); err != nil {
+		return errNotFound("game")
+	}
+
+	if _, err := s.store.GetUserByUsername(clipForm.Username); err != nil {
+		return errNotFound("user")
+	}
+
+	return nil
+}
+
+// Decide whether a viewer may see a clip. Unlisted clips can be played by anyone
+// with the ID but are left out of listings.
+func canViewClip(viewer User, loggedIn bool, clip Clip, listing bool) bool {
+	switch clip.Visibility {
+	case VisibilityPublic, "":
+		return true
+	case VisibilityUnlisted:
+		return !listing
+	case VisibilityMembers:
+		return loggedIn
+	case VisibilityPrivate:
+		return loggedIn && (viewer.ID == clip.UserID || hasPermission(viewer.Role, PermClipsViewPrivate))
+	default:
+		return false
+	}
+}
+
+func isValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityMembers, VisibilityPrivate:
+		return true
+	default:
+		return false
+	}
+}
+
+// Members-only and private clips are created with a signed playback policy
+func isSignedVisibility(visibility string) bool {
+	return visibility == VisibilityMembers || visibility == VisibilityPrivate
 }
 
 func NewDigitalOceanSession() (*session.Session, error) {
@@ -181,12 +477,13 @@ func NewS3Client(sess *session.Session) (*s3.S3, error) {
 	return svc, nil
 }
 
-func UploadFileToSpaces(svc *s3.S3, file multipart.File, handler *multipart.FileHeader) error {
+// Upload a private object. Mux is given a presigned URL to fetch it; nobody else can.
+func UploadFileToSpaces(svc *s3.S3, file io.ReadSeeker, key string) error {
 	_, err := svc.PutObject(&s3.PutObjectInput{
 		Bucket: aws.String("lostsonstv"),
-		Key:    aws.String(handler.Filename),
+		Key:    aws.String(key),
 		Body:   file,
-		ACL:    aws.String("public-read"),
+		ACL:    aws.String("private"),
 	})
 	if err != nil {
 		err = fmt.Errorf("error uploading file to spaces: %w", err)
@@ -195,3 +492,65 @@ func UploadFileToSpaces(svc *s3.S3, file multipart.File, handler *multipart.File
 
 	return nil
 }
+
+// A URL Mux can fetch a private object from for spacesPresignTTL
+func PresignSpacesURL(svc *s3.S3, key string) (string, error) {
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String("lostsonstv"),
+		Key:    aws.String(key),
+	})
+
+	signed, err := req.Presign(spacesPresignTTL)
+	if err != nil {
+		err = fmt.Errorf("error presigning spaces url: %w", err)
+		return "", err
+	}
+
+	return signed, nil
+}
+
+// Make an object private, for objects uploaded before uploads were
+func MakeSpacesObjectPrivate(svc *s3.S3, key string) error {
+	_, err := svc.PutObjectAcl(&s3.PutObjectAclInput{
+		Bucket: aws.String("lostsonstv"),
+		Key:    aws.String(key),
+		ACL:    aws.String("private"),
+	})
+	if err != nil {
+		err = fmt.Errorf("error making spaces object private: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+func DeleteFileFromSpaces(svc *s3.S3, key string) error {
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String("lostsonstv"),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		err = fmt.Errorf("error deleting file from spaces: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// List every object in the bucket, following pagination
+func ListSpacesObjects(svc *s3.S3) ([]*s3.Object, error) {
+	objects := []*s3.Object{}
+
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String("lostsonstv"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		err = fmt.Errorf("error listing spaces objects: %w", err)
+		return nil, err
+	}
+
+	return objects, nil
+}
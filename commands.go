@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Run a one-off command instead of the HTTP server, e.g. `lostsonstv reconcile -dry-run=false`
+func (s *APIServer) runCommand(name string, args []string) error {
+	switch name {
+	case "reconcile":
+		return s.reconcileCommand(args)
+	case "import":
+		return s.importCommand(args)
+	case "fingerprint":
+		return s.fingerprintCommand(args)
+	case "role":
+		return s.roleCommand(args)
+	case "link-discord":
+		return s.linkDiscordCommand(args)
+	case "keys":
+		return s.keysCommand(args)
+	case "openapi":
+		return s.openAPICommand(args)
+	case "make-private":
+		return s.makePrivateCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func (s *APIServer) reconcileCommand(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", true, "report drift without changing anything")
+	deleteOrphans := fs.Bool("delete-orphans", false, "queue deletion of orphaned Mux assets and bucket objects")
+	recreateRows := fs.Bool("recreate-rows", false, "re-create clips rows for orphaned assets from their upload jobs")
+	minAge := fs.Duration("min-age", defaultReconcileMinAge, "ignore assets and objects newer than this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := s.reconcile(ReconcileOptions{
+		DryRun:        *dryRun,
+		DeleteOrphans: *deleteOrphans,
+		RecreateRows:  *recreateRows,
+		MinAge:        *minAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func (s *APIServer) importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory of clips to import")
+	medal := fs.String("medal", "", "medal.tv export manifest to import")
+	mappingPath := fs.String("mapping", "", "JSON file mapping games, users and tags")
+	statePath := fs.String("state", "import-state.json", "progress file, used to resume an interrupted import")
+	reportPath := fs.String("report", "", "write the report here instead of stdout")
+	concurrency := fs.Int("concurrency", 4, "number of clips uploaded at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if (*dir == "") == (*medal == "") {
+		return fmt.Errorf("import needs exactly one of -dir or -medal")
+	}
+
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	mapping, err := loadImportMapping(*mappingPath)
+	if err != nil {
+		return err
+	}
+
+	var items []importItem
+	if *dir != "" {
+		items, err = importItemsFromDir(*dir, mapping)
+	} else {
+		items, err = importItemsFromMedal(*medal, mapping)
+	}
+	if err != nil {
+		return err
+	}
+
+	state, err := loadImportState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	s.importClips(items, state, *concurrency)
+
+	out := os.Stdout
+	if *reportPath != "" {
+		out, err = os.Create(*reportPath)
+		if err != nil {
+			return fmt.Errorf("error creating report: %w", err)
+		}
+		defer out.Close()
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state.report())
+}
+
+// Queue fingerprinting of every clip that doesn't have a fingerprint yet
+func (s *APIServer) fingerprintCommand(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	clips, err := s.store.GetAllClips()
+	if err != nil {
+		return err
+	}
+
+	queued := 0
+	for _, clip := range clips {
+		if clip.Fingerprint != "" {
+			continue
+		}
+
+		if _, err := s.enqueueJob(jobTypeFingerprint, defaultJobQueue, fingerprintJobPayload{AssetID: clip.AssetID}); err != nil {
+			return err
+		}
+		queued++
+	}
+
+	fmt.Printf("queued %d clips for fingerprinting\n", queued)
+	return nil
+}
+
+// Set a user's role, e.g. to make the first admin before anyone can use the admin panel
+func (s *APIServer) roleCommand(args []string) error {
+	fs := flag.NewFlagSet("role", flag.ExitOnError)
+	username := fs.String("username", "", "user to change")
+	role := fs.String("role", "", "viewer, uploader, moderator or admin; overrides the Discord role mapping")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !isValidRole(*role) {
+		return fmt.Errorf("role is invalid")
+	}
+
+	user, err := s.store.GetUserByUsername(*username)
+	if err != nil {
+		return fmt.Errorf("user does not exist")
+	}
+
+	if err := s.setUserRole(user, *role, roleSourceManual, "command"); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is now %s\n", user.Username, *role)
+	return nil
+}
+
+// Link an existing user to a Discord account, for rows that can't be matched by email
+func (s *APIServer) linkDiscordCommand(args []string) error {
+	fs := flag.NewFlagSet("link-discord", flag.ExitOnError)
+	username := fs.String("username", "", "user to link")
+	discordID := fs.String("discord-id", "", "snowflake ID of their Discord account")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *discordID == "" {
+		return fmt.Errorf("discord-id is required")
+	}
+
+	user, err := s.store.GetUserByUsername(*username)
+	if err != nil {
+		return fmt.Errorf("user does not exist")
+	}
+
+	if other, err := s.store.GetUserByDiscordID(*discordID); err == nil && other.ID != user.ID {
+		return fmt.Errorf("discord account is already linked to %s", other.Username)
+	}
+
+	user.DiscordID = *discordID
+	if err := s.store.UpdateUserDiscordProfile(user); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is now linked to discord account %s\n", user.Username, user.DiscordID)
+	return nil
+}
+
+// Manage the keys JWTs are signed with, in JWT_KEYS_DIR. Rotate by generating a key,
+// waiting for every instance to load it, then activating it:
+//
+//	lostsonstv keys generate -alg EdDSA
+//	lostsonstv keys rotate -overlap 168h
+func (s *APIServer) keysCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("keys needs a subcommand: list, generate or rotate")
+	}
+
+	switch args[0] {
+	case "list":
+		manifest, err := readKeyManifest()
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(manifest.Keys)
+	case "generate":
+		fs := flag.NewFlagSet("keys generate", flag.ExitOnError)
+		alg := fs.String("alg", "EdDSA", "EdDSA or RS256")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		key, err := generateSigningKey(*alg)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("generated pending key %s (%s); run `keys rotate` once every instance has loaded it\n", key.ID, key.Algorithm)
+		return nil
+	case "rotate":
+		fs := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+		overlap := fs.Duration("overlap", sessionTTL, "how long tokens signed by the old key stay valid")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		key, err := rotateSigningKeys(*overlap)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("key %s is now active; the previous key retires in %s\n", key.ID, *overlap)
+		return nil
+	default:
+		return fmt.Errorf("unknown keys subcommand %q", args[0])
+	}
+}
+
+// Make every bucket object private. Clips used to be uploaded public-read, which let
+// anyone with a key fetch the source of a members-only or private clip.
+func (s *APIServer) makePrivateCommand(args []string) error {
+	fs := flag.NewFlagSet("make-private", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", true, "count the objects without changing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sess, err := NewDigitalOceanSession()
+	if err != nil {
+		return err
+	}
+
+	svc, err := NewS3Client(sess)
+	if err != nil {
+		return err
+	}
+
+	objects, err := ListSpacesObjects(svc)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("%d objects would be made private\n", len(objects))
+		return nil
+	}
+
+	failed := 0
+	for _, object := range objects {
+		if err := MakeSpacesObjectPrivate(svc, *object.Key); err != nil {
+			s.log.Warn(err.Error())
+			failed++
+		}
+	}
+
+	fmt.Printf("made %d of %d objects private\n", len(objects)-failed, len(objects))
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be made private", failed)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Form field and header a CSRF token can be sent in
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// HMAC key for CSRF tokens, from SESSION_ENCRYPTION_KEY or, if that isn't set, JWT_SECRET
+func csrfKey() []byte {
+	secret := os.Getenv("SESSION_ENCRYPTION_KEY")
+	if secret == "" {
+		secret = os.Getenv("JWT_SECRET")
+	}
+
+	key := sha256.Sum256([]byte("lostsons.tv csrf:" + secret))
+	return key[:]
+}
+
+// A session's CSRF token. It is derived from the session, so it needs no storage and
+// stops working when the session is revoked.
+func csrfToken(session Session) string {
+	mac := hmac.New(sha256.New, csrfKey())
+	mac.Write([]byte(session.ID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// Origins other than our own that may call the API with credentials, from CORS_ORIGINS
+// (comma separated, e.g. "https://lostsons.tv,http://localhost:3000")
+func corsOrigins() []string {
+	return splitEnvList("CORS_ORIGINS")
+}
+
+func isCORSOrigin(origin string) bool {
+	for _, allowed := range corsOrigins() {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether an unsafe request comes from one of our pages, going by Origin or, failing
+// that, Referer. Requests with neither are left to the token check.
+func isTrustedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer, err := url.Parse(r.Referer())
+		if err != nil || referer.Host == "" {
+			return true
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host) || isCORSOrigin(origin)
+}
+
+// Check an unsafe request authenticated by the session cookie came from our own pages:
+// its origin must be trusted and it must carry the session's CSRF token
+func (s *APIServer) checkCSRF(r *http.Request, session Session) error {
+	if isSafeMethod(r.Method) {
+		return nil
+	}
+
+	if !isTrustedOrigin(r) {
+		return fmt.Errorf("origin not allowed")
+	}
+
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfFormField)
+	}
+
+	if !hmac.Equal([]byte(token), []byte(csrfToken(session))) {
+		return fmt.Errorf("invalid csrf token")
+	}
+
+	return nil
+}
+
+// Parse a page template with csrfField available, so its forms can carry the request's
+// CSRF token. Any other funcs the page needs are passed in funcs.
+func (s *APIServer) parsePage(r *http.Request, path string, funcs template.FuncMap) (*template.Template, error) {
+	token := ""
+	if session, ok := s.currentSession(r); ok {
+		token = csrfToken(session)
+	}
+
+	pageFuncs := template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfFormField, template.HTMLEscapeString(token)))
+		},
+	}
+	for name, f := range funcs {
+		pageFuncs[name] = f
+	}
+
+	return template.New(filepath.Base(path)).Funcs(pageFuncs).ParseFiles(path)
+}
+
+// Render a page in full before sending it, so a template error is answered with a 500
+// instead of half a page
+func renderPage(w http.ResponseWriter, t *template.Template, data interface{}) error {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return errInternal(fmt.Errorf("error rendering %s: %w", t.Name(), err))
+	}
+
+	writeResponse(w, http.StatusOK, "text/html; charset=utf-8", b.Bytes())
+	return nil
+}
+
+// Route for getting the session's CSRF token, for scripts that post to the API
+func (s *APIServer) handleGetCSRFToken(w http.ResponseWriter, r *http.Request) error {
+	session, ok := s.currentSession(r)
+	if !ok {
+		return errUnauthorized()
+	}
+
+	return responseWithJSON(w, http.StatusOK, map[string]string{"csrf_token": csrfToken(session)})
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majesticbeast/lostsons.tv/mux"
+)
+
+// Status of a suspected duplicate
+const (
+	duplicatePending = "pending"
+	duplicateKept    = "kept"
+)
+
+// Clips whose frames differ by at most this many bits (of 64, averaged over the
+// sampled frames) are flagged as near-duplicates
+const nearDuplicateThreshold = 8
+
+// Points in a clip, as a fraction of its duration, sampled for the fingerprint
+var fingerprintFrames = []float64{0.2, 0.4, 0.6, 0.8}
+
+// Thumbnails are small. A slow or oversized one fails the attempt, and the job retries.
+var thumbnailClient = &http.Client{Timeout: 30 * time.Second}
+
+const maxThumbnailSize = 1 << 20
+
+type fingerprintJobPayload struct {
+	AssetID string `json:"asset_id"`
+}
+
+// SHA-256 of everything in r, leaving r rewound to the start
+func hashContent(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("error hashing content: %w", err)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("error rewinding content: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Compute a clip's perceptual fingerprint from Mux thumbnails and flag any existing
+// clip that looks the same
+func (s *APIServer) handleFingerprintJob(job Job) error {
+	payload := fingerprintJobPayload{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("error unmarshalling fingerprint payload: %w", err)
+	}
+
+	clip, err := s.store.GetClipByAssetID(payload.AssetID)
+	if err != nil {
+		return err
+	}
+
+	client := mux.NewMuxClient()
+	asset, err := mux.GetAsset(client, clip.AssetID)
+	if err != nil {
+		return fmt.Errorf("error getting mux asset: %w", err)
+	}
+
+	// Duration counts against the uploader's quota
+	if err := s.store.UpdateClipDuration(clip.AssetID, asset.Data.Duration); err != nil {
+		return err
+	}
+
+	fingerprint, err := fingerprintClip(clip, asset.Data.Duration)
+	if err != nil {
+		return err
+	}
+
+	clips, err := s.store.GetAllClips()
+	if err != nil {
+		return fmt.Errorf("error getting clips: %w", err)
+	}
+
+	for _, other := range clips {
+		if other.ID == clip.ID || other.Fingerprint == "" {
+			continue
+		}
+
+		distance, ok := fingerprintDistance(fingerprint, other.Fingerprint)
+		if !ok || distance > nearDuplicateThreshold {
+			continue
+		}
+
+		// The newer upload is the one the uploader is asked about. The pair always comes
+		// out the same way round, so a rerun finds the flag, resolved or not, already there.
+		duplicate := ClipDuplicate{ClipID: clip.ID, DuplicateOf: other.ID, Distance: distance}
+		if other.DateUploaded.After(clip.DateUploaded) || (other.DateUploaded.Equal(clip.DateUploaded) && other.ID > clip.ID) {
+			duplicate.ClipID, duplicate.DuplicateOf = other.ID, clip.ID
+		}
+
+		if err := s.store.CreateClipDuplicate(duplicate); err != nil {
+			return err
+		}
+	}
+
+	return s.store.UpdateClipFingerprint(clip.ID, fingerprint)
+}
+
+// dHash a thumbnail at each sample point and join them into one hex string
+func fingerprintClip(clip Clip, duration float64) (string, error) {
+	hashes := []string{}
+
+	for _, at := range fingerprintFrames {
+		thumbURL, err := mux.ThumbnailURL(clip.PlaybackID, duration*at, 64, isSignedVisibility(clip.Visibility))
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := thumbnailClient.Get(thumbURL)
+		if err != nil {
+			return "", fmt.Errorf("error getting thumbnail: %w", err)
+		}
+
+		// An error page would hash as a frame and match every other error page
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("unexpected status getting thumbnail: %s", resp.Status)
+		}
+
+		img, err := jpeg.Decode(io.LimitReader(resp.Body, maxThumbnailSize))
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("error decoding thumbnail: %w", err)
+		}
+
+		hashes = append(hashes, fmt.Sprintf("%016x", dHash(img)))
+	}
+
+	return strings.Join(hashes, ""), nil
+}
+
+// Difference hash: shrink to 9x8 and set a bit wherever a cell is brighter than its right neighbour
+func dHash(img image.Image) uint64 {
+	var hash uint64
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if cellLuminance(img, x, y, 9, 8) > cellLuminance(img, x+1, y, 9, 8) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+
+	return hash
+}
+
+// Average luminance of cell (cx, cy) when img is divided into a cols by rows grid
+func cellLuminance(img image.Image, cx int, cy int, cols int, rows int) float64 {
+	b := img.Bounds()
+	x0, x1 := b.Min.X+cx*b.Dx()/cols, b.Min.X+(cx+1)*b.Dx()/cols
+	y0, y1 := b.Min.Y+cy*b.Dy()/rows, b.Min.Y+(cy+1)*b.Dy()/rows
+
+	sum, n := 0.0, 0
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			n++
+		}
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	return sum / float64(n)
+}
+
+// Average number of differing bits per frame between two fingerprints
+func fingerprintDistance(a string, b string) (int, bool) {
+	if len(a) != len(b) || len(a) == 0 || len(a)%16 != 0 {
+		return 0, false
+	}
+
+	total, frames := 0, len(a)/16
+	for i := 0; i < frames; i++ {
+		x, errA := strconv.ParseUint(a[i*16:(i+1)*16], 16, 64)
+		y, errB := strconv.ParseUint(b[i*16:(i+1)*16], 16, 64)
+		if errA != nil || errB != nil {
+			return 0, false
+		}
+		total += bits.OnesCount64(x ^ y)
+	}
+
+	return total / frames, true
+}
+
+// Route for listing the logged in user's clips that were flagged as possible duplicates
+func (s *APIServer) handleGetClipDuplicates(w http.ResponseWriter, r *http.Request) error {
+	viewer, loggedIn := s.viewer(r)
+	if !loggedIn {
+		return errUnauthorized()
+	}
+
+	mine, err := s.store.GetPendingClipDuplicatesForUploader(viewer.ID)
+	if err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, mine)
+}
+
+// Route for the uploader to resolve a flag: action "keep" clears it, "delete" removes the clip
+func (s *APIServer) handleConfirmClipDuplicate(w http.ResponseWriter, r *http.Request) error {
+	viewer, loggedIn := s.viewer(r)
+	if !loggedIn {
+		return errUnauthorized()
+	}
+
+	duplicate, err := s.store.GetClipDuplicate(r.PostFormValue("id"))
+	if err != nil {
+		return errNotFound("duplicate")
+	}
+
+	clip, err := s.store.GetClip(duplicate.ClipID)
+	if err != nil {
+		return errNotFound("clip")
+	}
+
+	if !s.canModifyClip(r, clip, PermDuplicatesResolve) {
+		return s.forbid(viewer, PermDuplicatesResolve)
+	}
+
+	switch r.PostFormValue("action") {
+	case "keep":
+		if err := s.store.UpdateClipDuplicateStatus(duplicate.ID, duplicateKept); err != nil {
+			return err
+		}
+		return responseWithJSON(w, http.StatusOK, "clip kept")
+	case "delete":
+		if err := s.deleteClip(clip); err != nil {
+			return err
+		}
+		return responseWithJSON(w, http.StatusOK, "clip deleted")
+	default:
+		return errValidation("action", "must be keep or delete")
+	}
+}
+
+// Admin report of exact and suspected duplicates among existing clips
+func (s *APIServer) handleAdminDuplicates(w http.ResponseWriter, r *http.Request) error {
+	clips, err := s.store.GetAllClips()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	duplicates, err := s.store.GetAllClipDuplicates()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	// Group clips sharing a content hash
+	byHash := map[string][]Clip{}
+	for _, clip := range clips {
+		if clip.ContentHash != "" {
+			byHash[clip.ContentHash] = append(byHash[clip.ContentHash], clip)
+		}
+	}
+
+	exact := [][]Clip{}
+	for _, group := range byHash {
+		if len(group) > 1 {
+			exact = append(exact, group)
+		}
+	}
+
+	data := struct {
+		Exact      [][]Clip
+		Suspected  []ClipDuplicate
+		Unhashed   int
+		TotalClips int
+	}{
+		Exact:      exact,
+		Suspected:  duplicates,
+		TotalClips: len(clips),
+	}
+
+	for _, clip := range clips {
+		if clip.Fingerprint == "" {
+			data.Unhashed++
+		}
+	}
+
+	t, err := s.parsePage(r, "./templates/admin/duplicates.html", nil)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	return renderPage(w, t, data)
+}
@@ -3,24 +3,89 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/jwtauth"
 )
 
+// Clips shown with a game
+const recentGameClips = 10
+
 func (s *APIServer) gamesRouter() chi.Router {
 	r := chi.NewRouter()
 
+	// Optionally authenticated routes; clip counts depend on who is asking
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Get("/", makeHTTPHandleFunc(s.handleGetGames))
+		r.Get("/{id}", makeHTTPHandleFunc(s.handleGetGame))
+	})
+
 	// Protected routes
 	r.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(jwtauth.Authenticator)
+		r.Use(s.authenticate)
+		r.Use(s.requireAuth)
+		r.Use(s.RequirePermission(PermGamesCreate))
 		r.Post("/new", makeHTTPHandleFunc(s.handleCreateGame))
 	})
 
 	return r
 }
 
+// Route for listing games with how many clips each has
+func (s *APIServer) handleGetGames(w http.ResponseWriter, r *http.Request) error {
+	games, err := s.store.GetAllGames()
+	if err != nil {
+		return err
+	}
+
+	clips, err := s.store.GetAllClips()
+	if err != nil {
+		return fmt.Errorf("error getting all clips: %w", err)
+	}
+
+	counts := map[string]int{}
+	for _, clip := range s.listedClips(r, clips) {
+		counts[clip.GameID]++
+	}
+
+	summaries := []GameSummary{}
+	for _, game := range games {
+		summaries = append(summaries, GameSummary{Game: game, ClipCount: counts[game.ID]})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return strings.ToLower(summaries[i].Name) < strings.ToLower(summaries[j].Name)
+	})
+
+	return responseWithJSON(w, http.StatusOK, summaries)
+}
+
+// Route for a game with its clip count and newest clips
+func (s *APIServer) handleGetGame(w http.ResponseWriter, r *http.Request) error {
+	game, err := s.store.GetGame(chi.URLParam(r, "id"))
+	if err != nil {
+		return errNotFound("game")
+	}
+
+	clips, err := s.store.GetGameClips(game.ID)
+	if err != nil {
+		return err
+	}
+
+	visible := s.listedClips(r, clips)
+	detail := GameDetail{
+		GameSummary: GameSummary{Game: game, ClipCount: len(visible)},
+		RecentClips: visible,
+	}
+	if len(visible) > recentGameClips {
+		detail.RecentClips = visible[:recentGameClips]
+	}
+
+	return responseWithJSON(w, http.StatusOK, detail)
+}
+
 // Route for creating a new game
 func (s *APIServer) handleCreateGame(w http.ResponseWriter, r *http.Request) error {
 	game, err := parseGameForm(r)
@@ -30,7 +95,7 @@ func (s *APIServer) handleCreateGame(w http.ResponseWriter, r *http.Request) err
 
 	// Check if game already exists
 	if _, err := s.store.GetGameByName(game.Name); err == nil {
-		return fmt.Errorf("game already exists")
+		return errConflict("game already exists")
 	}
 
 	// Create game
@@ -60,7 +125,7 @@ func parseGameForm(r *http.Request) (Game, error) {
 
 func validateGameForm(gameForm NewGameForm) error {
 	if gameForm.Name == "" {
-		return fmt.Errorf("name cannot be empty")
+		return errValidation("name", "cannot be empty")
 	}
 
 	return nil
@@ -3,37 +3,28 @@ module github.com/majesticbeast/lostsons.tv
 go 1.21.0
 
 require (
+	github.com/AfterShip/email-verifier v1.3.3
+	github.com/aws/aws-sdk-go v1.45.19
 	github.com/go-chi/chi/v5 v5.0.10
+	github.com/go-chi/cors v1.2.1
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.3.1
+	github.com/gtuk/discordwebhook v1.1.0
 	github.com/jackc/pgx/v5 v5.4.3
 	github.com/joho/godotenv v1.5.1
+	github.com/muxinc/mux-go v1.1.1
+	golang.org/x/oauth2 v0.13.0
 )
 
 require (
-	github.com/AfterShip/email-verifier v1.3.3 // indirect
-	github.com/aws/aws-sdk-go v1.45.19 // indirect
-	github.com/go-chi/cors v1.2.1 // indirect
-	github.com/go-chi/jwtauth v1.2.0 // indirect
-	github.com/goccy/go-json v0.3.5 // indirect
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/gtuk/discordwebhook v1.1.0 // indirect
 	github.com/hbollon/go-edlib v1.6.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/puddle/v2 v2.2.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/lestrrat-go/backoff/v2 v2.0.7 // indirect
-	github.com/lestrrat-go/httpcc v1.0.0 // indirect
-	github.com/lestrrat-go/iter v1.0.0 // indirect
-	github.com/lestrrat-go/jwx v1.1.0 // indirect
-	github.com/lestrrat-go/option v1.0.0 // indirect
-	github.com/muxinc/mux-go v1.1.1 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
-	github.com/ravener/discord-oauth2 v0.0.0-20230514095040-ae65713199b3 // indirect
 	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.16.0 // indirect
-	golang.org/x/oauth2 v0.13.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The clip graph served at /graphql: clips, users, games and tags, with cursor
+// pagination and mutations for editing clips. Clips are filtered and paged in SQL, and
+// each field is resolved for a whole level at once, so a query costs a fixed number
+// of Storage calls per level however many clips it touches.
+
+// Connections return this many nodes unless asked for up to graphMaxPageSize
+const (
+	graphDefaultPageSize = 20
+	graphMaxPageSize     = 100
+)
+
+// Largest request body /graphql reads
+const graphMaxBodySize = 1 << 20
+
+// What /graphql answers with, documented in /api/openapi.json. Requests that can't be
+// run at all get errors alone, with a 400 or 405.
+var graphResponseSchema = jsonSchema{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"data": map[string]interface{}{"type": "object"},
+		"errors": map[string]interface{}{"type": "array", "items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"message":    map[string]interface{}{"type": "string"},
+				"path":       map[string]interface{}{"type": "array", "items": map[string]interface{}{}},
+				"extensions": map[string]interface{}{"type": "object"},
+			},
+		}},
+	},
+}
+
+// A tag, one of the names in a clip's Tags
+type graphTag struct {
+	Name string
+}
+
+// A page of a list, Relay style
+type graphConnection struct {
+	Edges      []graphEdge
+	Nodes      []interface{}
+	PageInfo   graphPageInfo
+	TotalCount int
+}
+
+type graphEdge struct {
+	Cursor string
+	Node   interface{}
+}
+
+type graphPageInfo struct {
+	HasNextPage bool
+	EndCursor   *string
+}
+
+/*
+ *
+ *
+ * Loaders
+ *
+ *
+ */
+
+// Fetch a batch of keys at once, caching what was fetched for the rest of the request
+type dataLoader struct {
+	fetch func(keys []string) (map[string]interface{}, error)
+	cache map[string]interface{}
+}
+
+func newDataLoader(fetch func(keys []string) (map[string]interface{}, error)) *dataLoader {
+	return &dataLoader{fetch: fetch, cache: map[string]interface{}{}}
+}
+
+// Values for keys, fetching the ones not seen yet in one call. Unknown keys map to nil.
+func (l *dataLoader) loadMany(keys []string) (map[string]interface{}, error) {
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if _, ok := l.cache[key]; !ok && !seen[key] {
+			missing = append(missing, key)
+			seen[key] = true
+		}
+	}
+
+	if len(missing) > 0 {
+		fetched, err := l.fetch(missing)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range missing {
+			l.cache[key] = fetched[key]
+		}
+	}
+
+	values := map[string]interface{}{}
+	for _, key := range keys {
+		values[key] = l.cache[key]
+	}
+
+	return values, nil
+}
+
+// A request's loaders. Games are read once; users, captions and who is featured in
+// what are fetched a level at a time.
+type graphLoaders struct {
+	store Storage
+
+	games map[string]Game
+
+	users    *dataLoader
+	captions *dataLoader
+	features *dataLoader
+}
+
+func newGraphLoaders(store Storage) *graphLoaders {
+	l := &graphLoaders{store: store}
+
+	l.users = newDataLoader(func(ids []string) (map[string]interface{}, error) {
+		users, err := store.GetUsersByIDs(ids)
+		if err != nil {
+			return nil, err
+		}
+
+		byID := map[string]interface{}{}
+		for _, user := range users {
+			byID[user.ID] = user
+		}
+		return byID, nil
+	})
+
+	l.captions = newDataLoader(func(clipIDs []string) (map[string]interface{}, error) {
+		captions, err := store.GetCaptionsForClips(clipIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		byClip := map[string]interface{}{}
+		for _, id := range clipIDs {
+			byClip[id] = []Caption{}
+		}
+		for _, caption := range captions {
+			byClip[caption.ClipID] = append(byClip[caption.ClipID].([]Caption), caption)
+		}
+		return byClip, nil
+	})
+
+	l.features = newDataLoader(func(clipIDs []string) (map[string]interface{}, error) {
+		features, err := store.GetClipFeatures(clipIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		byClip := map[string]interface{}{}
+		for _, id := range clipIDs {
+			byClip[id] = features[id]
+		}
+		return byClip, nil
+	})
+
+	return l
+}
+
+func (ctx *gqlContext) allGames() (map[string]Game, error) {
+	l := ctx.loaders
+	if l.games != nil {
+		return l.games, nil
+	}
+
+	games, err := l.store.GetAllGames()
+	if err != nil {
+		return nil, err
+	}
+
+	l.games = map[string]Game{}
+	for _, game := range games {
+		l.games[game.ID] = game
+	}
+
+	return l.games, nil
+}
+
+/*
+ *
+ *
+ * Pagination
+ *
+ *
+ */
+
+func encodeCursor(kind string, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(kind + ":" + id))
+}
+
+func decodeCursor(kind string, cursor string) (string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", false
+	}
+
+	prefix, id, ok := strings.Cut(string(raw), ":")
+	return id, ok && prefix == kind
+}
+
+// How many nodes args["first"] asks for
+func pageSize(args map[string]interface{}) (int, error) {
+	first := graphDefaultPageSize
+	if n, ok := args["first"].(int); ok {
+		if n < 0 || n > graphMaxPageSize {
+			return 0, errValidation("first", fmt.Sprintf("must be between 0 and %d", graphMaxPageSize))
+		}
+		first = n
+	}
+
+	return first, nil
+}
+
+// How many nodes a connection costs: as many as it may return
+func pageCost(args map[string]interface{}) int {
+	first, err := pageSize(args)
+	if err != nil {
+		return 0
+	}
+
+	return first
+}
+
+// Lists that aren't paged are costed as a full page
+func listCost(args map[string]interface{}) int {
+	return graphMaxPageSize
+}
+
+// A page of nodes after the cursor in args["after"], args["first"] long
+func paginate(kind string, nodes []interface{}, idOf func(interface{}) string, args map[string]interface{}) (graphConnection, error) {
+	first, err := pageSize(args)
+	if err != nil {
+		return graphConnection{}, err
+	}
+
+	start := 0
+	if after, ok := args["after"].(string); ok {
+		id, valid := decodeCursor(kind, after)
+		found := false
+		for i, node := range nodes {
+			if valid && idOf(node) == id {
+				start, found = i+1, true
+				break
+			}
+		}
+
+		if !found {
+			return graphConnection{}, errValidation("after", "is not a valid cursor")
+		}
+	}
+
+	end := start + first
+	if end > len(nodes) {
+		end = len(nodes)
+	}
+
+	conn := graphConnection{Edges: []graphEdge{}, Nodes: []interface{}{}, TotalCount: len(nodes)}
+	for _, node := range nodes[start:end] {
+		conn.Edges = append(conn.Edges, graphEdge{Cursor: encodeCursor(kind, idOf(node)), Node: node})
+		conn.Nodes = append(conn.Nodes, node)
+	}
+
+	conn.PageInfo.HasNextPage = end < len(nodes)
+	if len(conn.Edges) > 0 {
+		cursor := conn.Edges[len(conn.Edges)-1].Cursor
+		conn.PageInfo.EndCursor = &cursor
+	}
+
+	return conn, nil
+}
+
+// Clip cursors hold the clip's upload time as well as its ID, so Storage can page
+// from them without finding the clip first
+func encodeClipCursor(clip Clip) string {
+	return encodeCursor("clip", fmt.Sprintf("%d:%s", clip.DateUploaded.UnixNano(), clip.ID))
+}
+
+func decodeClipCursor(cursor string) (ClipCursor, bool) {
+	value, ok := decodeCursor("clip", cursor)
+	if !ok {
+		return ClipCursor{}, false
+	}
+
+	nanos, id, ok := strings.Cut(value, ":")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil || id == "" {
+		return ClipCursor{}, false
+	}
+
+	return ClipCursor{DateUploaded: time.Unix(0, n).UTC(), ID: id}, true
+}
+
+// The clips the requester may see listed, paged as args ask
+func (ctx *gqlContext) clipPageQuery(args map[string]interface{}) (ClipPageQuery, error) {
+	q := listedClipsQuery(ctx.server.viewer(ctx.r))
+
+	first, err := pageSize(args)
+	if err != nil {
+		return ClipPageQuery{}, err
+	}
+	q.First = first
+
+	if after, ok := args["after"].(string); ok {
+		cursor, valid := decodeClipCursor(after)
+		if !valid {
+			return ClipPageQuery{}, errValidation("after", "is not a valid cursor")
+		}
+		q.After = &cursor
+	}
+
+	return q, nil
+}
+
+func clipConnection(page ClipPage) graphConnection {
+	conn := graphConnection{Edges: []graphEdge{}, Nodes: []interface{}{}, TotalCount: page.TotalCount}
+	for _, clip := range page.Clips {
+		conn.Edges = append(conn.Edges, graphEdge{Cursor: encodeClipCursor(clip), Node: clip})
+		conn.Nodes = append(conn.Nodes, clip)
+	}
+
+	conn.PageInfo.HasNextPage = page.HasNextPage
+	if len(conn.Edges) > 0 {
+		cursor := conn.Edges[len(conn.Edges)-1].Cursor
+		conn.PageInfo.EndCursor = &cursor
+	}
+
+	return conn
+}
+
+// The key of each source, for a ClipPageQuery split by one of them
+func sourceKeys(sources []interface{}, keyOf func(source interface{}) string) []string {
+	keys := []string{}
+	for _, source := range sources {
+		keys = append(keys, keyOf(source))
+	}
+
+	return keys
+}
+
+// Resolve a connection of clips for each source, with one page per key in a single
+// Storage call. by is how ClipPageQuery splits clips by keys.
+func clipConnections(by string, keyOf func(source interface{}) string) gqlResolver {
+	return func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		q, err := ctx.clipPageQuery(args)
+		if err != nil {
+			return nil, err
+		}
+		q.By = by
+		q.Keys = sourceKeys(sources, keyOf)
+
+		pages, err := ctx.loaders.store.GetClipPages(q)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]interface{}, len(sources))
+		for i, source := range sources {
+			values[i] = clipConnection(pages[keyOf(source)])
+		}
+		return values, nil
+	}
+}
+
+// Resolve how many listed clips each source has
+func clipCounts(by string, keyOf func(source interface{}) string) gqlResolver {
+	return func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		q := listedClipsQuery(ctx.server.viewer(ctx.r))
+		q.By = by
+		q.Keys = sourceKeys(sources, keyOf)
+
+		counts, err := ctx.loaders.store.CountListedClips(q)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]interface{}, len(sources))
+		for i, source := range sources {
+			values[i] = counts[keyOf(source)]
+		}
+		return values, nil
+	}
+}
+
+var pageArgs = []gqlArg{{Name: "first", Type: "Int"}, {Name: "after", Type: "String"}}
+
+/*
+ *
+ *
+ * Resolvers
+ *
+ *
+ */
+
+// Resolve a field from each source on its own
+func graphProp(get func(source interface{}) interface{}) gqlResolver {
+	return func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		values := make([]interface{}, len(sources))
+		for i, source := range sources {
+			values[i] = get(source)
+		}
+		return values, nil
+	}
+}
+
+// Resolve a root field, which has a single nil source
+func graphRoot(resolve func(ctx *gqlContext, args map[string]interface{}) (interface{}, error)) gqlResolver {
+	return func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		value, err := resolve(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	}
+}
+
+func clipTags(clip Clip) []graphTag {
+	tags := []graphTag{}
+	for _, name := range strings.Split(clip.Tags, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			tags = append(tags, graphTag{Name: name})
+		}
+	}
+
+	return tags
+}
+
+// Tags the requester may see on listed clips, by name. With name, only that tag.
+func (ctx *gqlContext) listedTags(name string) ([]graphTag, error) {
+	q := listedClipsQuery(ctx.server.viewer(ctx.r))
+	q.Tag = name
+
+	names, err := ctx.loaders.store.GetListedTags(q)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []graphTag{}
+	for _, name := range names {
+		tags = append(tags, graphTag{Name: name})
+	}
+	return tags, nil
+}
+
+// Tags as given to updateClip: trimmed, without blanks or repeats
+func normalizeTags(values []interface{}) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		tag := strings.TrimSpace(value.(string))
+		if key := strings.ToLower(tag); tag != "" && !seen[key] {
+			seen[key] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func (s *APIServer) graphSchema() *gqlSchema {
+	return &gqlSchema{
+		Query:    "Query",
+		Mutation: "Mutation",
+		Scalars:  []string{"Time"},
+		Types: []*gqlObject{
+			{Name: "Query", Fields: []gqlField{
+				{Name: "clip", Type: "Clip", Args: []gqlArg{{Name: "id", Type: "ID!"}}, Description: "A clip by ID, including unlisted ones",
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						clip, err := s.store.GetClip(args["id"].(string))
+						viewer, loggedIn := s.viewer(ctx.r)
+						if err != nil || !canViewClip(viewer, loggedIn, clip, false) {
+							return nil, nil
+						}
+						return clip, nil
+					})},
+				{Name: "clips", Type: "ClipConnection!", Args: append([]gqlArg{{Name: "game", Type: "ID"}, {Name: "tag", Type: "String"}}, pageArgs...), Description: "Listed clips, newest first", Size: pageCost,
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						q, err := ctx.clipPageQuery(args)
+						if err != nil {
+							return nil, err
+						}
+						q.GameID, _ = args["game"].(string)
+						q.Tag, _ = args["tag"].(string)
+
+						pages, err := s.store.GetClipPages(q)
+						if err != nil {
+							return nil, err
+						}
+						return clipConnection(pages[""]), nil
+					})},
+				{Name: "user", Type: "User", Args: []gqlArg{{Name: "username", Type: "String!"}},
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						user, err := s.store.GetUserByUsername(args["username"].(string))
+						if err != nil {
+							return nil, nil
+						}
+						return user, nil
+					})},
+				{Name: "users", Type: "UserConnection!", Args: pageArgs, Description: "Users by username", Size: pageCost,
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						users, err := s.store.GetAllUsers()
+						if err != nil {
+							return nil, err
+						}
+
+						sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+						nodes := make([]interface{}, len(users))
+						for i, user := range users {
+							nodes[i] = user
+						}
+						return paginate("user", nodes, func(node interface{}) string { return node.(User).ID }, args)
+					})},
+				{Name: "viewer", Type: "User", Description: "The logged in user",
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						if user, ok := s.viewer(ctx.r); ok {
+							return user, nil
+						}
+						return nil, nil
+					})},
+				{Name: "game", Type: "Game", Args: []gqlArg{{Name: "id", Type: "ID!"}},
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						games, err := ctx.allGames()
+						if err != nil {
+							return nil, err
+						}
+						if game, ok := games[args["id"].(string)]; ok {
+							return game, nil
+						}
+						return nil, nil
+					})},
+				{Name: "games", Type: "[Game!]!", Description: "Games by name", Size: listCost,
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						games, err := ctx.allGames()
+						if err != nil {
+							return nil, err
+						}
+
+						list := []Game{}
+						for _, game := range games {
+							list = append(list, game)
+						}
+						sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+						return list, nil
+					})},
+				{Name: "tag", Type: "Tag", Args: []gqlArg{{Name: "name", Type: "String!"}},
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						tags, err := ctx.listedTags(args["name"].(string))
+						if err != nil || len(tags) == 0 {
+							return nil, err
+						}
+						return tags[0], nil
+					})},
+				{Name: "tags", Type: "[Tag!]!", Description: "Tags of listed clips, by name", Size: listCost,
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						return ctx.listedTags("")
+					})},
+			}},
+
+			{Name: "Mutation", Fields: []gqlField{
+				{Name: "updateClip", Type: "Clip!", Description: "Change a clip's description, game or tags. Needs clips:manage:own for your own clips, clips:edit for others.",
+					Args: []gqlArg{{Name: "id", Type: "ID!"}, {Name: "description", Type: "String"}, {Name: "game", Type: "String"}, {Name: "tags", Type: "[String!]"}},
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						clip, err := s.modifiableClip(ctx, args["id"].(string), PermClipsEdit)
+						if err != nil {
+							return nil, err
+						}
+
+						var description *string
+						if value, ok := args["description"].(string); ok {
+							description = &value
+						}
+						game, _ := args["game"].(string)
+
+						if err := s.editClip(clip, description, game); err != nil {
+							return nil, err
+						}
+
+						if tags, ok := args["tags"].([]interface{}); ok {
+							if err := s.store.UpdateClipTags(clip.ID, normalizeTags(tags)); err != nil {
+								return nil, err
+							}
+						}
+
+						return s.store.GetClip(clip.ID)
+					})},
+				{Name: "deleteClip", Type: "Boolean!", Args: []gqlArg{{Name: "id", Type: "ID!"}}, Description: "Delete a clip. Needs clips:manage:own for your own clips, clips:delete for others.",
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						clip, err := s.modifiableClip(ctx, args["id"].(string), PermClipsDelete)
+						if err != nil {
+							return nil, err
+						}
+
+						if err := s.deleteClip(clip); err != nil {
+							return nil, err
+						}
+						return true, nil
+					})},
+			}},
+
+			{Name: "Clip", Fields: []gqlField{
+				{Name: "id", Type: "ID!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).ID })},
+				{Name: "playbackId", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).PlaybackID })},
+				{Name: "description", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).Description })},
+				{Name: "visibility", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).Visibility })},
+				{Name: "downloadable", Type: "Boolean!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).Downloadable })},
+				{Name: "dateUploaded", Type: "Time!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).DateUploaded })},
+				{Name: "duration", Type: "Float!", Description: "Seconds, once Mux knows", Resolve: graphProp(func(v interface{}) interface{} { return v.(Clip).Duration })},
+				{Name: "uploader", Type: "User", Resolve: func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+					ids := []string{}
+					for _, source := range sources {
+						ids = append(ids, source.(Clip).UserID)
+					}
+
+					users, err := ctx.loaders.users.loadMany(ids)
+					if err != nil {
+						return nil, err
+					}
+
+					values := make([]interface{}, len(sources))
+					for i, source := range sources {
+						values[i] = users[source.(Clip).UserID]
+					}
+					return values, nil
+				}},
+				{Name: "featuredUsers", Type: "[User!]!", Resolve: func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+					clipIDs := []string{}
+					for _, source := range sources {
+						clipIDs = append(clipIDs, source.(Clip).ID)
+					}
+
+					features, err := ctx.loaders.features.loadMany(clipIDs)
+					if err != nil {
+						return nil, err
+					}
+
+					ids := []string{}
+					for _, id := range clipIDs {
+						ids = append(ids, features[id].([]string)...)
+					}
+
+					users, err := ctx.loaders.users.loadMany(ids)
+					if err != nil {
+						return nil, err
+					}
+
+					values := make([]interface{}, len(sources))
+					for i, source := range sources {
+						featured := []User{}
+						for _, id := range features[source.(Clip).ID].([]string) {
+							if user, ok := users[id].(User); ok {
+								featured = append(featured, user)
+							}
+						}
+						values[i] = featured
+					}
+					return values, nil
+				}},
+				{Name: "game", Type: "Game", Resolve: func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+					games, err := ctx.allGames()
+					if err != nil {
+						return nil, err
+					}
+
+					values := make([]interface{}, len(sources))
+					for i, source := range sources {
+						if game, ok := games[source.(Clip).GameID]; ok {
+							values[i] = game
+						}
+					}
+					return values, nil
+				}},
+				{Name: "tags", Type: "[Tag!]!", Resolve: graphProp(func(v interface{}) interface{} { return clipTags(v.(Clip)) })},
+				{Name: "captions", Type: "[Caption!]!", Resolve: func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+					ids := []string{}
+					for _, source := range sources {
+						ids = append(ids, source.(Clip).ID)
+					}
+
+					captions, err := ctx.loaders.captions.loadMany(ids)
+					if err != nil {
+						return nil, err
+					}
+
+					values := make([]interface{}, len(sources))
+					for i, source := range sources {
+						values[i] = captions[source.(Clip).ID]
+					}
+					return values, nil
+				}},
+			}},
+
+			{Name: "Caption", Fields: []gqlField{
+				{Name: "id", Type: "ID!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Caption).ID })},
+				{Name: "languageCode", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Caption).LanguageCode })},
+				{Name: "name", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Caption).Name })},
+				{Name: "closedCaptions", Type: "Boolean!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Caption).ClosedCaptions })},
+				{Name: "createdAt", Type: "Time!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Caption).CreatedAt })},
+			}},
+
+			{Name: "User", Fields: []gqlField{
+				{Name: "id", Type: "ID!", Resolve: graphProp(func(v interface{}) interface{} { return v.(User).ID })},
+				{Name: "username", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(User).Username })},
+				{Name: "displayName", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(User).DisplayName })},
+				{Name: "avatarUrl", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(User).AvatarURL() })},
+				{Name: "role", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(User).Role })},
+				{Name: "uploadedClips", Type: "ClipConnection!", Args: pageArgs, Size: pageCost,
+					Resolve: clipConnections("uploader", func(v interface{}) string { return v.(User).ID })},
+				{Name: "featuredIn", Type: "ClipConnection!", Args: pageArgs, Description: "Clips the user is featured in but didn't upload", Size: pageCost,
+					Resolve: clipConnections("featured", func(v interface{}) string { return v.(User).ID })},
+			}},
+
+			{Name: "Game", Fields: []gqlField{
+				{Name: "id", Type: "ID!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Game).ID })},
+				{Name: "name", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(Game).Name })},
+				{Name: "clipCount", Type: "Int!", Resolve: clipCounts("game", func(v interface{}) string { return v.(Game).ID })},
+				{Name: "clips", Type: "ClipConnection!", Args: pageArgs, Size: pageCost,
+					Resolve: clipConnections("game", func(v interface{}) string { return v.(Game).ID })},
+			}},
+
+			{Name: "Tag", Fields: []gqlField{
+				{Name: "name", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphTag).Name })},
+				{Name: "clipCount", Type: "Int!", Resolve: clipCounts("tag", func(v interface{}) string { return strings.ToLower(v.(graphTag).Name) })},
+				{Name: "clips", Type: "ClipConnection!", Args: pageArgs, Size: pageCost,
+					Resolve: clipConnections("tag", func(v interface{}) string { return strings.ToLower(v.(graphTag).Name) })},
+			}},
+
+			{Name: "ClipConnection", Fields: connectionFields("ClipEdge", "Clip")},
+			{Name: "ClipEdge", Fields: edgeFields("Clip")},
+			{Name: "UserConnection", Fields: connectionFields("UserEdge", "User")},
+			{Name: "UserEdge", Fields: edgeFields("User")},
+			{Name: "PageInfo", Fields: []gqlField{
+				{Name: "hasNextPage", Type: "Boolean!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphPageInfo).HasNextPage })},
+				{Name: "endCursor", Type: "String", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphPageInfo).EndCursor })},
+			}},
+		},
+	}
+}
+
+func connectionFields(edge string, node string) []gqlField {
+	return []gqlField{
+		{Name: "edges", Type: "[" + edge + "!]!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphConnection).Edges })},
+		{Name: "nodes", Type: "[" + node + "!]!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphConnection).Nodes })},
+		{Name: "pageInfo", Type: "PageInfo!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphConnection).PageInfo })},
+		{Name: "totalCount", Type: "Int!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphConnection).TotalCount })},
+	}
+}
+
+func edgeFields(node string) []gqlField {
+	return []gqlField{
+		{Name: "cursor", Type: "String!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphEdge).Cursor })},
+		{Name: "node", Type: node + "!", Resolve: graphProp(func(v interface{}) interface{} { return v.(graphEdge).Node })},
+	}
+}
+
+// The clip with id, if the requester may change it with permission. Refusals are
+// errors, so a mutation stops before touching anything.
+func (s *APIServer) modifiableClip(ctx *gqlContext, id string, permission string) (Clip, error) {
+	viewer, ok := s.viewer(ctx.r)
+	if !ok {
+		return Clip{}, errUnauthorized()
+	}
+
+	clip, err := s.store.GetClip(id)
+	if err != nil {
+		return Clip{}, errNotFound("clip")
+	}
+
+	if !s.canModifyClip(ctx.r, clip, permission) {
+		return Clip{}, s.forbid(viewer, permission)
+	}
+
+	return clip, nil
+}
+
+/*
+ *
+ *
+ * Handlers
+ *
+ *
+ */
+
+// A request that couldn't be run, answered in GraphQL's error format
+func graphRequestError(w http.ResponseWriter, status int, code string, err error) error {
+	return responseWithJSON(w, status, gqlResponse{Errors: []gqlError{
+		{Message: err.Error(), Extensions: map[string]interface{}{"code": code}},
+	}})
+}
+
+// Route for GraphQL queries and mutations. GET runs queries only, so following a link
+// can't change anything; POST takes {"query", "operationName", "variables"} as JSON.
+func (s *APIServer) handleGraphQL(w http.ResponseWriter, r *http.Request) error {
+	req := gqlRequest{}
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if v := query.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return graphRequestError(w, http.StatusBadRequest, "bad_request", fmt.Errorf("variables is not valid JSON"))
+			}
+		}
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, graphMaxBodySize)).Decode(&req); err != nil {
+		return graphRequestError(w, http.StatusBadRequest, "bad_request", fmt.Errorf("error decoding graphql request: %w", err))
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return graphRequestError(w, http.StatusBadRequest, "parse_failed", err)
+	}
+
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return graphRequestError(w, http.StatusBadRequest, "bad_request", err)
+	}
+
+	if op.Type == "mutation" && r.Method == http.MethodGet {
+		return graphRequestError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Errorf("mutations must be sent with POST"))
+	}
+
+	ctx := &gqlContext{schema: s.graphSchema(), server: s, r: r, loaders: newGraphLoaders(s.store)}
+	data, err := ctx.execute(doc, op, req.Variables)
+	if err != nil {
+		return graphRequestError(w, http.StatusBadRequest, "validation_failed", err)
+	}
+
+	return responseWithJSON(w, http.StatusOK, gqlResponse{Data: data, Errors: ctx.errors})
+}
+
+// Route for the schema in the GraphQL schema language, for code generators and people
+func (s *APIServer) handleGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, s.graphSchema().sdl())
+}
@@ -0,0 +1,1303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A small GraphQL executor for the clip graph in graph.go. It runs queries and
+// mutations with variables, aliases, fragments and @include/@skip. There is no
+// introspection; the schema is published as SDL at /graphql/schema instead.
+//
+// Fields are resolved a level at a time: a field's resolver gets every object at that
+// level at once, so it can batch its lookups through the request's loaders.
+
+// Queries nested deeper than this are refused
+const gqlMaxDepth = 12
+
+// Queries that could return more objects than this are refused, before anything runs
+const gqlMaxCost = 10000
+
+/*
+ *
+ *
+ * Schema
+ *
+ *
+ */
+
+// Resolve a field for every source at one level. Returns one value per source.
+type gqlResolver func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error)
+
+type gqlArg struct {
+	Name string
+	Type string
+}
+
+type gqlField struct {
+	Name        string
+	Type        string // e.g. "[Clip!]!"
+	Args        []gqlArg
+	Description string
+	Resolve     gqlResolver
+
+	// How many objects the field can return for one source, given its arguments, for
+	// costing queries. Nil is one.
+	Size func(args map[string]interface{}) int
+}
+
+type gqlObject struct {
+	Name        string
+	Description string
+	Fields      []gqlField
+}
+
+type gqlSchema struct {
+	Query    string
+	Mutation string
+	Scalars  []string
+	Types    []*gqlObject
+}
+
+func (o *gqlObject) field(name string) (gqlField, bool) {
+	for _, f := range o.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+
+	return gqlField{}, false
+}
+
+func (s *gqlSchema) object(name string) (*gqlObject, bool) {
+	for _, t := range s.Types {
+		if t.Name == name {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+// The schema in the GraphQL schema language
+func (s *gqlSchema) sdl() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "schema {\n  query: %s\n", s.Query)
+	if s.Mutation != "" {
+		fmt.Fprintf(&b, "  mutation: %s\n", s.Mutation)
+	}
+	b.WriteString("}\n")
+
+	for _, scalar := range s.Scalars {
+		fmt.Fprintf(&b, "\nscalar %s\n", scalar)
+	}
+
+	for _, t := range s.Types {
+		b.WriteString("\n")
+		if t.Description != "" {
+			fmt.Fprintf(&b, "\"\"\"%s\"\"\"\n", t.Description)
+		}
+		fmt.Fprintf(&b, "type %s {\n", t.Name)
+		for _, f := range t.Fields {
+			if f.Description != "" {
+				fmt.Fprintf(&b, "  \"\"\"%s\"\"\"\n", f.Description)
+			}
+
+			args := []string{}
+			for _, a := range f.Args {
+				args = append(args, a.Name+": "+a.Type)
+			}
+
+			if len(args) > 0 {
+				fmt.Fprintf(&b, "  %s(%s): %s\n", f.Name, strings.Join(args, ", "), f.Type)
+			} else {
+				fmt.Fprintf(&b, "  %s: %s\n", f.Name, f.Type)
+			}
+		}
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+/*
+ *
+ *
+ * Lexer
+ *
+ *
+ */
+
+const (
+	gqlEOF = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	tokens := []gqlToken{}
+	i := 0
+
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "\ufeff"):
+			i += len("\ufeff")
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{gqlPunct, "...", i})
+			i += 3
+		case strings.ContainsRune("!$&()[]{}:=@|", rune(c)):
+			tokens = append(tokens, gqlToken{gqlPunct, string(c), i})
+			i++
+		case c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i] >= 'A' && src[i] <= 'Z') || (src[i] >= 'a' && src[i] <= 'z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, gqlToken{gqlName, src[start:i], start})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			kind := gqlInt
+			i++
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			if i < len(src) && src[i] == '.' {
+				kind = gqlFloat
+				i++
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				kind = gqlFloat
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], start})
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, gqlToken{gqlString, src[i+3 : i+3+end], i})
+			i += 3 + end + 3
+		case c == '"':
+			value, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%s at %d", err, i)
+			}
+			tokens = append(tokens, gqlToken{gqlString, value, i})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("unexpected character %q at %d", r, i)
+		}
+	}
+
+	return append(tokens, gqlToken{gqlEOF, "", len(src)}), nil
+}
+
+// A quoted string at the start of src, and how many bytes it took up
+func lexString(src string) (string, int, error) {
+	var b strings.Builder
+	i := 1
+
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case c == '\\' && i+1 < len(src):
+			escapes := map[byte]string{'"': "\"", '\\': "\\", '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}
+			if e, ok := escapes[src[i+1]]; ok {
+				b.WriteString(e)
+				i += 2
+				continue
+			}
+			if src[i+1] == 'u' && i+6 <= len(src) {
+				code, err := strconv.ParseUint(src[i+2:i+6], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				i += 6
+				continue
+			}
+			return "", 0, fmt.Errorf("invalid escape")
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+/*
+ *
+ *
+ * Parser
+ *
+ *
+ */
+
+type gqlDocument struct {
+	Operations []gqlOperation
+	Fragments  map[string]gqlFragment
+}
+
+type gqlOperation struct {
+	Type       string // query or mutation
+	Name       string
+	Variables  []gqlVariableDef
+	Selections []gqlSelection
+}
+
+type gqlVariableDef struct {
+	Name    string
+	Type    string
+	Default interface{}
+}
+
+type gqlFragment struct {
+	Name       string
+	TypeName   string
+	Selections []gqlSelection
+}
+
+// A field, a fragment spread (Spread set) or an inline fragment (Inline set)
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Directives []gqlDirective
+	Selections []gqlSelection
+
+	Spread   string
+	Inline   bool
+	TypeName string
+}
+
+type gqlDirective struct {
+	Name string
+	Args map[string]interface{}
+}
+
+// A $variable in a query, replaced by its value when arguments are coerced
+type gqlVariable string
+
+// An enum value in a query
+type gqlEnum string
+
+func (s gqlSelection) key() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+
+	return s.Name
+}
+
+type gqlParser struct {
+	tokens []gqlToken
+	i      int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{Fragments: map[string]gqlFragment{}}
+
+	for p.peek().kind != gqlEOF {
+		switch {
+		case p.peekPunct("{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, gqlOperation{Type: "query", Selections: selections})
+		case p.peekName("query") || p.peekName("mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		case p.peekName("fragment"):
+			fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.Fragments[fragment.Name]; ok {
+				return nil, fmt.Errorf("fragment %s is defined twice", fragment.Name)
+			}
+			doc.Fragments[fragment.Name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.i]
+	if t.kind != gqlEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *gqlParser) peekPunct(value string) bool {
+	t := p.peek()
+	return t.kind == gqlPunct && t.value == value
+}
+
+func (p *gqlParser) peekName(value string) bool {
+	t := p.peek()
+	return t.kind == gqlName && t.value == value
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	if t.kind == gqlEOF {
+		return fmt.Errorf("unexpected end of document")
+	}
+
+	return fmt.Errorf("unexpected %q at %d", t.value, t.pos)
+}
+
+func (p *gqlParser) expectPunct(value string) error {
+	if !p.peekPunct(value) {
+		return p.unexpected()
+	}
+
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != gqlName {
+		return "", p.unexpected()
+	}
+
+	return p.next().value, nil
+}
+
+func (p *gqlParser) operation() (gqlOperation, error) {
+	op := gqlOperation{Type: p.next().value}
+
+	if p.peek().kind == gqlName {
+		op.Name = p.next().value
+	}
+
+	if p.peekPunct("(") {
+		p.next()
+		for !p.peekPunct(")") {
+			if err := p.expectPunct("$"); err != nil {
+				return op, err
+			}
+
+			name, err := p.name()
+			if err != nil {
+				return op, err
+			}
+
+			if err := p.expectPunct(":"); err != nil {
+				return op, err
+			}
+
+			typ, err := p.typeRef()
+			if err != nil {
+				return op, err
+			}
+
+			def := gqlVariableDef{Name: name, Type: typ}
+			if p.peekPunct("=") {
+				p.next()
+				if def.Default, err = p.value(true); err != nil {
+					return op, err
+				}
+			}
+			op.Variables = append(op.Variables, def)
+		}
+		p.next()
+	}
+
+	if _, err := p.directives(); err != nil {
+		return op, err
+	}
+
+	selections, err := p.selectionSet()
+	op.Selections = selections
+	return op, err
+}
+
+func (p *gqlParser) fragment() (gqlFragment, error) {
+	p.next()
+
+	name, err := p.name()
+	if err != nil {
+		return gqlFragment{}, err
+	}
+
+	if !p.peekName("on") {
+		return gqlFragment{}, p.unexpected()
+	}
+	p.next()
+
+	typeName, err := p.name()
+	if err != nil {
+		return gqlFragment{}, err
+	}
+
+	if _, err := p.directives(); err != nil {
+		return gqlFragment{}, err
+	}
+
+	selections, err := p.selectionSet()
+	return gqlFragment{Name: name, TypeName: typeName, Selections: selections}, err
+}
+
+// A type like [String!]!, kept as written
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.peekPunct("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+
+	if p.peekPunct("!") {
+		p.next()
+		typ += "!"
+	}
+
+	return typ, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+
+	selections := []gqlSelection{}
+	for !p.peekPunct("}") {
+		selection, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	p.next()
+
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+
+	return selections, nil
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var err error
+	s := gqlSelection{}
+
+	if p.peekPunct("...") {
+		p.next()
+
+		if p.peek().kind == gqlName && !p.peekName("on") {
+			s.Spread = p.next().value
+			s.Directives, err = p.directives()
+			return s, err
+		}
+
+		s.Inline = true
+		if p.peekName("on") {
+			p.next()
+			if s.TypeName, err = p.name(); err != nil {
+				return s, err
+			}
+		}
+
+		if s.Directives, err = p.directives(); err != nil {
+			return s, err
+		}
+
+		s.Selections, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.Name, err = p.name(); err != nil {
+		return s, err
+	}
+
+	if p.peekPunct(":") {
+		p.next()
+		s.Alias = s.Name
+		if s.Name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+
+	if p.peekPunct("(") {
+		if s.Args, err = p.arguments(); err != nil {
+			return s, err
+		}
+	}
+
+	if s.Directives, err = p.directives(); err != nil {
+		return s, err
+	}
+
+	if p.peekPunct("{") {
+		s.Selections, err = p.selectionSet()
+	}
+
+	return s, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	p.next()
+
+	args := map[string]interface{}{}
+	for !p.peekPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	directives := []gqlDirective{}
+	for p.peekPunct("@") {
+		p.next()
+
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+
+		d := gqlDirective{Name: name}
+		if p.peekPunct("(") {
+			if d.Args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		directives = append(directives, d)
+	}
+
+	return directives, nil
+}
+
+// A value. Variables aren't allowed in constants, such as variable defaults.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.peek()
+
+	switch {
+	case t.kind == gqlPunct && t.value == "$" && !constant:
+		p.next()
+		name, err := p.name()
+		return gqlVariable(name), err
+	case t.kind == gqlInt:
+		p.next()
+		return strconv.ParseInt(t.value, 10, 64)
+	case t.kind == gqlFloat:
+		p.next()
+		return strconv.ParseFloat(t.value, 64)
+	case t.kind == gqlString:
+		p.next()
+		return t.value, nil
+	case t.kind == gqlName:
+		p.next()
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return gqlEnum(t.value), nil
+	case t.kind == gqlPunct && t.value == "[":
+		p.next()
+		list := []interface{}{}
+		for !p.peekPunct("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		p.next()
+		return list, nil
+	case t.kind == gqlPunct && t.value == "{":
+		p.next()
+		object := map[string]interface{}{}
+		for !p.peekPunct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return object, nil
+	}
+
+	return nil, p.unexpected()
+}
+
+/*
+ *
+ *
+ * Execution
+ *
+ *
+ */
+
+// A request to /graphql
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// Fields of a result object, in the order they were selected
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGQLResult() *gqlResult {
+	return &gqlResult{values: map[string]interface{}{}}
+}
+
+func (o *gqlResult) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *gqlResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
+
+// Everything a request's resolvers share
+type gqlContext struct {
+	schema    *gqlSchema
+	variables map[string]interface{}
+	fragments map[string]gqlFragment
+	errors    []gqlError
+
+	// Set by the endpoint for its resolvers. There is deliberately no ResponseWriter:
+	// resolvers report failures as errors, and only the endpoint writes the response.
+	server  *APIServer
+	r       *http.Request
+	loaders *graphLoaders
+}
+
+// Pick the operation to run: the one named, or the only one
+func (doc *gqlDocument) operation(name string) (gqlOperation, error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return gqlOperation{}, fmt.Errorf("operationName is required when the document has several operations")
+		}
+		return doc.Operations[0], nil
+	}
+
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+
+	return gqlOperation{}, fmt.Errorf("operation %s does not exist", name)
+}
+
+// Run an operation. An error means it couldn't be run at all; errors in fields are
+// in ctx.errors, with the fields set to null.
+func (ctx *gqlContext) execute(doc *gqlDocument, op gqlOperation, variables map[string]interface{}) (*gqlResult, error) {
+	ctx.fragments = doc.Fragments
+	ctx.variables = map[string]interface{}{}
+
+	for _, def := range op.Variables {
+		value, ok := variables[def.Name]
+		if !ok {
+			value = def.Default
+		}
+		if value == nil && strings.HasSuffix(def.Type, "!") {
+			return nil, fmt.Errorf("variable $%s is required", def.Name)
+		}
+		ctx.variables[def.Name] = value
+	}
+
+	if err := ctx.checkDepth(op.Selections, 1, map[string]bool{}); err != nil {
+		return nil, err
+	}
+
+	rootName := ctx.schema.Query
+	if op.Type == "mutation" {
+		rootName = ctx.schema.Mutation
+	}
+
+	root, ok := ctx.schema.object(rootName)
+	if !ok {
+		return nil, fmt.Errorf("%s is not supported", op.Type)
+	}
+
+	cost := 0
+	if err := ctx.checkCost(root, op.Selections, 1, &cost); err != nil {
+		return nil, err
+	}
+
+	results, err := ctx.executeSelections(root, []interface{}{nil}, op.Selections, [][]interface{}{{}})
+	if err != nil {
+		return nil, err
+	}
+
+	return results[0], nil
+}
+
+// Refuse queries nested too deep and fragments that spread themselves
+func (ctx *gqlContext) checkDepth(selections []gqlSelection, depth int, spreading map[string]bool) error {
+	if depth > gqlMaxDepth {
+		return fmt.Errorf("query is nested deeper than %d", gqlMaxDepth)
+	}
+
+	for _, s := range selections {
+		switch {
+		case s.Spread != "":
+			if spreading[s.Spread] {
+				return fmt.Errorf("fragment %s spreads itself", s.Spread)
+			}
+			fragment, ok := ctx.fragments[s.Spread]
+			if !ok {
+				return fmt.Errorf("fragment %s does not exist", s.Spread)
+			}
+			spreading[s.Spread] = true
+			if err := ctx.checkDepth(fragment.Selections, depth, spreading); err != nil {
+				return err
+			}
+			delete(spreading, s.Spread)
+		case s.Inline:
+			if err := ctx.checkDepth(s.Selections, depth, spreading); err != nil {
+				return err
+			}
+		default:
+			if err := ctx.checkDepth(s.Selections, depth+1, spreading); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Refuse queries that could return more than gqlMaxCost objects. Each object field
+// costs its Size for every object it is selected on. Unknown fields and bad arguments
+// are left for executeSelections to report.
+func (ctx *gqlContext) checkCost(object *gqlObject, selections []gqlSelection, multiplier int, cost *int) error {
+	keys := []string{}
+	fields := map[string][]gqlSelection{}
+	if err := ctx.collectFields(object, selections, &keys, fields); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		selected := fields[key]
+
+		field, ok := object.field(selected[0].Name)
+		if !ok {
+			continue
+		}
+
+		child, ok := ctx.schema.object(strings.Trim(field.Type, "[]!"))
+		if !ok {
+			continue
+		}
+
+		n := multiplier
+		if field.Size != nil {
+			args, err := ctx.coerceArgs(field, selected[0].Args)
+			if err != nil {
+				continue
+			}
+			n *= field.Size(args)
+		}
+
+		*cost += n
+		if *cost > gqlMaxCost {
+			return fmt.Errorf("query could return more than %d objects", gqlMaxCost)
+		}
+
+		subSelections := []gqlSelection{}
+		for _, s := range selected {
+			subSelections = append(subSelections, s.Selections...)
+		}
+
+		if err := ctx.checkCost(child, subSelections, n, cost); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fields selected on an object, with fragments flattened and fields of the same
+// name merged, in the order they were first selected
+func (ctx *gqlContext) collectFields(object *gqlObject, selections []gqlSelection, keys *[]string, fields map[string][]gqlSelection) error {
+	for _, s := range selections {
+		include, err := ctx.included(s.Directives)
+		if err != nil {
+			return err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case s.Spread != "":
+			fragment := ctx.fragments[s.Spread]
+			if fragment.TypeName != object.Name {
+				continue
+			}
+			if err := ctx.collectFields(object, fragment.Selections, keys, fields); err != nil {
+				return err
+			}
+		case s.Inline:
+			if s.TypeName != "" && s.TypeName != object.Name {
+				continue
+			}
+			if err := ctx.collectFields(object, s.Selections, keys, fields); err != nil {
+				return err
+			}
+		default:
+			if _, ok := fields[s.key()]; !ok {
+				*keys = append(*keys, s.key())
+			}
+			fields[s.key()] = append(fields[s.key()], s)
+		}
+	}
+
+	return nil
+}
+
+// Whether @include and @skip let a selection through
+func (ctx *gqlContext) included(directives []gqlDirective) (bool, error) {
+	for _, d := range directives {
+		if d.Name != "include" && d.Name != "skip" {
+			return false, fmt.Errorf("directive @%s is not supported", d.Name)
+		}
+
+		value, err := ctx.coerce(d.Args["if"], "Boolean!")
+		if err != nil {
+			return false, fmt.Errorf("@%s: %s", d.Name, err)
+		}
+
+		if value.(bool) == (d.Name == "skip") {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Resolve selections on every source object, one field at a time
+func (ctx *gqlContext) executeSelections(object *gqlObject, sources []interface{}, selections []gqlSelection, paths [][]interface{}) ([]*gqlResult, error) {
+	results := make([]*gqlResult, len(sources))
+	for i := range results {
+		results[i] = newGQLResult()
+	}
+
+	keys := []string{}
+	fields := map[string][]gqlSelection{}
+	if err := ctx.collectFields(object, selections, &keys, fields); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		selected := fields[key]
+		first := selected[0]
+
+		if first.Name == "__typename" {
+			for _, result := range results {
+				result.set(key, object.Name)
+			}
+			continue
+		}
+
+		field, ok := object.field(first.Name)
+		if !ok {
+			return nil, fmt.Errorf("field %s does not exist on %s", first.Name, object.Name)
+		}
+
+		args, err := ctx.coerceArgs(field, first.Args)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", object.Name, first.Name, err)
+		}
+
+		subSelections := []gqlSelection{}
+		for _, s := range selected {
+			subSelections = append(subSelections, s.Selections...)
+		}
+
+		fieldPaths := make([][]interface{}, len(sources))
+		for i := range sources {
+			fieldPaths[i] = append(append([]interface{}{}, paths[i]...), key)
+		}
+
+		values, err := field.Resolve(ctx, sources, args)
+		if err != nil {
+			ctx.fieldError(err, fieldPaths[0])
+			values = make([]interface{}, len(sources))
+		}
+
+		completed, err := ctx.complete(field.Type, values, subSelections, fieldPaths)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, result := range results {
+			result.set(key, completed[i])
+		}
+	}
+
+	return results, nil
+}
+
+// Turn resolved values into results: scalars as they are, objects by resolving their
+// selections, lists item by item. Every object at a level is resolved together.
+func (ctx *gqlContext) complete(typ string, values []interface{}, selections []gqlSelection, paths [][]interface{}) ([]interface{}, error) {
+	typ = strings.TrimSuffix(typ, "!")
+	completed := make([]interface{}, len(values))
+
+	if strings.HasPrefix(typ, "[") {
+		inner := typ[1 : len(typ)-1]
+
+		// Flatten every list into one level, then put the lists back together
+		flat := []interface{}{}
+		flatPaths := [][]interface{}{}
+		lengths := make([]int, len(values))
+		for i, value := range values {
+			lengths[i] = -1
+			if isNil(value) {
+				continue
+			}
+
+			list := reflect.ValueOf(value)
+			lengths[i] = list.Len()
+			for j := 0; j < list.Len(); j++ {
+				flat = append(flat, list.Index(j).Interface())
+				flatPaths = append(flatPaths, append(append([]interface{}{}, paths[i]...), j))
+			}
+		}
+
+		items, err := ctx.complete(inner, flat, selections, flatPaths)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, n := range lengths {
+			if n < 0 {
+				continue
+			}
+			completed[i] = items[:n:n]
+			items = items[n:]
+		}
+
+		return completed, nil
+	}
+
+	object, ok := ctx.schema.object(typ)
+	if !ok {
+		if len(selections) > 0 {
+			return nil, fmt.Errorf("%s has no fields to select", typ)
+		}
+		for i, value := range values {
+			if !isNil(value) {
+				completed[i] = value
+			}
+		}
+		return completed, nil
+	}
+
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("fields must be selected on %s", typ)
+	}
+
+	sources := []interface{}{}
+	sourcePaths := [][]interface{}{}
+	indexes := []int{}
+	for i, value := range values {
+		if isNil(value) {
+			continue
+		}
+		sources = append(sources, value)
+		sourcePaths = append(sourcePaths, paths[i])
+		indexes = append(indexes, i)
+	}
+
+	if len(sources) == 0 {
+		return completed, nil
+	}
+
+	results, err := ctx.executeSelections(object, sources, selections, sourcePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range indexes {
+		completed[i] = results[j]
+	}
+
+	return completed, nil
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+// Record a field that failed. Typed errors keep their message and code; anything
+// else is logged and reported as an internal error.
+func (ctx *gqlContext) fieldError(err error, path []interface{}) {
+	apiErr := errInternal(err)
+	if typed := new(APIError); errors.As(err, &typed) {
+		apiErr = typed
+	}
+
+	message := apiErr.Message
+	if apiErr.Status >= 500 && ctx.server != nil {
+		ctx.server.log.Warn(fmt.Sprintf("graphql %v: %s", path, apiErr))
+	}
+
+	extensions := map[string]interface{}{"code": apiErr.Code}
+	if len(apiErr.Fields) > 0 {
+		extensions["fields"] = apiErr.Fields
+	}
+
+	ctx.errors = append(ctx.errors, gqlError{Message: message, Path: path, Extensions: extensions})
+}
+
+/*
+ *
+ *
+ * Arguments
+ *
+ *
+ */
+
+func (ctx *gqlContext) coerceArgs(field gqlField, given map[string]interface{}) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+
+	for name := range given {
+		found := false
+		for _, a := range field.Args {
+			if a.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("argument %s does not exist", name)
+		}
+	}
+
+	for _, a := range field.Args {
+		value, err := ctx.coerce(given[a.Name], a.Type)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %s", a.Name, err)
+		}
+		if value != nil {
+			args[a.Name] = value
+		}
+	}
+
+	return args, nil
+}
+
+// Check a value against a type, replacing variables with their values. Values from
+// variables come from JSON, so whole float64s are accepted as Ints.
+func (ctx *gqlContext) coerce(value interface{}, typ string) (interface{}, error) {
+	if v, ok := value.(gqlVariable); ok {
+		value = ctx.variables[string(v)]
+	}
+
+	nonNull := strings.HasSuffix(typ, "!")
+	typ = strings.TrimSuffix(typ, "!")
+
+	if value == nil {
+		if nonNull {
+			return nil, fmt.Errorf("is required")
+		}
+		return nil, nil
+	}
+
+	if strings.HasPrefix(typ, "[") {
+		inner := typ[1 : len(typ)-1]
+
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+
+		coerced := []interface{}{}
+		for _, item := range list {
+			c, err := ctx.coerce(item, inner)
+			if err != nil {
+				return nil, err
+			}
+			coerced = append(coerced, c)
+		}
+		return coerced, nil
+	}
+
+	switch typ {
+	case "Int":
+		switch v := value.(type) {
+		case int64:
+			return int(v), nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		}
+		return nil, fmt.Errorf("must be an Int")
+	case "Float":
+		switch v := value.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("must be a Float")
+	case "Boolean":
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("must be a Boolean")
+	case "ID":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		}
+		return nil, fmt.Errorf("must be an ID")
+	case "String":
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("must be a String")
+	}
+
+	return nil, fmt.Errorf("type %s can't be used as an argument", typ)
+}
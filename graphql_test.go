@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		# a comment
+		query Clips($first: Int = 5, $tag: String!) {
+			latest: clips(first: $first, tag: $tag, order: NEWEST, filter: {ids: ["a", "b"]}) {
+				...clipFields
+				... on Clip @include(if: true) { id }
+			}
+		}
+
+		fragment clipFields on Clip {
+			description
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := doc.operation("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Type != "query" || op.Name != "Clips" {
+		t.Errorf("operation = %s %s, want query Clips", op.Type, op.Name)
+	}
+
+	if len(op.Variables) != 2 || op.Variables[0].Default != int64(5) || op.Variables[1].Type != "String!" {
+		t.Errorf("variables = %+v", op.Variables)
+	}
+
+	clips := op.Selections[0]
+	if clips.key() != "latest" || clips.Name != "clips" {
+		t.Errorf("selection = %s: %s, want latest: clips", clips.Alias, clips.Name)
+	}
+
+	if clips.Args["first"] != gqlVariable("first") || clips.Args["order"] != gqlEnum("NEWEST") {
+		t.Errorf("args = %+v", clips.Args)
+	}
+
+	filter, _ := clips.Args["filter"].(map[string]interface{})
+	if ids, _ := filter["ids"].([]interface{}); len(ids) != 2 || ids[1] != "b" {
+		t.Errorf("filter = %+v", clips.Args["filter"])
+	}
+
+	if len(clips.Selections) != 2 || clips.Selections[0].Spread != "clipFields" || !clips.Selections[1].Inline || clips.Selections[1].TypeName != "Clip" {
+		t.Errorf("selections = %+v", clips.Selections)
+	}
+
+	if fragment := doc.Fragments["clipFields"]; fragment.TypeName != "Clip" || fragment.Selections[0].Name != "description" {
+		t.Errorf("fragment = %+v", fragment)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`{ clips `,
+		`{ clips(first: ) { id } }`,
+		`{ clip(id: "unterminated) { id } }`,
+		`query { a } query { b } garbage`,
+		`{ a } fragment f on { b }`,
+	}
+
+	for _, src := range tests {
+		if _, err := parseGraphQL(src); err == nil {
+			t.Errorf("parseGraphQL(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestParseGraphQLStrings(t *testing.T) {
+	doc, err := parseGraphQL(`{ a(s: "tab\there é \"quoted\"") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := doc.Operations[0].Selections[0].Args["s"], "tab\there é \"quoted\""; got != want {
+		t.Errorf("string = %q, want %q", got, want)
+	}
+}
+
+// An item with children, to check nesting, batching and costs
+type testItem struct {
+	ID string
+}
+
+// A schema of items, and how many times each resolver ran
+func testGraphSchema(calls map[string]int) *gqlSchema {
+	items := func(n int) []testItem {
+		list := []testItem{}
+		for i := 0; i < n; i++ {
+			list = append(list, testItem{ID: string(rune('a' + i))})
+		}
+		return list
+	}
+
+	size := func(args map[string]interface{}) int {
+		n, _ := args["first"].(int)
+		return n
+	}
+
+	return &gqlSchema{
+		Query: "Query",
+		Types: []*gqlObject{
+			{Name: "Query", Fields: []gqlField{
+				{Name: "hello", Type: "String!", Args: []gqlArg{{Name: "name", Type: "String!"}},
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						return "hello " + args["name"].(string), nil
+					})},
+				{Name: "items", Type: "[Item!]!", Args: []gqlArg{{Name: "first", Type: "Int!"}}, Size: size,
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						return items(args["first"].(int)), nil
+					})},
+				{Name: "broken", Type: "String",
+					Resolve: graphRoot(func(ctx *gqlContext, args map[string]interface{}) (interface{}, error) {
+						return nil, errNotFound("thing")
+					})},
+			}},
+			{Name: "Item", Fields: []gqlField{
+				{Name: "id", Type: "ID!", Resolve: graphProp(func(v interface{}) interface{} { return v.(testItem).ID })},
+				{Name: "children", Type: "[Item!]!", Args: []gqlArg{{Name: "first", Type: "Int!"}}, Size: size,
+					Resolve: func(ctx *gqlContext, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+						calls["children"]++
+						values := make([]interface{}, len(sources))
+						for i, source := range sources {
+							children := items(args["first"].(int))
+							for j := range children {
+								children[j].ID = source.(testItem).ID + children[j].ID
+							}
+							values[i] = children
+						}
+						return values, nil
+					}},
+			}},
+		},
+	}
+}
+
+// Run a query against the test schema, returning its data as JSON and its errors
+func runTestQuery(t *testing.T, src string, variables map[string]interface{}, calls map[string]int) (string, []gqlError, error) {
+	t.Helper()
+
+	doc, err := parseGraphQL(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := doc.operation("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &gqlContext{schema: testGraphSchema(calls)}
+	data, err := ctx.execute(doc, op, variables)
+	if err != nil {
+		return "", nil, err
+	}
+
+	out, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out), ctx.errors, nil
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{"aliases", `{ hi: hello(name: "a") hello(name: "b") }`, nil, `{"hi":"hello a","hello":"hello b"}`},
+		{"variables", `query($n: String!) { hello(name: $n) }`, map[string]interface{}{"n": "c"}, `{"hello":"hello c"}`},
+		{"whole floats are ints", `query($n: Int!) { items(first: $n) { id } }`, map[string]interface{}{"n": float64(2)}, `{"items":[{"id":"a"},{"id":"b"}]}`},
+		{"nesting", `{ items(first: 2) { id children(first: 2) { id } } }`, nil,
+			`{"items":[{"id":"a","children":[{"id":"aa"},{"id":"ab"}]},{"id":"b","children":[{"id":"ba"},{"id":"bb"}]}]}`},
+		{"fragments", `{ items(first: 1) { ...f ... on Item { children(first: 1) { id } } } } fragment f on Item { id }`, nil,
+			`{"items":[{"id":"a","children":[{"id":"aa"}]}]}`},
+		{"skip and include", `query($no: Boolean!) { items(first: 1) { id @skip(if: true) children(first: 1) @include(if: $no) { id } __typename } }`,
+			map[string]interface{}{"no": false}, `{"items":[{"__typename":"Item"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs, err := runTestQuery(t, tt.query, tt.variables, map[string]int{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(errs) > 0 {
+				t.Errorf("errors = %+v", errs)
+			}
+			if got != tt.want {
+				t.Errorf("data = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteBatchesLevels(t *testing.T) {
+	calls := map[string]int{}
+	_, _, err := runTestQuery(t, `{ items(first: 5) { children(first: 5) { children(first: 5) { id } } } }`, nil, calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once for the 5 items and once for their 25 children
+	if calls["children"] != 2 {
+		t.Errorf("children resolved %d times, want 2", calls["children"])
+	}
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	got, errs, err := runTestQuery(t, `{ broken hello(name: "a") }`, nil, map[string]int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"broken":null,"hello":"hello a"}`; got != want {
+		t.Errorf("data = %s, want %s", got, want)
+	}
+
+	if len(errs) != 1 || errs[0].Path[0] != "broken" || errs[0].Extensions["code"] != "not_found" {
+		t.Errorf("errors = %+v, want a not_found error at broken", errs)
+	}
+}
+
+func TestExecuteRefuses(t *testing.T) {
+	deep := `{ items(first: 1) { ` + strings.Repeat(`children(first: 1) { `, gqlMaxDepth) + `id` + strings.Repeat(` }`, gqlMaxDepth+1) + ` }`
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{"unknown field", `{ nope }`, nil, "does not exist"},
+		{"unknown argument", `{ hello(name: "a", other: 1) }`, nil, "argument other does not exist"},
+		{"missing argument", `{ hello }`, nil, "argument name: is required"},
+		{"missing variable", `query($n: String!) { hello(name: $n) }`, nil, "variable $n is required"},
+		{"wrong type", `{ items(first: "two") { id } }`, nil, "argument first"},
+		{"no selection", `{ items(first: 1) }`, nil, "fields must be selected"},
+		{"self spread", `{ items(first: 1) { ...f } } fragment f on Item { children(first: 1) { ...f } }`, nil, "spreads itself"},
+		{"too deep", deep, nil, "nested deeper"},
+		{"too costly", `{ items(first: 100) { children(first: 100) { children(first: 2) { id } } } }`, nil, "more than 10000 objects"},
+		{"too costly through variables", `query($n: Int!) { items(first: $n) { children(first: $n) { id } } }`, map[string]interface{}{"n": float64(101)}, "more than 10000 objects"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := map[string]int{}
+			_, _, err := runTestQuery(t, tt.query, tt.variables, calls)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want one containing %q", err, tt.want)
+			}
+			if tt.name == "too costly" && calls["children"] > 0 {
+				t.Errorf("children resolved %d times before the query was refused", calls["children"])
+			}
+		})
+	}
+}
+
+func TestClipCursors(t *testing.T) {
+	clip := Clip{ID: "clip-1", DateUploaded: time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)}
+
+	cursor, ok := decodeClipCursor(encodeClipCursor(clip))
+	if !ok || cursor.ID != clip.ID || !cursor.DateUploaded.Equal(clip.DateUploaded) {
+		t.Errorf("cursor = %+v, %t; want clip-1 at %s", cursor, ok, clip.DateUploaded)
+	}
+
+	for _, bad := range []string{"", "!!", encodeCursor("user", "1:clip-1"), encodeCursor("clip", "clip-1"), encodeCursor("clip", "1:")} {
+		if _, ok := decodeClipCursor(bad); ok {
+			t.Errorf("decodeClipCursor(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestListedClipsQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		viewer   User
+		loggedIn bool
+	}{
+		{"anonymous", User{}, false},
+		{"viewer", User{ID: "user-1", Role: RoleViewer}, true},
+		{"admin", User{ID: "user-2", Role: RoleAdmin}, true},
+	}
+
+	visibilities := []string{VisibilityPublic, VisibilityUnlisted, VisibilityMembers, VisibilityPrivate, ""}
+	owners := []string{"user-1", "user-2", "user-3"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := listedClipsQuery(tt.viewer, tt.loggedIn)
+
+			// The SQL condition, evaluated in Go, must agree with canViewClip
+			for _, visibility := range visibilities {
+				for _, owner := range owners {
+					clip := Clip{Visibility: visibility, UserID: owner}
+					listed := (visibility == VisibilityPrivate && owner == q.PrivateOf)
+					for _, v := range q.Visibilities {
+						listed = listed || v == visibility
+					}
+
+					if want := canViewClip(tt.viewer, tt.loggedIn, clip, true); listed != want {
+						t.Errorf("%q clip of %s: listed = %t, want %t", visibility, owner, listed, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGraphQLEndpointRefusesCostlyQueries(t *testing.T) {
+	router := newStubServer().routes()
+
+	query := `{ games { clips(first: 100) { nodes { id } } } }`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape(query), nil))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "validation_failed") {
+		t.Errorf("status = %d, want %d with validation_failed: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const jobTypeGuildCheck = "guild_check"
+
+const defaultGuildCheckInterval = 6 * time.Hour
+
+// Returned when Discord no longer accepts a session's token, e.g. the user
+// de-authorised the app
+var errDiscordTokenInvalid = errors.New("discord token is no longer valid")
+
+// A member of a guild, from /users/@me/guilds/{guild.id}/member
+type discordGuildMember struct {
+	Roles []string `json:"roles"`
+}
+
+// Guilds a user must be in to log in, from DISCORD_GUILD_IDS. Empty means anyone may log in.
+func allowedGuildIDs() []string {
+	return splitEnvList("DISCORD_GUILD_IDS")
+}
+
+// Guild roles of which a user must have at least one, from DISCORD_GUILD_ROLE_IDS.
+// Empty means membership alone is enough.
+func requiredGuildRoleIDs() []string {
+	return splitEnvList("DISCORD_GUILD_ROLE_IDS")
+}
+
+func guildGatingEnabled() bool {
+	return len(allowedGuildIDs()) > 0
+}
+
+func splitEnvList(name string) []string {
+	values := []string{}
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// Check the token's user is in one of the allowed guilds, with a required role if any
+// are configured. Returns their roles across the allowed guilds, and a reason the user
+// can be shown when they aren't let in.
+func checkGuildMembership(ctx context.Context, token *oauth2.Token) (bool, []string, string, error) {
+	if !guildGatingEnabled() {
+		return true, nil, "", nil
+	}
+
+	roles := []string{}
+	member := false
+	for _, guildID := range allowedGuildIDs() {
+		guildMember, ok, err := getDiscordGuildMember(ctx, token, guildID)
+		if err != nil {
+			return false, nil, "", err
+		}
+
+		if ok {
+			member = true
+			roles = append(roles, guildMember.Roles...)
+		}
+	}
+
+	if !member {
+		return false, nil, "Only members of our Discord server can sign in.", nil
+	}
+
+	requiredRoles := requiredGuildRoleIDs()
+	if len(requiredRoles) == 0 {
+		return true, roles, "", nil
+	}
+
+	for _, role := range roles {
+		for _, required := range requiredRoles {
+			if role == required {
+				return true, roles, "", nil
+			}
+		}
+	}
+
+	return false, nil, "You don't have a Discord server role that is allowed to sign in.", nil
+}
+
+// Mapping of Discord guild role IDs to our roles, from DISCORD_ROLE_MAP,
+// e.g. "1090000000000000001=moderator,1090000000000000002=uploader"
+func discordRoleMap() map[string]string {
+	mapping := map[string]string{}
+	for _, pair := range splitEnvList("DISCORD_ROLE_MAP") {
+		discordRole, role, ok := strings.Cut(pair, "=")
+		if !ok || !isValidRole(strings.TrimSpace(role)) {
+			continue
+		}
+		mapping[strings.TrimSpace(discordRole)] = strings.TrimSpace(role)
+	}
+
+	return mapping
+}
+
+// The mapping needs guild roles, so it only applies when guild gating is on
+func roleMappingEnabled() bool {
+	return guildGatingEnabled() && len(discordRoleMap()) > 0
+}
+
+// The highest of our roles mapped from a user's Discord roles, or viewer if none are mapped
+func mappedRole(discordRoles []string) string {
+	mapping := discordRoleMap()
+
+	role := RoleViewer
+	for _, discordRole := range discordRoles {
+		if mapped, ok := mapping[discordRole]; ok && roleRank(mapped) > roleRank(role) {
+			role = mapped
+		}
+	}
+
+	return role
+}
+
+// Give a user the role their Discord roles map to, unless an admin set their role by hand
+func (s *APIServer) syncDiscordRoles(user User, discordRoles []string) (User, error) {
+	if !roleMappingEnabled() || user.RoleSource != roleSourceDiscord {
+		return user, nil
+	}
+
+	role := mappedRole(discordRoles)
+	if err := s.setUserRole(user, role, roleSourceDiscord, "discord"); err != nil {
+		return user, err
+	}
+
+	user.Role = role
+	return user, nil
+}
+
+// Get the token's user's membership of a guild. ok is false if they aren't a member.
+func getDiscordGuildMember(ctx context.Context, token *oauth2.Token, guildID string) (discordGuildMember, bool, error) {
+	member := discordGuildMember{}
+
+	url := fmt.Sprintf("%s/users/@me/guilds/%s/member", discordAPIURL(), guildID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return member, false, fmt.Errorf("error creating request to Discord API: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return member, false, fmt.Errorf("error getting response from Discord API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return member, false, nil
+	case http.StatusUnauthorized:
+		return member, false, errDiscordTokenInvalid
+	default:
+		return member, false, fmt.Errorf("unexpected status from Discord guild member API: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&member); err != nil {
+		return member, false, fmt.Errorf("error decoding guild member: %w", err)
+	}
+
+	return member, true, nil
+}
+
+// Show a user why they couldn't log in
+func renderLoginRejected(w http.ResponseWriter, reason string) error {
+	t, err := template.ParseFiles("./templates/login_rejected.html")
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, reason); err != nil {
+		return err
+	}
+
+	writeResponse(w, http.StatusForbidden, "text/html; charset=utf-8", b.Bytes())
+	return nil
+}
+
+/*
+ *
+ *
+ * Re-validation
+ *
+ *
+ */
+
+// Re-check the guild membership of everyone who can still get in, with a session or
+// an API token. Users who have left the server or lost their role, and users whose
+// membership can't be confirmed because none of their sessions has a working Discord
+// token, lose every session and API token and their mapped role. Everyone else has
+// their roles synced.
+func (s *APIServer) handleGuildCheckJob(job Job) error {
+	if !guildGatingEnabled() {
+		return nil
+	}
+
+	userIDs, err := s.store.GetUserIDsWithAccess()
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		s.checkUserGuildMembership(userID)
+	}
+
+	s.scheduleNextGuildCheck()
+
+	return nil
+}
+
+func (s *APIServer) checkUserGuildMembership(userID string) {
+	user, err := s.store.GetUserByID(userID)
+	if err != nil {
+		s.log.Warn(fmt.Sprintf("guild check: user %s: %s", userID, err))
+		return
+	}
+
+	token, err := s.userDiscordToken(user.ID)
+	if errors.Is(err, errDiscordTokenInvalid) {
+		s.revokeForGuild(user, "no working discord token to check membership with")
+		return
+	}
+	if err != nil {
+		s.log.Warn(fmt.Sprintf("guild check: user %s: %s", user.Username, err))
+		return
+	}
+
+	ok, discordRoles, _, err := checkGuildMembership(context.Background(), token)
+	if errors.Is(err, errDiscordTokenInvalid) {
+		s.revokeForGuild(user, err.Error())
+		return
+	}
+	if err != nil {
+		// Discord being down isn't a reason to lock everyone out; the next run retries
+		s.log.Warn(fmt.Sprintf("guild check: user %s: %s", user.Username, err))
+		return
+	}
+
+	if !ok {
+		s.revokeForGuild(user, "no longer allowed in")
+		return
+	}
+
+	if _, err := s.syncDiscordRoles(user, discordRoles); err != nil {
+		s.log.Warn(fmt.Sprintf("guild check: syncing roles of user %s: %s", user.Username, err))
+	}
+}
+
+// Log a user out everywhere, revoke their API tokens and drop the role their Discord
+// roles gave them
+func (s *APIServer) revokeForGuild(user User, reason string) {
+	count, err := s.store.RevokeUserSessions(user.ID)
+	if err != nil {
+		s.log.Warn(err.Error())
+	}
+
+	tokens, err := s.store.RevokeUserAPITokens(user.ID)
+	if err != nil {
+		s.log.Warn(err.Error())
+	}
+
+	if _, err := s.syncDiscordRoles(user, nil); err != nil {
+		s.log.Warn(fmt.Sprintf("guild check: resetting role of user %s: %s", user.Username, err))
+	}
+
+	s.log.Info(fmt.Sprintf("guild check: revoked %d sessions and %d api tokens of user %s, %s", count, tokens, user.Username, reason))
+}
+
+// A working Discord token from one of the user's sessions, most recently used first.
+// errDiscordTokenInvalid means none of them has one.
+func (s *APIServer) userDiscordToken(userID string) (*oauth2.Token, error) {
+	sessions, err := s.store.GetUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		token, err := s.sessionDiscordToken(session)
+		if errors.Is(err, errDiscordTokenInvalid) {
+			continue
+		}
+		return token, err
+	}
+
+	return nil, errDiscordTokenInvalid
+}
+
+// A session's Discord token, refreshing and saving it if it has expired
+func (s *APIServer) sessionDiscordToken(session Session) (*oauth2.Token, error) {
+	if len(session.DiscordToken) == 0 {
+		return nil, errDiscordTokenInvalid
+	}
+
+	plaintext, err := decryptSecret(session.DiscordToken)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(plaintext, token); err != nil {
+		return nil, fmt.Errorf("error unmarshalling discord token: %w", err)
+	}
+
+	fresh, err := discordOAuthConfig().TokenSource(context.Background(), token).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return nil, errDiscordTokenInvalid
+		}
+		return nil, fmt.Errorf("error refreshing discord token: %w", err)
+	}
+
+	if fresh.AccessToken != token.AccessToken {
+		if err := s.saveSessionDiscordToken(session.ID, fresh); err != nil {
+			s.log.Warn(err.Error())
+		}
+	}
+
+	return fresh, nil
+}
+
+// Check a user logging in with Twitch or Steam against the server, with the Discord
+// token of one of their Discord sessions. The token is returned so the new session
+// keeps it and stays covered by the periodic guild check.
+func (s *APIServer) checkLinkedGuildMembership(user User) (bool, []string, string, *oauth2.Token, error) {
+	if user.DiscordID == "" {
+		return false, nil, "Only members of our Discord server can sign in. Sign in with Discord instead.", nil, nil
+	}
+
+	token, err := s.userDiscordToken(user.ID)
+	if errors.Is(err, errDiscordTokenInvalid) {
+		return false, nil, "Sign in with Discord so we can check you're still in our server.", nil, nil
+	}
+	if err != nil {
+		return false, nil, "", nil, err
+	}
+
+	allowed, discordRoles, reason, err := checkGuildMembership(context.Background(), token)
+	return allowed, discordRoles, reason, token, err
+}
+
+func (s *APIServer) saveSessionDiscordToken(sessionID string, token *oauth2.Token) error {
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("error marshalling discord token: %w", err)
+	}
+
+	discordToken, err := encryptSecret(tokenJSON)
+	if err != nil {
+		return err
+	}
+
+	return s.store.UpdateSessionDiscordToken(sessionID, discordToken)
+}
+
+// Make sure a guild check job is queued when guild gating is on. The job janitor
+// calls this every minute, so one failed run doesn't end the schedule.
+func (s *APIServer) scheduleGuildCheck() {
+	if !guildGatingEnabled() || guildCheckInterval() <= 0 {
+		return
+	}
+
+	pending, err := s.store.HasPendingJob(jobTypeGuildCheck)
+	if err != nil {
+		s.log.Warn(err.Error())
+		return
+	}
+
+	if pending {
+		return
+	}
+
+	if _, err := s.enqueueJob(jobTypeGuildCheck, defaultJobQueue, struct{}{}); err != nil {
+		s.log.Warn(err.Error())
+	}
+}
+
+func (s *APIServer) scheduleNextGuildCheck() {
+	if !guildGatingEnabled() || guildCheckInterval() <= 0 {
+		return
+	}
+
+	if _, err := s.enqueueJobAfter(jobTypeGuildCheck, defaultJobQueue, struct{}{}, guildCheckInterval()); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+// How often to re-check guild membership, from DISCORD_GUILD_CHECK_INTERVAL. 0 turns it off.
+func guildCheckInterval() time.Duration {
+	value := os.Getenv("DISCORD_GUILD_CHECK_INTERVAL")
+	if value == "" {
+		return defaultGuildCheckInterval
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultGuildCheckInterval
+	}
+
+	return interval
+}
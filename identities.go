@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func identityOf(userID string, profile ProviderUser) UserIdentity {
+	return UserIdentity{
+		Provider: profile.Provider,
+		Subject:  profile.ID,
+		UserID:   userID,
+		Username: truncate(profile.Username, 64),
+	}
+}
+
+// Cut s to at most n characters, never inside one
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+
+	return s
+}
+
+// Find the user for a Twitch or Steam account, creating them if they have an invite.
+// Unlike Discord with guild gating, these accounts never vouch for a new user by
+// themselves, and they are never linked to an existing user by email.
+func (s *APIServer) identityLogin(profile ProviderUser, invite string) (User, error) {
+	user, err := s.store.GetUserByIdentity(profile.Provider, profile.ID)
+	if err == nil {
+		if err := s.store.SaveUserIdentity(identityOf(user.ID, profile)); err != nil {
+			s.log.Warn(err.Error())
+		}
+		return user, nil
+	}
+
+	if invite == "" {
+		return User{}, errInviteRequired
+	}
+
+	username := truncate(profile.Username, 35)
+	if _, err := s.store.GetUserByUsername(username); err == nil {
+		return User{}, errConflict(fmt.Sprintf("username %s is taken, log in to your existing account and link your %s account from there", username, profile.Provider))
+	}
+
+	email := profile.Email
+	if _, err := s.store.GetUserByEmail(email); email != "" && err == nil {
+		return User{}, errConflict(fmt.Sprintf("email %s belongs to an existing account, log in to it and link your %s account from there", email, profile.Provider))
+	}
+
+	newUser := User{
+		Username:    username,
+		Email:       email,
+		DisplayName: truncate(profile.DisplayName, 64),
+	}
+	user, err = s.registerWithInvite(newUser, invite)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := s.store.SaveUserIdentity(identityOf(user.ID, profile)); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// Link an account at a login provider to a logged in user, so they can log in with either
+func (s *APIServer) linkIdentity(userID string, profile ProviderUser) error {
+	user, err := s.store.GetUserByID(userID)
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	if profile.Provider == providerDiscord {
+		if other, err := s.store.GetUserByDiscordID(profile.ID); err == nil && other.ID != user.ID {
+			return errConflict("this Discord account is linked to another user")
+		}
+
+		_, err := s.syncDiscordProfile(user, profile)
+		return err
+	}
+
+	if other, err := s.store.GetUserByIdentity(profile.Provider, profile.ID); err == nil && other.ID != user.ID {
+		return errConflict(fmt.Sprintf("this %s account is linked to another user", profile.Provider))
+	}
+
+	if err := s.store.SaveUserIdentity(identityOf(user.ID, profile)); err != nil {
+		return err
+	}
+
+	s.log.Info(fmt.Sprintf("linked %s account %s to user %s", profile.Provider, profile.ID, user.Username))
+	return nil
+}
+
+/*
+ *
+ *
+ * Handlers
+ *
+ *
+ */
+
+// Route for listing the accounts the logged in user can log in with
+func (s *APIServer) handleGetIdentities(w http.ResponseWriter, r *http.Request) error {
+	session, ok := s.currentSession(r)
+	if !ok {
+		return errUnauthorized()
+	}
+
+	user, err := s.store.GetUserByID(session.UserID)
+	if err != nil {
+		return err
+	}
+
+	identities, err := s.store.GetUserIdentities(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if user.DiscordID != "" {
+		discord := UserIdentity{Provider: providerDiscord, Subject: user.DiscordID, UserID: user.ID, Username: user.Username}
+		identities = append([]UserIdentity{discord}, identities...)
+	}
+
+	return responseWithJSON(w, http.StatusOK, identities)
+}
+
+// Route for unlinking a Twitch or Steam account. Discord can't be unlinked, since guild
+// gating and role mapping rely on it, and a user's last way to log in can't be removed.
+func (s *APIServer) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) error {
+	session, ok := s.currentSession(r)
+	if !ok {
+		return errUnauthorized()
+	}
+
+	provider := r.PostFormValue("provider")
+	if provider == providerDiscord {
+		return errBadRequest("discord accounts can't be unlinked")
+	}
+
+	user, err := s.store.GetUserByID(session.UserID)
+	if err != nil {
+		return err
+	}
+
+	identities, err := s.store.GetUserIdentities(user.ID)
+	if err != nil {
+		return err
+	}
+
+	linked := false
+	for _, identity := range identities {
+		if identity.Provider == provider {
+			linked = true
+		}
+	}
+
+	if !linked {
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "account is not linked"}
+	}
+
+	if user.DiscordID == "" && len(identities) == 1 {
+		return errConflict("can't unlink the only account you log in with")
+	}
+
+	if err := s.store.DeleteUserIdentity(user.ID, provider); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "account unlinked")
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Extensions picked up when walking a directory
+var importVideoExts = map[string]bool{
+	".mp4":  true,
+	".mov":  true,
+	".mkv":  true,
+	".webm": true,
+}
+
+// Outcome of importing one file
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importFailed   = "failed"
+)
+
+// Maps names from the source library onto lostsons.tv games, users and tags.
+// Anything not in a map is used as-is.
+type ImportMapping struct {
+	DefaultUsername   string            `json:"default_username"`
+	DefaultGame       string            `json:"default_game"`
+	DefaultVisibility string            `json:"default_visibility"`
+	DefaultTags       []string          `json:"default_tags"`
+	Games             map[string]string `json:"games"`
+	Users             map[string]string `json:"users"`
+	Tags              map[string]string `json:"tags"`
+}
+
+// One clip in a medal.tv export manifest. The manifest is a JSON array of these,
+// with File relative to the manifest's directory.
+type MedalClip struct {
+	File      string    `json:"file"`
+	Title     string    `json:"title"`
+	Game      string    `json:"game"`
+	Uploader  string    `json:"uploader"`
+	Tags      []string  `json:"tags"`
+	Featured  []string  `json:"featured"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// A file waiting to be imported, with its metadata already mapped
+type importItem struct {
+	Path         string
+	Form         NewClipForm
+	DateUploaded time.Time
+}
+
+type ImportResult struct {
+	Path      string    `json:"path"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	ObjectKey string    `json:"object_key,omitempty"`
+	JobID     string    `json:"job_id,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+type ImportReport struct {
+	Imported int            `json:"imported"`
+	Skipped  int            `json:"skipped"`
+	Failed   int            `json:"failed"`
+	Results  []ImportResult `json:"results"`
+}
+
+// Progress of an import, saved after every file so an interrupted run can resume.
+// Files already imported are skipped; skipped and failed files are tried again.
+type importState struct {
+	path    string
+	mu      sync.Mutex
+	Results map[string]ImportResult `json:"results"`
+}
+
+func loadImportState(path string) (*importState, error) {
+	state := &importState{path: path, Results: map[string]ImportResult{}}
+
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading import state: %w", err)
+	}
+
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, fmt.Errorf("error parsing import state: %w", err)
+	}
+
+	return state, nil
+}
+
+func (st *importState) done(path string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.Results[path].Status == importImported
+}
+
+func (st *importState) record(result ImportResult) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Results[result.Path] = result
+
+	body, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash mid-write can't lose the whole state
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, st.path)
+}
+
+func (st *importState) report() ImportReport {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	report := ImportReport{Results: []ImportResult{}}
+	for _, result := range st.Results {
+		switch result.Status {
+		case importImported:
+			report.Imported++
+		case importSkipped:
+			report.Skipped++
+		case importFailed:
+			report.Failed++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].Path < report.Results[j].Path
+	})
+
+	return report
+}
+
+func loadImportMapping(path string) (ImportMapping, error) {
+	mapping := ImportMapping{}
+	if path == "" {
+		return mapping, nil
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return mapping, fmt.Errorf("error reading mapping file: %w", err)
+	}
+
+	if err := json.Unmarshal(body, &mapping); err != nil {
+		return mapping, fmt.Errorf("error parsing mapping file: %w", err)
+	}
+
+	return mapping, nil
+}
+
+func (m ImportMapping) game(name string) string {
+	if mapped, ok := m.Games[name]; ok {
+		return mapped
+	}
+	if name == "" {
+		return m.DefaultGame
+	}
+	return name
+}
+
+func (m ImportMapping) user(name string) string {
+	if mapped, ok := m.Users[name]; ok {
+		return mapped
+	}
+	if name == "" {
+		return m.DefaultUsername
+	}
+	return name
+}
+
+func (m ImportMapping) tags(tags []string) string {
+	mapped := []string{}
+	for _, tag := range append(tags, m.DefaultTags...) {
+		if to, ok := m.Tags[tag]; ok {
+			tag = to
+		}
+		if tag = strings.TrimSpace(tag); tag != "" {
+			mapped = append(mapped, tag)
+		}
+	}
+
+	return strings.Join(mapped, ",")
+}
+
+func (m ImportMapping) users(names []string) string {
+	mapped := []string{}
+	for _, name := range names {
+		mapped = append(mapped, m.user(name))
+	}
+
+	return strings.Join(mapped, ",")
+}
+
+// Collect the videos under dir. A file's first directory below dir is taken as its game
+// and its name as the description, e.g. dir/Apex Legends/triple kill.mp4.
+func importItemsFromDir(dir string, mapping ImportMapping) ([]importItem, error) {
+	items := []importItem{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !importVideoExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		game := ""
+		if parts := strings.Split(filepath.ToSlash(rel), "/"); len(parts) > 1 {
+			game = parts[0]
+		}
+
+		items = append(items, importItem{
+			Path: path,
+			Form: NewClipForm{
+				Username:    mapping.user(""),
+				Description: importDescription(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))),
+				Game:        mapping.game(game),
+				Tags:        mapping.tags(nil),
+				Visibility:  mapping.DefaultVisibility,
+			},
+			DateUploaded: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %w", dir, err)
+	}
+
+	return items, nil
+}
+
+// Collect the clips listed in a medal.tv export manifest
+func importItemsFromMedal(manifestPath string, mapping ImportMapping) ([]importItem, error) {
+	body, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading medal manifest: %w", err)
+	}
+
+	medalClips := []MedalClip{}
+	if err := json.Unmarshal(body, &medalClips); err != nil {
+		return nil, fmt.Errorf("error parsing medal manifest: %w", err)
+	}
+
+	baseDir := filepath.Dir(manifestPath)
+	items := []importItem{}
+	for _, medalClip := range medalClips {
+		dateUploaded := medalClip.CreatedAt
+		if dateUploaded.IsZero() {
+			dateUploaded = time.Now()
+		}
+
+		items = append(items, importItem{
+			Path: filepath.Join(baseDir, medalClip.File),
+			Form: NewClipForm{
+				Username:      mapping.user(medalClip.Uploader),
+				Description:   importDescription(medalClip.Title),
+				Game:          mapping.game(medalClip.Game),
+				Tags:          mapping.tags(medalClip.Tags),
+				FeaturedUsers: mapping.users(medalClip.Featured),
+				Visibility:    mapping.DefaultVisibility,
+			},
+			DateUploaded: dateUploaded,
+		})
+	}
+
+	return items, nil
+}
+
+// Descriptions are limited to 120 characters by the clips table
+func importDescription(description string) string {
+	description = strings.TrimSpace(description)
+	if runes := []rune(description); len(runes) > 120 {
+		description = string(runes[:120])
+	}
+
+	return description
+}
+
+// Upload items through the clip pipeline, concurrency at a time, recording each
+// outcome in state as it happens
+func (s *APIServer) importClips(items []importItem, state *importState, concurrency int) {
+	queue := make(chan importItem)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				result := s.importClip(item)
+				if err := state.record(result); err != nil {
+					s.log.Error(fmt.Sprintf("error saving import state: %s", err))
+				}
+				s.log.Info(fmt.Sprintf("%s: %s %s", result.Status, item.Path, result.Reason))
+			}
+		}()
+	}
+
+	for _, item := range items {
+		if state.done(item.Path) {
+			continue
+		}
+		queue <- item
+	}
+	close(queue)
+
+	wg.Wait()
+}
+
+func (s *APIServer) importClip(item importItem) ImportResult {
+	result := ImportResult{Path: item.Path, At: time.Now()}
+
+	if err := s.validateClipForm(&item.Form); err != nil {
+		result.Status = importSkipped
+		result.Reason = err.Error()
+		return result
+	}
+
+	file, err := os.Open(item.Path)
+	if err != nil {
+		result.Status = importFailed
+		result.Reason = err.Error()
+		return result
+	}
+	defer file.Close()
+
+	contentHash, err := hashContent(file)
+	if err != nil {
+		result.Status = importFailed
+		result.Reason = err.Error()
+		return result
+	}
+
+	if existing, err := s.store.GetClipByContentHash(contentHash); err == nil {
+		result.Status = importSkipped
+		result.Reason = fmt.Sprintf("duplicate of clip %s", existing.ID)
+		return result
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		result.Status = importFailed
+		result.Reason = err.Error()
+		return result
+	}
+
+	user, err := s.store.GetUserByUsername(item.Form.Username)
+	if err != nil {
+		result.Status = importSkipped
+		result.Reason = fmt.Sprintf("user %s not found", item.Form.Username)
+		return result
+	}
+
+	if err := s.reserveQuota(user, info.Size()); err != nil {
+		result.Status = importSkipped
+		result.Reason = err.Error()
+		return result
+	}
+
+	result.ObjectKey = uuid.New().String() + strings.ToLower(filepath.Ext(item.Path))
+	result.JobID, err = s.ingestClip(file, result.ObjectKey, contentHash, info.Size(), item.Form, item.DateUploaded)
+	if err != nil {
+		s.releaseQuota(user.Username, info.Size())
+		result.Status = importFailed
+		result.Reason = err.Error()
+		return result
+	}
+
+	result.Status = importImported
+	return result
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned when someone without an account logs in and no invite was given
+var errInviteRequired = errors.New("an invite code is required to sign up")
+
+const (
+	defaultInviteDays = 7
+	maxInviteDays     = 90
+)
+
+// A random code that is easy to read out and type, e.g. "K7QX-3MZD-PW2A"
+func newInviteCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:12]
+	return code[:4] + "-" + code[4:8] + "-" + code[8:], nil
+}
+
+// Invite codes are matched case-insensitively, with or without the dashes
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 12 {
+		return code
+	}
+
+	return code[:4] + "-" + code[4:8] + "-" + code[8:]
+}
+
+// Check an invite can still be redeemed
+func validateInvite(invite Invite) error {
+	if invite.RevokedAt != nil {
+		return errBadRequest("invite code has been revoked")
+	}
+
+	if time.Now().After(invite.ExpiresAt) {
+		return errBadRequest("invite code has expired")
+	}
+
+	if invite.Uses >= invite.MaxUses {
+		return errBadRequest("invite code has already been used")
+	}
+
+	return nil
+}
+
+// Create a user with an invite code, giving them the invite's role if it has one
+func (s *APIServer) registerWithInvite(user User, code string) (User, error) {
+	invite, err := s.store.GetInvite(normalizeInviteCode(code))
+	if err != nil {
+		return user, errBadRequest("invite code is invalid")
+	}
+
+	if err := validateInvite(invite); err != nil {
+		return user, err
+	}
+
+	if invite.Role != "" {
+		user.Role = invite.Role
+		user.RoleSource = roleSourceManual
+	}
+
+	user, err = s.store.CreateUserWithInvite(user, invite.Code)
+	if err != nil {
+		return user, err
+	}
+
+	s.log.Info(fmt.Sprintf("user %s registered with invite %s", user.Username, invite.Code))
+	return user, nil
+}
+
+/*
+ *
+ *
+ * Admin handlers
+ *
+ *
+ */
+
+// List of invites and who redeemed them
+func (s *APIServer) handleAdminInvites(w http.ResponseWriter, r *http.Request) error {
+	invites, err := s.store.GetAllInvites()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	redemptions, err := s.store.GetAllInviteRedemptions()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	// Attach redemptions to their invites
+	for i := range invites {
+		for _, redemption := range redemptions {
+			if redemption.InviteCode == invites[i].Code {
+				invites[i].Redemptions = append(invites[i].Redemptions, redemption)
+			}
+		}
+	}
+
+	t, err := s.parsePage(r, "./templates/admin/invites.html", nil)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	return renderPage(w, t, invites)
+}
+
+// Route for minting an invite code
+func (s *APIServer) handleCreateInvite(w http.ResponseWriter, r *http.Request) error {
+	creator, _ := s.viewer(r)
+
+	role := r.PostFormValue("role")
+	if role != "" && !isValidRole(role) {
+		return errValidation("role", "is invalid")
+	}
+
+	maxUses := 1
+	if v := r.PostFormValue("max_uses"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return errValidation("max_uses", "must be at least 1")
+		}
+		maxUses = n
+	}
+
+	days := defaultInviteDays
+	if v := r.PostFormValue("expires_in_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxInviteDays {
+			return errValidation("expires_in_days", fmt.Sprintf("must be between 1 and %d", maxInviteDays))
+		}
+		days = n
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return fmt.Errorf("error generating invite code: %w", err)
+	}
+
+	invite := Invite{
+		Code:      code,
+		Role:      role,
+		MaxUses:   maxUses,
+		ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour),
+		CreatedBy: creator.ID,
+	}
+
+	if err := s.store.CreateInvite(invite); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, invite)
+}
+
+// Route for revoking an invite code
+func (s *APIServer) handleRevokeInvite(w http.ResponseWriter, r *http.Request) error {
+	invite, err := s.store.GetInvite(normalizeInviteCode(r.PostFormValue("code")))
+	if err != nil {
+		return errNotFound("invite")
+	}
+
+	if err := s.store.RevokeInvite(invite.Code); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "invite revoked")
+}
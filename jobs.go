@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/majesticbeast/lostsons.tv/mux"
+)
+
+// Job types handled by the background workers
+const (
+	jobTypeCreateAsset = "create_asset"
+	jobTypeNotify      = "notify"
+	jobTypeCleanup     = "cleanup"
+	jobTypeReconcile   = "reconcile"
+	jobTypeFingerprint = "fingerprint"
+)
+
+const (
+	defaultJobQueue       = "default"
+	defaultJobMaxAttempts = 8
+	defaultJobWorkers     = 2
+
+	jobPollInterval  = 2 * time.Second
+	jobBaseBackoff   = 30 * time.Second
+	jobMaxBackoff    = time.Hour
+	jobStaleAfter    = 15 * time.Minute
+	jobStaleInterval = time.Minute
+
+	// A running job's lock is renewed this often, so however long it runs it is
+	// only requeued once its worker is gone
+	jobHeartbeatInterval = time.Minute
+)
+
+type jobFunc func(Job) error
+
+// Payload of a create_asset job: a clip in Spaces that still needs a Mux asset and a clips row
+type createAssetJobPayload struct {
+	ObjectKey    string      `json:"object_key"`
+	ContentHash  string      `json:"content_hash"`
+	SizeBytes    int64       `json:"size_bytes"`
+	Form         NewClipForm `json:"form"`
+	DateUploaded time.Time   `json:"date_uploaded"`
+}
+
+// Payload of a cleanup job. Either field may be empty.
+type cleanupJobPayload struct {
+	AssetID   string `json:"asset_id"`
+	ObjectKey string `json:"object_key"`
+}
+
+func (s *APIServer) jobHandlers() map[string]jobFunc {
+	return map[string]jobFunc{
+		jobTypeCreateAsset: s.handleCreateAssetJob,
+		jobTypeNotify:      s.handleNotifyJob,
+		jobTypeCleanup:     s.handleCleanupJob,
+		jobTypeReconcile:   s.handleReconcileJob,
+		jobTypeFingerprint: s.handleFingerprintJob,
+		jobTypeGuildCheck:  s.handleGuildCheckJob,
+	}
+}
+
+// Serialise payload and put a job on the given queue
+func (s *APIServer) enqueueJob(jobType string, queue string, payload interface{}) (string, error) {
+	return s.enqueueJobAfter(jobType, queue, payload, 0)
+}
+
+// Like enqueueJob, but the job won't run until delay has passed
+func (s *APIServer) enqueueJobAfter(jobType string, queue string, payload interface{}, delay time.Duration) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling %s job payload: %w", jobType, err)
+	}
+
+	id, err := s.store.EnqueueJob(Job{
+		Type:    jobType,
+		Queue:   queue,
+		Payload: body,
+		Delay:   delay,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error enqueueing %s job: %w", jobType, err)
+	}
+
+	return id, nil
+}
+
+// Start n workers plus a janitor that requeues jobs abandoned by a crashed worker and
+// restarts the periodic jobs if a run was dead-lettered without queueing the next one
+func (s *APIServer) runJobWorkers(n int) {
+	queues := []string{defaultJobQueue}
+
+	for i := 0; i < n; i++ {
+		go s.jobWorker(queues)
+	}
+
+	go func() {
+		for {
+			count, err := s.store.RequeueStaleJobs(jobStaleAfter)
+			if err != nil {
+				s.log.Warn(err.Error())
+			} else if count > 0 {
+				s.log.Warn(fmt.Sprintf("requeued %d stale jobs", count))
+			}
+
+			dead, err := s.store.DeadLetterStaleJobs(jobStaleAfter)
+			if err != nil {
+				s.log.Warn(err.Error())
+			}
+			for _, job := range dead {
+				s.log.Error(fmt.Sprintf("job %s (%s) dead, its worker stopped on attempt %d", job.ID, job.Type, job.Attempts))
+				s.releaseJobQuota(job)
+			}
+
+			s.scheduleReconcile()
+			s.scheduleGuildCheck()
+
+			time.Sleep(jobStaleInterval)
+		}
+	}()
+
+	s.log.Info(fmt.Sprintf("Started %d job workers on queues %v", n, queues))
+}
+
+func (s *APIServer) jobWorker(queues []string) {
+	for {
+		job, err := s.store.ClaimJob(queues)
+		if err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				s.log.Warn(err.Error())
+			}
+			time.Sleep(jobPollInterval)
+			continue
+		}
+
+		s.runJob(job)
+	}
+}
+
+// Run a claimed job and record the outcome: done, retried with backoff, or dead-lettered
+func (s *APIServer) runJob(job Job) {
+	handler, ok := s.jobHandlers()[job.Type]
+	if !ok {
+		msg := fmt.Sprintf("unknown job type %q", job.Type)
+		if err := s.store.DeadLetterJob(job.ID, msg); err != nil {
+			s.log.Error(err.Error())
+		}
+		return
+	}
+
+	stop := make(chan struct{})
+	go s.heartbeatJob(job, stop)
+	err := callJobFunc(handler, job)
+	close(stop)
+
+	if err == nil {
+		if err := s.store.CompleteJob(job.ID); err != nil {
+			s.log.Error(err.Error())
+		}
+		return
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		s.log.Error(fmt.Sprintf("job %s (%s) dead after %d attempts: %s", job.ID, job.Type, job.Attempts, err))
+		if err := s.store.DeadLetterJob(job.ID, err.Error()); err != nil {
+			s.log.Error(err.Error())
+		}
+		s.releaseJobQuota(job)
+		return
+	}
+
+	delay := jobBackoff(job.Attempts)
+	s.log.Warn(fmt.Sprintf("job %s (%s) attempt %d failed, retrying in %s: %s", job.ID, job.Type, job.Attempts, delay, err))
+	if err := s.store.RetryJob(job.ID, delay, err.Error()); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+// An upload that will never become a clip gives back the storage reserved for it
+func (s *APIServer) releaseJobQuota(job Job) {
+	if job.Type != jobTypeCreateAsset {
+		return
+	}
+
+	payload := createAssetJobPayload{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		s.log.Error(fmt.Sprintf("error unmarshalling %s payload: %s", job.Type, err))
+		return
+	}
+
+	s.releaseQuota(payload.Form.Username, payload.SizeBytes)
+}
+
+// Keep renewing a job's lock until stop is closed
+func (s *APIServer) heartbeatJob(job Job, stop <-chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.store.TouchJob(job.ID); err != nil {
+				s.log.Warn(err.Error())
+			}
+		}
+	}
+}
+
+// Call a job handler, turning a panic into an ordinary failure so the worker survives
+func callJobFunc(f jobFunc, job Job) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("panic running job: %v", rec)
+		}
+	}()
+
+	return f(job)
+}
+
+// Exponential backoff: 30s, 1m, 2m, 4m ... capped at an hour
+func jobBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= jobMaxBackoff {
+			return jobMaxBackoff
+		}
+	}
+
+	return backoff
+}
+
+func jobWorkerCount() int {
+	n, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || n < 1 {
+		return defaultJobWorkers
+	}
+
+	return n
+}
+
+/*
+ *
+ *
+ * Job handlers
+ *
+ *
+ */
+
+// Upload a clip file to Spaces and queue asset creation, returning the create_asset job id
+func (s *APIServer) ingestClip(file io.ReadSeeker, objectKey string, contentHash string, sizeBytes int64, form NewClipForm, dateUploaded time.Time) (string, error) {
+	sess, err := NewDigitalOceanSession()
+	if err != nil {
+		return "", errUpstream("spaces", err)
+	}
+
+	svc, err := NewS3Client(sess)
+	if err != nil {
+		return "", errUpstream("spaces", err)
+	}
+
+	if err := UploadFileToSpaces(svc, file, objectKey); err != nil {
+		return "", errUpstream("spaces", err)
+	}
+
+	jobID, err := s.enqueueJob(jobTypeCreateAsset, defaultJobQueue, createAssetJobPayload{
+		ObjectKey:    objectKey,
+		ContentHash:  contentHash,
+		SizeBytes:    sizeBytes,
+		Form:         form,
+		DateUploaded: dateUploaded,
+	})
+	if err != nil {
+		if cleanupErr := DeleteFileFromSpaces(svc, objectKey); cleanupErr != nil {
+			err = fmt.Errorf("error deleting uploaded clip: %w // %w", cleanupErr, err)
+		}
+		return "", err
+	}
+
+	return jobID, nil
+}
+
+// Create the Mux asset for an uploaded object and insert the clip
+func (s *APIServer) handleCreateAssetJob(job Job) error {
+	payload := createAssetJobPayload{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("error unmarshalling create_asset payload: %w", err)
+	}
+
+	// An identical file may have been accepted in parallel; keep the first one
+	if payload.ContentHash != "" {
+		if existing, err := s.store.GetClipByContentHash(payload.ContentHash); err == nil {
+			// A rerun of a job that already inserted its clip has nothing left to do
+			if existing.ObjectKey == payload.ObjectKey {
+				return nil
+			}
+
+			s.log.Warn(fmt.Sprintf("dropping upload %s, duplicate of clip %s", payload.ObjectKey, existing.ID))
+			s.releaseQuota(payload.Form.Username, payload.SizeBytes)
+			_, err := s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{ObjectKey: payload.ObjectKey})
+			return err
+		}
+	}
+
+	sess, err := NewDigitalOceanSession()
+	if err != nil {
+		return err
+	}
+
+	svc, err := NewS3Client(sess)
+	if err != nil {
+		return err
+	}
+
+	inputURL, err := PresignSpacesURL(svc, payload.ObjectKey)
+	if err != nil {
+		return err
+	}
+
+	client := mux.NewMuxClient()
+	asset, err := mux.CreateAsset(client, inputURL, payload.ObjectKey, mux.AssetOptions{
+		Signed:     isSignedVisibility(payload.Form.Visibility),
+		MP4Support: payload.Form.Downloadable,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating mux asset: %w", err)
+	}
+
+	clip := Clip{
+		PlaybackID:    asset.Data.PlaybackIds[0].Id,
+		AssetID:       asset.Data.Id,
+		ObjectKey:     payload.ObjectKey,
+		ContentHash:   payload.ContentHash,
+		SizeBytes:     payload.SizeBytes,
+		Description:   payload.Form.Description,
+		Game:          payload.Form.Game,
+		Username:      payload.Form.Username,
+		Tags:          payload.Form.Tags,
+		FeaturedUsers: payload.Form.FeaturedUsers,
+		Visibility:    payload.Form.Visibility,
+		Downloadable:  payload.Form.Downloadable,
+		DateUploaded:  payload.DateUploaded,
+	}
+
+	if err := s.store.CreateClip(clip); err != nil {
+		err = fmt.Errorf("error creating clip: %w", err)
+
+		// The retry creates a fresh asset, so don't leave this one orphaned in Mux
+		if _, cleanupErr := s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{AssetID: clip.AssetID}); cleanupErr != nil {
+			err = fmt.Errorf("error queueing cleanup of failed mux asset: %w // %w", cleanupErr, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Announce a ready Mux asset on Discord. Only public clips are announced, and an asset
+// without a clip row (deleted, or never inserted) is skipped rather than retried.
+func (s *APIServer) handleNotifyJob(job Job) error {
+	payload := mux.WebhookResponse{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("error unmarshalling notify payload: %w", err)
+	}
+
+	clip, err := s.store.GetClipByAssetID(payload.Data.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		s.log.Info(fmt.Sprintf("not announcing asset %s, no clip has it", payload.Data.ID))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if clip.Visibility != VisibilityPublic {
+		return nil
+	}
+
+	return PostToDiscordWebhook(payload)
+}
+
+// Remove a Mux asset and/or bucket object that no clip refers to any more
+func (s *APIServer) handleCleanupJob(job Job) error {
+	payload := cleanupJobPayload{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("error unmarshalling cleanup payload: %w", err)
+	}
+
+	if payload.AssetID != "" {
+		client := mux.NewMuxClient()
+		if err := mux.DeleteAsset(client, payload.AssetID); err != nil && !mux.IsNotFound(err) {
+			return fmt.Errorf("error deleting mux asset: %w", err)
+		}
+	}
+
+	if payload.ObjectKey != "" {
+		sess, err := NewDigitalOceanSession()
+		if err != nil {
+			return err
+		}
+
+		svc, err := NewS3Client(sess)
+		if err != nil {
+			return err
+		}
+
+		if err := DeleteFileFromSpaces(svc, payload.ObjectKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// JWTs are signed with a ring of keys. Without JWT_KEYS_DIR the ring is just JWT_SECRET
+// as an HS256 key. With it, keys.json in that directory lists EdDSA or RS256 keys kept
+// in PEM files beside it: the active one signs, and the rest verify until they retire.
+// Rotation is two steps so every instance knows a key before anything is signed with it:
+// `keys generate` adds a pending key, and `keys rotate` activates it and retires the old
+// one after an overlap window.
+
+const keyManifestFile = "keys.json"
+
+// ID of the JWT_SECRET key. Tokens from before key IDs were used have no kid and are checked with it.
+const legacyKeyID = "hs256"
+
+// How often the server re-reads JWT_KEYS_DIR to pick up generated and rotated keys
+const keyRingReloadInterval = time.Minute
+
+// What a JWT is for, in its typ claim. Every token the ring signs has one, and a token
+// is only accepted where its typ is expected, so an OAuth state cookie can't be used
+// as a session or the other way round.
+const (
+	jwtTypeSession    = "session"
+	jwtTypeOAuthState = "oauth_state"
+)
+
+const (
+	keyStatePending  = "pending"
+	keyStateActive   = "active"
+	keyStateRetiring = "retiring"
+)
+
+// keys.json
+type keyManifest struct {
+	Keys []manifestKey `json:"keys"`
+}
+
+type manifestKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"alg"`
+	// PEM file in JWT_KEYS_DIR; empty for the HS256 JWT_SECRET key
+	File      string     `json:"file,omitempty"`
+	State     string     `json:"state"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetireAt  *time.Time `json:"retire_at,omitempty"`
+}
+
+type jwtKey struct {
+	ID       string
+	Method   jwt.SigningMethod
+	Signing  interface{}
+	Verify   interface{}
+	RetireAt *time.Time
+}
+
+type keyRing struct {
+	active *jwtKey
+	keys   map[string]*jwtKey
+}
+
+var signingKeys atomic.Pointer[keyRing]
+
+// The key ring loaded by Run
+func jwtKeys() *keyRing {
+	return signingKeys.Load()
+}
+
+func keysDir() string {
+	return os.Getenv("JWT_KEYS_DIR")
+}
+
+// Load the key ring from JWT_KEYS_DIR, or from JWT_SECRET if that isn't set
+func loadKeyRing() (*keyRing, error) {
+	if keysDir() == "" {
+		key, err := legacyKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return &keyRing{active: key, keys: map[string]*jwtKey{key.ID: key}}, nil
+	}
+
+	manifest, err := readKeyManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	ring := &keyRing{keys: map[string]*jwtKey{}}
+	for _, entry := range manifest.Keys {
+		if entry.RetireAt != nil && time.Now().After(*entry.RetireAt) {
+			continue
+		}
+
+		key, err := loadManifestKey(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		ring.keys[key.ID] = key
+		if entry.State == keyStateActive {
+			ring.active = key
+		}
+	}
+
+	if ring.active == nil {
+		return nil, fmt.Errorf("no active key in %s, run `keys rotate`", filepath.Join(keysDir(), keyManifestFile))
+	}
+
+	return ring, nil
+}
+
+func legacyKey() (*jwtKey, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("JWT_SECRET is not set")
+	}
+
+	return &jwtKey{
+		ID:      legacyKeyID,
+		Method:  jwt.SigningMethodHS256,
+		Signing: []byte(secret),
+		Verify:  []byte(secret),
+	}, nil
+}
+
+func loadManifestKey(entry manifestKey) (*jwtKey, error) {
+	if entry.Algorithm == jwt.SigningMethodHS256.Alg() {
+		key, err := legacyKey()
+		if err != nil {
+			return nil, err
+		}
+		key.RetireAt = entry.RetireAt
+		return key, nil
+	}
+
+	pemKey, err := os.ReadFile(filepath.Join(keysDir(), entry.File))
+	if err != nil {
+		return nil, fmt.Errorf("error reading key %s: %w", entry.ID, err)
+	}
+
+	key := &jwtKey{ID: entry.ID, RetireAt: entry.RetireAt}
+	switch entry.Algorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		private, err := jwt.ParseEdPrivateKeyFromPEM(pemKey)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %w", entry.ID, err)
+		}
+		edKey, ok := private.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %s is not an ed25519 key", entry.ID)
+		}
+		key.Method = jwt.SigningMethodEdDSA
+		key.Signing = edKey
+		key.Verify = edKey.Public()
+	case jwt.SigningMethodRS256.Alg():
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(pemKey)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %w", entry.ID, err)
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.Signing = private
+		key.Verify = &private.PublicKey
+	default:
+		return nil, fmt.Errorf("key %s has unsupported algorithm %q", entry.ID, entry.Algorithm)
+	}
+
+	return key, nil
+}
+
+// Sign claims with the active key, naming it in the kid header
+func (k *keyRing) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.ID
+
+	value, err := token.SignedString(k.active.Signing)
+	if err != nil {
+		return "", fmt.Errorf("error signing JWT: %w", err)
+	}
+
+	return value, nil
+}
+
+// Verify a JWT with the key its kid names and return its claims. Expiry and the typ
+// claim are checked too.
+func (k *keyRing) parse(value string, typ string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(value, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = legacyKeyID
+		}
+
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		// The key decides the algorithm, never the token
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		if key.RetireAt != nil && time.Now().After(*key.RetireAt) {
+			return nil, fmt.Errorf("signing key %q has been retired", kid)
+		}
+
+		return key.Verify, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JWT: %w", err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid JWT")
+	}
+
+	if claims["typ"] != typ {
+		return nil, fmt.Errorf("JWT is not a %s token", typ)
+	}
+
+	return claims, nil
+}
+
+// Re-read JWT_KEYS_DIR now and then, keeping the current ring if it can't be loaded
+func (s *APIServer) reloadKeyRing() {
+	if keysDir() == "" {
+		return
+	}
+
+	for range time.Tick(keyRingReloadInterval) {
+		ring, err := loadKeyRing()
+		if err != nil {
+			s.log.Error(fmt.Sprintf("error reloading jwt keys: %s", err))
+			continue
+		}
+
+		signingKeys.Store(ring)
+	}
+}
+
+/*
+ *
+ *
+ * JWKS
+ *
+ *
+ */
+
+// A public key in JWK form
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// Public keys of the ring, including pending and retiring ones. HS256 keys are secret and left out.
+func (k *keyRing) jwks() []jsonWebKey {
+	jwks := []jsonWebKey{}
+	for _, key := range k.keys {
+		jwk := jsonWebKey{KeyID: key.ID, Algorithm: key.Method.Alg(), Use: "sig"}
+
+		switch public := key.Verify.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+
+		jwks = append(jwks, jwk)
+	}
+
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].KeyID < jwks[j].KeyID })
+	return jwks
+}
+
+// Route publishing the public keys JWTs are signed with, so other services such as
+// the Discord bot can verify them. A verifier must also check the typ claim: only
+// "session" tokens identify a user.
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return responseWithJSON(w, http.StatusOK, map[string][]jsonWebKey{"keys": jwtKeys().jwks()})
+}
+
+/*
+ *
+ *
+ * Generation and rotation
+ *
+ *
+ */
+
+func readKeyManifest() (keyManifest, error) {
+	manifest := keyManifest{}
+
+	data, err := os.ReadFile(filepath.Join(keysDir(), keyManifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("error reading key manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("error parsing key manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// Write the manifest through a temporary file so a running server never reads half of it
+func writeKeyManifest(manifest keyManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling key manifest: %w", err)
+	}
+
+	path := filepath.Join(keysDir(), keyManifestFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("error writing key manifest: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing key manifest: %w", err)
+	}
+
+	return nil
+}
+
+// Generate a key and add it to the manifest as pending
+func generateSigningKey(algorithm string) (manifestKey, error) {
+	if keysDir() == "" {
+		return manifestKey{}, fmt.Errorf("JWT_KEYS_DIR is not set")
+	}
+
+	var der []byte
+	var blockType string
+	switch algorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return manifestKey{}, fmt.Errorf("error generating key: %w", err)
+		}
+		der, err = x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return manifestKey{}, fmt.Errorf("error marshalling key: %w", err)
+		}
+		blockType = "PRIVATE KEY"
+	case jwt.SigningMethodRS256.Alg():
+		private, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return manifestKey{}, fmt.Errorf("error generating key: %w", err)
+		}
+		der = x509.MarshalPKCS1PrivateKey(private)
+		blockType = "RSA PRIVATE KEY"
+	default:
+		return manifestKey{}, fmt.Errorf("algorithm must be EdDSA or RS256")
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return manifestKey{}, err
+	}
+
+	now := time.Now().UTC()
+	entry := manifestKey{
+		ID:        now.Format("20060102") + "-" + hex.EncodeToString(suffix),
+		Algorithm: algorithm,
+		State:     keyStatePending,
+		CreatedAt: now,
+	}
+	entry.File = entry.ID + ".pem"
+
+	if err := os.MkdirAll(keysDir(), 0700); err != nil {
+		return entry, fmt.Errorf("error creating keys directory: %w", err)
+	}
+
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(filepath.Join(keysDir(), entry.File), pemKey, 0600); err != nil {
+		return entry, fmt.Errorf("error writing key: %w", err)
+	}
+
+	manifest, err := readKeyManifest()
+	if err != nil {
+		return entry, err
+	}
+
+	manifest.Keys = append(manifest.Keys, entry)
+	return entry, writeKeyManifest(manifest)
+}
+
+// Activate the newest pending key and retire the active one once overlap has passed,
+// so tokens it signed stay valid until then. Keys already past retirement are removed.
+// The first rotation retires JWT_SECRET the same way.
+func rotateSigningKeys(overlap time.Duration) (manifestKey, error) {
+	manifest, err := readKeyManifest()
+	if err != nil {
+		return manifestKey{}, err
+	}
+
+	next := -1
+	for i, entry := range manifest.Keys {
+		if entry.State == keyStatePending && (next == -1 || entry.CreatedAt.After(manifest.Keys[next].CreatedAt)) {
+			next = i
+		}
+	}
+
+	if next == -1 {
+		return manifestKey{}, fmt.Errorf("no pending key, run `keys generate` and give every instance time to load it first")
+	}
+
+	retireAt := time.Now().UTC().Add(overlap)
+	hasActive := false
+	for i := range manifest.Keys {
+		if manifest.Keys[i].State == keyStateActive {
+			hasActive = true
+			manifest.Keys[i].State = keyStateRetiring
+			manifest.Keys[i].RetireAt = &retireAt
+		}
+	}
+
+	if !hasActive && os.Getenv("JWT_SECRET") != "" {
+		manifest.Keys = append(manifest.Keys, manifestKey{
+			ID:        legacyKeyID,
+			Algorithm: jwt.SigningMethodHS256.Alg(),
+			State:     keyStateRetiring,
+			CreatedAt: time.Now().UTC(),
+			RetireAt:  &retireAt,
+		})
+	}
+
+	manifest.Keys[next].State = keyStateActive
+	activated := manifest.Keys[next]
+
+	kept := []manifestKey{}
+	for _, entry := range manifest.Keys {
+		if entry.RetireAt != nil && time.Now().After(*entry.RetireAt) {
+			if entry.File != "" {
+				os.Remove(filepath.Join(keysDir(), entry.File))
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	manifest.Keys = kept
+
+	return activated, writeKeyManifest(manifest)
+}
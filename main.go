@@ -14,6 +14,15 @@ func main() {
 	// Load environment variables
 	godotenv.Load() // not likely needed with app platform env vars
 
+	// The openapi command only looks at the router, so CI can run it without a database
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		if err := NewAPIServer(nil, log).runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize the database connection
 	dbConnStr := os.Getenv("DBCONNSTR")
 	store, err := NewPostgresStore(dbConnStr)
@@ -26,7 +35,17 @@ func main() {
 		log.Error(err.Error())
 	}
 
-	// Initialize and run the API server
+	// Initialize the API server
 	server := NewAPIServer(store, log)
+
+	// Run a one-off command if one was given, otherwise serve
+	if len(os.Args) > 1 {
+		if err := server.runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	server.Run()
 }
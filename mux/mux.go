@@ -3,11 +3,15 @@ package mux
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/joho/godotenv"
@@ -29,15 +33,37 @@ func NewMuxClient() *muxgo.APIClient {
 	return client
 }
 
-// Create a Mux asset
-func CreateAsset(client *muxgo.APIClient, filename string) (muxgo.AssetResponse, error) {
+// Options for a new asset
+type AssetOptions struct {
+	// Require a signed token to play the asset
+	Signed bool
+	// Generate static MP4 renditions for downloading
+	MP4Support bool
+}
+
+// Create a Mux asset from a file Mux can fetch at inputURL, e.g. a presigned Spaces URL.
+// objectKey is kept as the asset's passthrough.
+func CreateAsset(client *muxgo.APIClient, inputURL string, objectKey string, opts AssetOptions) (muxgo.AssetResponse, error) {
+	policy := muxgo.PUBLIC
+	if opts.Signed {
+		policy = muxgo.SIGNED
+	}
+
+	mp4Support := "none"
+	if opts.MP4Support {
+		mp4Support = "standard"
+	}
+
 	asset, err := client.AssetsApi.CreateAsset(muxgo.CreateAssetRequest{
 		Input: []muxgo.InputSettings{
 			{
-				Url: "https://lostsonstv.sfo3.digitaloceanspaces.com/" + filename,
+				Url: inputURL,
 			},
 		},
-		PlaybackPolicy: []muxgo.PlaybackPolicy{"PUBLIC"},
+		PlaybackPolicy: []muxgo.PlaybackPolicy{policy},
+		Mp4Support:     mp4Support,
+		// Lets the reconciler tie an asset back to its bucket object
+		Passthrough: objectKey,
 	})
 	if err != nil {
 		return asset, err
@@ -46,6 +72,39 @@ func CreateAsset(client *muxgo.APIClient, filename string) (muxgo.AssetResponse,
 	return asset, nil
 }
 
+// Get a Mux asset
+func GetAsset(client *muxgo.APIClient, assetID string) (muxgo.AssetResponse, error) {
+	asset, err := client.AssetsApi.GetAsset(assetID)
+	if err != nil {
+		return asset, err
+	}
+
+	return asset, nil
+}
+
+// URL of a thumbnail taken at the given second, signed if the playback ID requires it
+func ThumbnailURL(playbackID string, seconds float64, width int, signed bool) (string, error) {
+	params := map[string]string{
+		"time":  strconv.FormatFloat(seconds, 'f', 2, 64),
+		"width": strconv.Itoa(width),
+	}
+
+	if signed {
+		token, err := SignPlaybackToken(playbackID, AudienceThumbnail, 5*time.Minute, params)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("https://image.mux.com/%s/thumbnail.jpg?token=%s", playbackID, token), nil
+	}
+
+	query := url.Values{}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+
+	return fmt.Sprintf("https://image.mux.com/%s/thumbnail.jpg?%s", playbackID, query.Encode()), nil
+}
+
 // Delete a Mux asset
 func DeleteAsset(client *muxgo.APIClient, assetID string) error {
 	err := client.AssetsApi.DeleteAsset(assetID)
@@ -56,6 +115,73 @@ func DeleteAsset(client *muxgo.APIClient, assetID string) error {
 	return nil
 }
 
+// Attach a WebVTT or SRT file Mux can fetch at inputURL to an asset as a subtitles
+// track, returning the track id
+func CreateTextTrack(client *muxgo.APIClient, assetID string, inputURL string, languageCode string, name string, closedCaptions bool) (string, error) {
+	track, err := client.AssetsApi.CreateAssetTrack(assetID, muxgo.CreateTrackRequest{
+		Url:            inputURL,
+		Type:           "text",
+		TextType:       "subtitles",
+		LanguageCode:   languageCode,
+		Name:           name,
+		ClosedCaptions: closedCaptions,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return track.Data.Id, nil
+}
+
+// Remove a track from an asset
+func DeleteTrack(client *muxgo.APIClient, assetID string, trackID string) error {
+	err := client.AssetsApi.DeleteAssetTrack(assetID, trackID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Pick the best MP4 rendition from a static_renditions.ready webhook, or "" if there is none
+func BestMP4Rendition(webhook WebhookResponse) string {
+	best := ""
+	for _, name := range []string{"low.mp4", "medium.mp4", "high.mp4"} {
+		for _, file := range webhook.Data.StaticRenditions.Files {
+			if file.Name == name {
+				best = name
+			}
+		}
+	}
+
+	return best
+}
+
+// List every asset in the environment, following pagination
+func ListAllAssets(client *muxgo.APIClient) ([]muxgo.Asset, error) {
+	const limit = 100
+	assets := []muxgo.Asset{}
+
+	for page := int32(1); ; page++ {
+		resp, err := client.AssetsApi.ListAssets(muxgo.WithParams(&muxgo.ListAssetsParams{Limit: limit, Page: page}))
+		if err != nil {
+			return nil, err
+		}
+
+		assets = append(assets, resp.Data...)
+
+		if len(resp.Data) < limit {
+			return assets, nil
+		}
+	}
+}
+
+// Report whether a Mux API error is a 404, e.g. deleting an asset that is already gone
+func IsNotFound(err error) bool {
+	var notFound muxgo.NotFoundError
+	return errors.As(err, &notFound)
+}
+
 func ReceiveVideoStatus(w http.ResponseWriter, r *http.Request) {
 
 	// Get the hook data
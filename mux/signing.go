@@ -0,0 +1,60 @@
+package mux
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Token audiences understood by Mux
+const (
+	AudienceVideo      = "v"
+	AudienceThumbnail  = "t"
+	AudienceStoryboard = "s"
+	AudienceGif        = "g"
+)
+
+// Sign a token granting access to a signed playback ID for ttl. The signing key is
+// the one created in the Mux dashboard: MUX_SIGNING_KEY_ID and the base64 encoded
+// private key as MUX_SIGNING_KEY_PRIVATE. Query parameters for thumbnails (time,
+// width, ...) must be passed in params, since Mux reads them from the token.
+func SignPlaybackToken(playbackID string, audience string, ttl time.Duration, params map[string]string) (string, error) {
+	keyID := os.Getenv("MUX_SIGNING_KEY_ID")
+	encodedKey := os.Getenv("MUX_SIGNING_KEY_PRIVATE")
+	if keyID == "" || encodedKey == "" {
+		return "", errors.New("mux signing key is not configured")
+	}
+
+	pemKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return "", fmt.Errorf("error decoding mux signing key: %w", err)
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(pemKey)
+	if err != nil {
+		return "", fmt.Errorf("error parsing mux signing key: %w", err)
+	}
+
+	claims := jwt.MapClaims{
+		"sub": playbackID,
+		"aud": audience,
+		"exp": time.Now().Add(ttl).Unix(),
+	}
+	for name, value := range params {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("error signing playback token: %w", err)
+	}
+
+	return signed, nil
+}
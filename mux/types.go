@@ -99,6 +99,17 @@ type WebhookResponse struct {
 		ID                string `json:"id"`
 		EncodingTier      string `json:"encoding_tier"`
 		CreatedAt         int    `json:"created_at"`
+		StaticRenditions  struct {
+			Status string `json:"status"`
+			Files  []struct {
+				Name     string `json:"name"`
+				Ext      string `json:"ext"`
+				Height   int    `json:"height"`
+				Width    int    `json:"width"`
+				Bitrate  int    `json:"bitrate"`
+				Filesize string `json:"filesize"`
+			} `json:"files"`
+		} `json:"static_renditions"`
 	} `json:"data"`
 	CreatedAt      time.Time `json:"created_at"`
 	Attempts       []any     `json:"attempts"`
@@ -0,0 +1,915 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How a route is authenticated
+const (
+	// No authentication
+	authNone = ""
+	// authenticate runs, so a token or session is used if sent, but none is needed
+	authOptional = "optional"
+	// A session or API token is needed
+	authRequired = "required"
+	// A session is needed; API tokens are refused
+	authSession = "session"
+)
+
+// What a successful response is, if not JSON
+const (
+	responseHTML     = "html"
+	responseRedirect = "redirect"
+	responseText     = "text"
+)
+
+// A path, query or form parameter
+type apiParam struct {
+	Name        string
+	In          string // path, query or form
+	Type        string // string (the default), integer, number, boolean, array or file
+	Required    bool
+	Enum        []string
+	Description string
+}
+
+// A route, as documented in /api/openapi.json and checked by `lostsonstv openapi check`
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+
+	Auth       string
+	Permission string
+
+	Params    []apiParam
+	Multipart bool
+
+	// The response's data, e.g. []Clip{}. Its schema is generated from the Go type.
+	// A jsonSchema is used as is; nil means a message like "clip deleted".
+	Response     interface{}
+	ResponseType string
+	Status       int
+	Errors       []int
+
+	// Also served under /api/v1, where responses are wrapped in an envelope
+	V1 bool
+}
+
+type jsonSchema map[string]interface{}
+
+// Every route the server has. routes() and this list are compared by `openapi check`.
+var apiOperations = []apiOperation{
+	// Meta
+	{Method: "GET", Path: "/", Tag: "meta", Summary: "Home page", ResponseType: responseHTML},
+	{Method: "GET", Path: "/healthDB", Tag: "meta", Summary: "Check the database is reachable", Response: map[string]string{}, Errors: []int{503}},
+	{Method: "GET", Path: "/healthHTTP", Tag: "meta", Summary: "Check the server is up", Response: map[string]string{}},
+	{Method: "GET", Path: "/.well-known/jwks.json", Tag: "meta", Summary: "Public keys session JWTs are signed with", Response: jsonSchema{
+		"type":        "object",
+		"description": `Verify a JWT with the key its kid names, then check its typ claim: only "session" tokens identify a user. "oauth_state" tokens are login cookies and must be rejected.`,
+		"properties":  map[string]interface{}{"keys": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}},
+	}},
+	{Method: "GET", Path: "/api/openapi.json", Tag: "meta", Summary: "This document", Response: jsonSchema{"type": "object"}},
+	{Method: "GET", Path: "/api/docs", Tag: "meta", Summary: "Interactive API docs", ResponseType: responseHTML},
+	{Method: "POST", Path: "/mux-webhook", Tag: "meta", Summary: "Mux webhook, signed with Mux-Signature", Errors: []int{400, 401, 429, 500}, Params: []apiParam{
+		{Name: "Mux-Signature", In: "header", Required: true, Description: "t=<timestamp>,v1=<hmac>"},
+	}},
+
+	// GraphQL
+	{Method: "GET", Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query; mutations need POST", Auth: authOptional, Response: graphResponseSchema, Params: []apiParam{
+		{Name: "query", In: "query", Required: true},
+		{Name: "operationName", In: "query"},
+		{Name: "variables", In: "query", Description: "A JSON object"},
+	}},
+	{Method: "POST", Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query or mutation sent as JSON: {\"query\", \"operationName\", \"variables\"}", Auth: authOptional, Response: graphResponseSchema},
+	{Method: "GET", Path: "/graphql/schema", Tag: "graphql", Summary: "The GraphQL schema, in the schema language", ResponseType: responseText},
+
+	// Clips
+	{Method: "GET", Path: "/clips", Tag: "clips", Summary: "List the clips the requester may see", Auth: authOptional, Response: []Clip{}, V1: true},
+	{Method: "GET", Path: "/clips/{id}", Tag: "clips", Summary: "Get a clip and its captions", Auth: authOptional, Response: Clip{}, Errors: []int{404}, V1: true, Params: []apiParam{
+		{Name: "id", In: "path", Required: true},
+	}},
+	{Method: "GET", Path: "/clips/{id}/playback", Tag: "clips", Summary: "Playback URLs and tokens for a clip", Auth: authOptional, Response: ClipPlayback{}, Errors: []int{404}, V1: true, Params: []apiParam{
+		{Name: "id", In: "path", Required: true},
+	}},
+	{Method: "GET", Path: "/clips/{id}/download", Tag: "clips", Summary: "Redirect to a clip's MP4 download", Auth: authOptional, ResponseType: responseRedirect, Errors: []int{404, 409}, V1: true, Params: []apiParam{
+		{Name: "id", In: "path", Required: true},
+	}},
+	{Method: "GET", Path: "/clips/{id}/captions", Tag: "clips", Summary: "List a clip's captions", Auth: authOptional, Response: []Caption{}, Errors: []int{404}, V1: true, Params: []apiParam{
+		{Name: "id", In: "path", Required: true},
+	}},
+	{Method: "GET", Path: "/clips/duplicates", Tag: "clips", Summary: "List pending duplicates of the requester's clips", Auth: authOptional, Response: []ClipDuplicate{}, Errors: []int{401}, V1: true},
+	{Method: "POST", Path: "/clips/new", Tag: "clips", Summary: "Upload a clip, queued for processing", Auth: authRequired, Permission: PermClipsCreate, Multipart: true, Status: http.StatusAccepted, V1: true,
+		Response: map[string]string{}, Errors: []int{400, 401, 403, 404, 409, 413, 422, 429, 502}, Params: []apiParam{
+			{Name: "clip", In: "form", Type: "file", Required: true},
+			{Name: "game", In: "form", Required: true},
+			{Name: "description", In: "form", Description: "At most 120 characters"},
+			{Name: "username", In: "form", Description: "Uploader, if not the requester. Needs " + PermClipsCreateOthers},
+			{Name: "tags", In: "form"},
+			{Name: "featured_users", In: "form"},
+			{Name: "visibility", In: "form", Enum: []string{VisibilityPublic, VisibilityUnlisted, VisibilityMembers, VisibilityPrivate}},
+			{Name: "downloadable", In: "form", Type: "boolean"},
+		}},
+	{Method: "POST", Path: "/clips/edit", Tag: "clips", Summary: "Change a clip's description or game", Auth: authRequired, Permission: PermClipsManageOwn + " or " + PermClipsEdit, Errors: []int{401, 403, 404, 422}, V1: true, Params: []apiParam{
+		{Name: "id", In: "form", Required: true},
+		{Name: "description", In: "form", Description: "At most 120 characters"},
+		{Name: "game", In: "form"},
+	}},
+	{Method: "POST", Path: "/clips/delete", Tag: "clips", Summary: "Delete a clip", Auth: authRequired, Permission: PermClipsManageOwn + " or " + PermClipsDelete, Errors: []int{401, 403, 404}, V1: true, Params: []apiParam{
+		{Name: "id", In: "form", Required: true},
+	}},
+	{Method: "POST", Path: "/clips/captions/new", Tag: "clips", Summary: "Attach a WebVTT or SRT file to a clip", Auth: authRequired, Permission: PermCaptionsCreate, Multipart: true, Response: Caption{}, Errors: []int{400, 401, 403, 404, 422, 502}, V1: true, Params: []apiParam{
+		{Name: "captions", In: "form", Type: "file", Required: true},
+		{Name: "clip_id", In: "form", Required: true},
+		{Name: "language", In: "form", Required: true, Description: "BCP 47 language code, e.g. en or pt-BR"},
+		{Name: "name", In: "form", Description: "At most 60 characters"},
+		{Name: "closed_captions", In: "form", Type: "boolean"},
+	}},
+	{Method: "POST", Path: "/clips/captions/delete", Tag: "clips", Summary: "Remove a caption", Auth: authRequired, Permission: PermClipsManageOwn + " or " + PermCaptionsDelete, Errors: []int{401, 403, 404, 502}, V1: true, Params: []apiParam{
+		{Name: "id", In: "form", Required: true},
+	}},
+	{Method: "POST", Path: "/clips/duplicates/confirm", Tag: "clips", Summary: "Keep or delete a clip flagged as a duplicate", Auth: authRequired, Permission: PermClipsManageOwn + " or " + PermDuplicatesResolve, Errors: []int{401, 403, 404, 422}, V1: true, Params: []apiParam{
+		{Name: "id", In: "form", Required: true},
+		{Name: "action", In: "form", Required: true, Enum: []string{"keep", "delete"}},
+	}},
+
+	// Users and games
+	{Method: "GET", Path: "/users/{username}", Tag: "users", Summary: "A user's profile, with the clips they uploaded and are featured in", Auth: authOptional, Response: UserProfile{}, Errors: []int{404}, V1: true, Params: []apiParam{
+		{Name: "username", In: "path", Required: true},
+	}},
+	{Method: "GET", Path: "/games", Tag: "games", Summary: "List games with their clip counts", Auth: authOptional, Response: []GameSummary{}, V1: true},
+	{Method: "GET", Path: "/games/{id}", Tag: "games", Summary: "A game with its clip count and newest clips", Auth: authOptional, Response: GameDetail{}, Errors: []int{404}, V1: true, Params: []apiParam{
+		{Name: "id", In: "path", Required: true},
+	}},
+	{Method: "POST", Path: "/users/new", Tag: "users", Summary: "Register a user. Needs an invite unless the requester manages users.", Auth: authOptional, Errors: []int{400, 403, 409, 422, 429}, V1: true, Params: []apiParam{
+		{Name: "username", In: "form", Required: true, Description: "At most 35 characters"},
+		{Name: "email", In: "form", Required: true},
+		{Name: "role", In: "form", Enum: roleRanks, Description: "Ignored unless the requester has " + PermUsersManage},
+		{Name: "invite_code", In: "form"},
+	}},
+	{Method: "POST", Path: "/users/delete", Tag: "users", Summary: "Delete a user", Auth: authRequired, Permission: PermUsersManage, Errors: []int{401, 403, 404}, V1: true, Params: []apiParam{
+		{Name: "username", In: "form", Required: true},
+	}},
+	{Method: "POST", Path: "/games/new", Tag: "games", Summary: "Add a game", Auth: authRequired, Permission: PermGamesCreate, Errors: []int{401, 403, 409, 422}, V1: true, Params: []apiParam{
+		{Name: "name", In: "form", Required: true},
+	}},
+
+	// Auth
+	{Method: "GET", Path: "/auth/{provider}", Tag: "auth", Summary: "Start logging in, or linking an account with link=1", Auth: authOptional, ResponseType: responseRedirect, Errors: []int{404, 429}, V1: true, Params: []apiParam{
+		{Name: "provider", In: "path", Required: true, Enum: []string{providerDiscord, providerTwitch, providerSteam}},
+		{Name: "link", In: "query", Description: "Any value links the account to the logged in user"},
+		{Name: "return_to", In: "query", Description: "Path to return to after logging in"},
+		{Name: "invite", In: "query"},
+	}},
+	{Method: "GET", Path: "/auth/{provider}/callback", Tag: "auth", Summary: "Where the provider sends the user back to, with its own query parameters", ResponseType: responseRedirect, Errors: []int{400, 404, 409, 429, 502}, V1: true, Params: []apiParam{
+		{Name: "provider", In: "path", Required: true, Enum: []string{providerDiscord, providerTwitch, providerSteam}},
+	}},
+	{Method: "GET", Path: "/auth/csrf", Tag: "auth", Summary: "The session's CSRF token, for unsafe requests authenticated by cookie", Auth: authOptional, Response: map[string]string{}, Errors: []int{401}, V1: true},
+	{Method: "POST", Path: "/auth/logout", Tag: "auth", Summary: "Log out of the current session", Auth: authOptional, V1: true},
+	{Method: "GET", Path: "/auth/sessions", Tag: "auth", Summary: "List the user's sessions", Auth: authOptional, Response: []Session{}, Errors: []int{401}, V1: true},
+	{Method: "POST", Path: "/auth/sessions/revoke", Tag: "auth", Summary: "Log a session out", Auth: authOptional, Errors: []int{401, 404}, V1: true, Params: []apiParam{
+		{Name: "id", In: "form", Required: true},
+	}},
+	{Method: "GET", Path: "/auth/identities", Tag: "auth", Summary: "List the accounts the user can log in with", Auth: authOptional, Response: []UserIdentity{}, Errors: []int{401}, V1: true},
+	{Method: "POST", Path: "/auth/identities/unlink", Tag: "auth", Summary: "Unlink a Twitch or Steam account", Auth: authOptional, Errors: []int{400, 401, 404, 409}, V1: true, Params: []apiParam{
+		{Name: "provider", In: "form", Required: true, Enum: []string{providerTwitch, providerSteam}},
+	}},
+
+	// Settings
+	{Method: "GET", Path: "/settings/tokens", Tag: "settings", Summary: "API tokens page", Auth: authSession, ResponseType: responseHTML},
+	{Method: "POST", Path: "/settings/tokens/new", Tag: "settings", Summary: "Create an API token. The secret is only shown here.", Auth: authSession, Errors: []int{400, 401, 422}, Response: jsonSchema{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"id":         map[string]interface{}{"type": "string"},
+			"name":       map[string]interface{}{"type": "string"},
+			"scopes":     map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"expires_at": map[string]interface{}{"type": "string", "format": "date-time"},
+			"token":      map[string]interface{}{"type": "string"},
+		},
+	}, Params: []apiParam{
+		{Name: "name", In: "form", Required: true},
+		{Name: "scopes", In: "form", Type: "array", Required: true, Description: "Permissions, each one the user has"},
+		{Name: "expires_in_days", In: "form", Type: "integer"},
+	}},
+	{Method: "POST", Path: "/settings/tokens/revoke", Tag: "settings", Summary: "Revoke an API token", Auth: authSession, Errors: []int{401, 404}, Params: []apiParam{
+		{Name: "id", In: "form", Required: true},
+	}},
+
+	// Admin
+	{Method: "GET", Path: "/admin", Tag: "admin", Summary: "Admin home page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/clips", Tag: "admin", Summary: "Clips page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/duplicates", Tag: "admin", Summary: "Duplicates page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/games", Tag: "admin", Summary: "Games page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/users", Tag: "admin", Summary: "Users page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/quotas", Tag: "admin", Summary: "Quotas page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/invites", Tag: "admin", Summary: "Invites page", Auth: authRequired, Permission: PermAdminAccess, ResponseType: responseHTML},
+	{Method: "GET", Path: "/admin/metrics", Tag: "admin", Summary: "expvar metrics, including rate limit rejections", Auth: authRequired, Permission: PermAdminAccess, Response: jsonSchema{"type": "object"}},
+	{Method: "POST", Path: "/admin/quotas", Tag: "admin", Summary: "Set a role's quota", Auth: authRequired, Permission: PermAdminAccess, Errors: []int{401, 403, 422}, Params: []apiParam{
+		{Name: "role", In: "form", Required: true, Enum: roleRanks},
+		{Name: "max_mb", In: "form", Type: "integer"},
+		{Name: "max_minutes", In: "form", Type: "number"},
+		{Name: "max_uploads_per_day", In: "form", Type: "integer"},
+	}},
+	{Method: "POST", Path: "/admin/users/quota", Tag: "admin", Summary: "Set a user's quota overrides", Auth: authRequired, Permission: PermAdminAccess, Errors: []int{401, 403, 404}, Params: []apiParam{
+		{Name: "username", In: "form", Required: true},
+		{Name: "max_mb", In: "form", Type: "integer"},
+		{Name: "max_minutes", In: "form", Type: "number"},
+		{Name: "max_uploads_per_day", In: "form", Type: "integer"},
+	}},
+	{Method: "POST", Path: "/admin/users/role", Tag: "admin", Summary: "Set a user's role, or hand it back to the Discord mapping", Auth: authRequired, Permission: PermAdminAccess, Errors: []int{401, 403, 404, 409, 422}, Params: []apiParam{
+		{Name: "username", In: "form", Required: true},
+		{Name: "role", In: "form", Required: true, Enum: append(append([]string{}, roleRanks...), roleSourceDiscord)},
+	}},
+	{Method: "POST", Path: "/admin/users/sessions/revoke", Tag: "admin", Summary: "Log a user out everywhere", Auth: authRequired, Permission: PermAdminAccess, Errors: []int{401, 403, 404}, Params: []apiParam{
+		{Name: "username", In: "form", Required: true},
+	}},
+	{Method: "POST", Path: "/admin/invites/new", Tag: "admin", Summary: "Create an invite", Auth: authRequired, Permission: PermAdminAccess, Response: Invite{}, Errors: []int{401, 403, 422}, Params: []apiParam{
+		{Name: "role", In: "form", Enum: roleRanks},
+		{Name: "max_uses", In: "form", Type: "integer"},
+		{Name: "expires_in_days", In: "form", Type: "integer"},
+	}},
+	{Method: "POST", Path: "/admin/invites/revoke", Tag: "admin", Summary: "Revoke an invite", Auth: authRequired, Permission: PermAdminAccess, Errors: []int{401, 403, 404}, Params: []apiParam{
+		{Name: "code", In: "form", Required: true},
+	}},
+}
+
+// Where an operation is served. V1 operations are also served at Path itself, unwrapped.
+func (op apiOperation) documentedPath() string {
+	if op.V1 {
+		return "/api/v1" + op.Path
+	}
+
+	return op.Path
+}
+
+/*
+ *
+ *
+ * Document
+ *
+ *
+ */
+
+// The OpenAPI 3 document for apiOperations
+func openAPIDocument() map[string]interface{} {
+	schemas := map[string]interface{}{
+		"Message": jsonSchema{
+			"type":       "object",
+			"properties": map[string]interface{}{"message": map[string]interface{}{"type": "string"}},
+		},
+		"Error": jsonSchema{
+			"type":     "object",
+			"required": []string{"code", "message"},
+			"properties": map[string]interface{}{
+				"code":       map[string]interface{}{"type": "string", "enum": []string{"bad_request", "unauthorized", "forbidden", "not_found", "conflict", "validation_failed", "quota_exceeded", "rate_limited", "upstream_failed", "internal_error", "unavailable", "method_not_allowed"}},
+				"message":    map[string]interface{}{"type": "string"},
+				"fields":     map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}, "description": "Problems by form field, for validation_failed"},
+				"details":    map[string]interface{}{"type": "object"},
+				"request_id": map[string]interface{}{"type": "string"},
+			},
+		},
+		"Envelope": jsonSchema{
+			"type":     "object",
+			"required": []string{"data", "error", "meta"},
+			"properties": map[string]interface{}{
+				"data":  map[string]interface{}{},
+				"error": map[string]interface{}{"nullable": true, "allOf": []interface{}{schemaRef("Error")}},
+				"meta": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"request_id": map[string]interface{}{"type": "string"}},
+				},
+			},
+		},
+		"LegacyError": jsonSchema{
+			"type":       "object",
+			"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		path, ok := paths[op.documentedPath()].(map[string]interface{})
+		if !ok {
+			path = map[string]interface{}{}
+			paths[op.documentedPath()] = path
+		}
+		path[strings.ToLower(op.Method)] = op.document(schemas)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "LostSons.tv API",
+			"version": "1",
+			"description": "Routes under /api/v1 are also served without the prefix for the site's HTML forms. " +
+				"Those unprefixed routes return bare JSON and errors as {\"error\": message}; " +
+				"/api/v1 wraps every response in an Envelope. Unsafe requests authenticated by the session cookie " +
+				"need the CSRF token from /api/v1/auth/csrf in the " + csrfHeader + " header or the " + csrfFormField + " field.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/"}},
+		"tags": []interface{}{
+			map[string]interface{}{"name": "clips"},
+			map[string]interface{}{"name": "users"},
+			map[string]interface{}{"name": "games"},
+			map[string]interface{}{"name": "auth"},
+			map[string]interface{}{"name": "settings"},
+			map[string]interface{}{"name": "admin"},
+			map[string]interface{}{"name": "graphql"},
+			map[string]interface{}{"name": "meta"},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiToken": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal API token (lstv_...), limited to its scopes. Create one at /settings/tokens.",
+				},
+				"sessionJWT": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "The session JWT issued at login, with typ \"session\"",
+				},
+				"sessionCookie": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "jwt",
+				},
+			},
+		},
+	}
+}
+
+func (op apiOperation) document(schemas map[string]interface{}) map[string]interface{} {
+	doc := map[string]interface{}{
+		"tags":        []string{op.Tag},
+		"summary":     op.Summary,
+		"operationId": operationID(op),
+	}
+
+	if op.Permission != "" {
+		doc["description"] = "Needs " + op.Permission
+		doc["x-permission"] = op.Permission
+	}
+
+	switch op.Auth {
+	case authOptional:
+		doc["security"] = []interface{}{
+			map[string]interface{}{"apiToken": []string{}},
+			map[string]interface{}{"sessionJWT": []string{}},
+			map[string]interface{}{"sessionCookie": []string{}},
+			map[string]interface{}{},
+		}
+	case authRequired:
+		doc["security"] = []interface{}{
+			map[string]interface{}{"apiToken": []string{}},
+			map[string]interface{}{"sessionJWT": []string{}},
+			map[string]interface{}{"sessionCookie": []string{}},
+		}
+	case authSession:
+		doc["security"] = []interface{}{
+			map[string]interface{}{"sessionJWT": []string{}},
+			map[string]interface{}{"sessionCookie": []string{}},
+		}
+	case authNone:
+		doc["security"] = []interface{}{}
+	}
+
+	// Path, query and header parameters
+	parameters := []interface{}{}
+	formProperties := map[string]interface{}{}
+	formRequired := []string{}
+	for _, p := range op.Params {
+		if p.In == "form" {
+			formProperties[p.Name] = p.schema()
+			if p.Required {
+				formRequired = append(formRequired, p.Name)
+			}
+			continue
+		}
+
+		parameter := map[string]interface{}{
+			"name":     p.Name,
+			"in":       p.In,
+			"required": p.Required,
+			"schema":   p.schema(),
+		}
+		if p.Description != "" {
+			parameter["description"] = p.Description
+		}
+		parameters = append(parameters, parameter)
+	}
+
+	if len(parameters) > 0 {
+		doc["parameters"] = parameters
+	}
+
+	if len(formProperties) > 0 {
+		body := jsonSchema{"type": "object", "properties": formProperties}
+		if len(formRequired) > 0 {
+			body["required"] = formRequired
+		}
+
+		contentType := "application/x-www-form-urlencoded"
+		if op.Multipart {
+			contentType = "multipart/form-data"
+		}
+
+		doc["requestBody"] = map[string]interface{}{
+			"required": len(formRequired) > 0,
+			"content":  map[string]interface{}{contentType: map[string]interface{}{"schema": body}},
+		}
+	}
+
+	// Responses
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	responses := map[string]interface{}{}
+	switch op.ResponseType {
+	case responseHTML:
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": "An HTML page",
+			"content":     map[string]interface{}{"text/html": map[string]interface{}{}},
+		}
+	case responseText:
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": "Plain text",
+			"content":     map[string]interface{}{"text/plain": map[string]interface{}{}},
+		}
+	case responseRedirect:
+		responses["302"] = map[string]interface{}{
+			"description": "A redirect",
+			"headers":     map[string]interface{}{"Location": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+		}
+	default:
+		data := schemaRef("Message")
+		if s, ok := op.Response.(jsonSchema); ok {
+			data = s
+		} else if op.Response != nil {
+			data = schemaOf(reflect.TypeOf(op.Response), schemas)
+		} else if !op.V1 {
+			data = jsonSchema{"type": "string"}
+		}
+
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": op.wrap(data)}},
+		}
+	}
+
+	for _, code := range op.Errors {
+		errorSchema := schemaRef("LegacyError")
+		if op.V1 {
+			errorSchema = schemaRef("Envelope")
+		}
+
+		responses[strconv.Itoa(code)] = map[string]interface{}{
+			"description": http.StatusText(code),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+		}
+	}
+	doc["responses"] = responses
+
+	return doc
+}
+
+// The schema of a response body with data in it
+func (op apiOperation) wrap(data interface{}) interface{} {
+	if !op.V1 {
+		return data
+	}
+
+	return jsonSchema{
+		"allOf": []interface{}{
+			schemaRef("Envelope"),
+			map[string]interface{}{"properties": map[string]interface{}{"data": data}},
+		},
+	}
+}
+
+func (p apiParam) schema() jsonSchema {
+	schema := jsonSchema{"type": "string"}
+	switch p.Type {
+	case "integer", "number", "boolean":
+		schema["type"] = p.Type
+	case "array":
+		schema = jsonSchema{"type": "array", "items": map[string]interface{}{"type": "string"}}
+	case "file":
+		schema["format"] = "binary"
+	}
+
+	if len(p.Enum) > 0 {
+		schema["enum"] = p.Enum
+	}
+	if p.Description != "" && p.In == "form" {
+		schema["description"] = p.Description
+	}
+
+	return schema
+}
+
+// e.g. postClipsCaptionsNew, getClipsIdPlayback
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '.' || r == '-' }) {
+		part = strings.Trim(part, "{}")
+		if part == "" {
+			continue
+		}
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+
+	if id == strings.ToLower(op.Method) {
+		id += "Index"
+	}
+
+	return id
+}
+
+func schemaRef(name string) jsonSchema {
+	return jsonSchema{"$ref": "#/components/schemas/" + name}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Generate a schema from a Go type as encoding/json would marshal it. Structs are added
+// to schemas and referred to by name.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) jsonSchema {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	var schema jsonSchema
+	switch {
+	case t == timeType:
+		schema = jsonSchema{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // placeholder, for types that refer to themselves
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		schema = schemaRef(t.Name())
+		if nullable {
+			return jsonSchema{"nullable": true, "allOf": []interface{}{schema}}
+		}
+		return schema
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		schema = jsonSchema{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		schema = jsonSchema{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Bool:
+		schema = jsonSchema{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema = jsonSchema{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema = jsonSchema{"type": "number"}
+	case t.Kind() == reflect.String:
+		schema = jsonSchema{"type": "string"}
+	default:
+		schema = jsonSchema{}
+	}
+
+	if nullable {
+		schema["nullable"] = true
+	}
+
+	return schema
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) jsonSchema {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		// Embedded structs are flattened, as encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := structSchema(field.Type, schemas)
+			for key, value := range embedded["properties"].(map[string]interface{}) {
+				properties[key] = value
+			}
+			if names, ok := embedded["required"].([]string); ok {
+				required = append(required, names...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemaOf(field.Type, schemas)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	sort.Strings(required)
+	schema := jsonSchema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+/*
+ *
+ *
+ * Checking the spec against the router and requests
+ *
+ *
+ */
+
+// Routes that aren't documented, and documented routes that don't exist. Trailing
+// slashes are ignored, and an unprefixed route is documented by its /api/v1 twin.
+func checkOpenAPI(router chi.Routes) (undocumented []string, missing []string, err error) {
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.documentedPath()] = false
+	}
+
+	err = chi.Walk(router, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if route != "/" {
+			route = strings.TrimSuffix(route, "/")
+		}
+
+		key := method + " " + route
+		if _, ok := documented[key]; !ok {
+			key = method + " /api/v1" + route
+		}
+
+		if _, ok := documented[key]; !ok {
+			undocumented = append(undocumented, method+" "+route)
+			return nil
+		}
+
+		documented[key] = true
+		return nil
+	})
+
+	for key, seen := range documented {
+		if !seen {
+			missing = append(missing, key)
+		}
+	}
+
+	sort.Strings(undocumented)
+	sort.Strings(missing)
+	return undocumented, missing, err
+}
+
+// Whether a request path matches a documented path like /api/v1/clips/{id}/playback
+func matchesPath(pattern string, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return false
+	}
+
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") {
+			if pathParts[i] == "" {
+				return false
+			}
+			continue
+		}
+
+		if part != pathParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The operation a request is for. Like chi, a path without parameters wins, so
+// /clips/duplicates isn't taken for /clips/{id}.
+func findOperation(method string, path string) (apiOperation, bool) {
+	var match apiOperation
+	found := false
+	for _, op := range apiOperations {
+		if op.Method != method || !matchesPath(op.documentedPath(), path) {
+			continue
+		}
+
+		if !strings.Contains(op.Path, "{") {
+			return op, true
+		}
+
+		if !found {
+			match, found = op, true
+		}
+	}
+
+	return match, found
+}
+
+// Check a request's query and form parameters against its operation
+func (op apiOperation) validate(r *http.Request) error {
+	for _, p := range op.Params {
+		var values []string
+		switch p.In {
+		case "query":
+			values = r.URL.Query()[p.Name]
+		case "form":
+			if p.Type == "file" {
+				if r.MultipartForm == nil || len(r.MultipartForm.File[p.Name]) == 0 {
+					if p.Required {
+						return errValidation(p.Name, "is required")
+					}
+				}
+				continue
+			}
+			values = r.PostForm[p.Name]
+		default:
+			continue
+		}
+
+		if len(values) == 0 || values[0] == "" {
+			if p.Required {
+				return errValidation(p.Name, "is required")
+			}
+			continue
+		}
+
+		for _, value := range values {
+			if err := p.check(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p apiParam) check(value string) error {
+	switch p.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return errValidation(p.Name, "must be an integer")
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return errValidation(p.Name, "must be a number")
+		}
+	case "boolean":
+		if value != "true" && value != "false" && value != "on" && value != "1" && value != "0" {
+			return errValidation(p.Name, "must be true or false")
+		}
+	}
+
+	if len(p.Enum) == 0 {
+		return nil
+	}
+
+	for _, allowed := range p.Enum {
+		if value == allowed {
+			return nil
+		}
+	}
+
+	return errValidation(p.Name, "must be one of "+strings.Join(p.Enum, ", "))
+}
+
+// Whether validateRequests checks requests, from OPENAPI_VALIDATE
+func requestValidationEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("OPENAPI_VALIDATE"))
+	return enabled
+}
+
+// Key marking a request to be checked against the spec
+const validateContextKey contextKey = "validate"
+
+// Middleware marking requests to be checked against the spec. The check runs in
+// makeHTTPHandleFunc, after authentication and rate limiting, so nobody can make us
+// parse a large form without getting past those. Off unless OPENAPI_VALIDATE is set.
+func validateRequests(next http.Handler) http.Handler {
+	if !requestValidationEnabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), validateContextKey, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Check a request marked by validateRequests against its operation, rejecting one
+// that doesn't match with a 422
+func validateRequest(r *http.Request) error {
+	if marked, _ := r.Context().Value(validateContextKey).(bool); !marked {
+		return nil
+	}
+
+	op, ok := findOperation(r.Method, r.URL.Path)
+	if !ok {
+		return nil
+	}
+
+	if !isSafeMethod(r.Method) {
+		var err error
+		if op.Multipart {
+			err = r.ParseMultipartForm(32 << 20)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			return errBadRequest("error parsing form: %s", err)
+		}
+	}
+
+	return op.validate(r)
+}
+
+/*
+ *
+ *
+ * Handlers
+ *
+ *
+ */
+
+// Route for the OpenAPI document
+func (s *APIServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	return responseWithJSON(w, http.StatusOK, openAPIDocument())
+}
+
+// Route for the API docs, which render /api/openapi.json and can send requests
+func (s *APIServer) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("./templates/api_docs.html")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := t.Execute(w, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Print the document, or check it against the router, e.g. in CI:
+//
+//	lostsonstv openapi check
+//	lostsonstv openapi print > openapi.json
+func (s *APIServer) openAPICommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("openapi needs a subcommand: print or check")
+	}
+
+	switch args[0] {
+	case "print":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(openAPIDocument())
+	case "check":
+		undocumented, missing, err := checkOpenAPI(s.routes())
+		if err != nil {
+			return err
+		}
+
+		for _, route := range undocumented {
+			fmt.Printf("undocumented route: %s\n", route)
+		}
+		for _, route := range missing {
+			fmt.Printf("documented route doesn't exist: %s\n", route)
+		}
+
+		if len(undocumented) > 0 || len(missing) > 0 {
+			return fmt.Errorf("openapi document is out of date with the router")
+		}
+
+		fmt.Printf("all %d operations are documented\n", len(apiOperations))
+		return nil
+	default:
+		return fmt.Errorf("unknown openapi subcommand %q", args[0])
+	}
+}
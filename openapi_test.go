@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/majesticbeast/lostsons.tv/logger"
+)
+
+// A Storage with canned clips and games. Methods the tests don't stub panic.
+type stubStore struct {
+	Storage
+	clips []Clip
+	games []Game
+}
+
+func (s *stubStore) GetAllClips() ([]Clip, error) {
+	return s.clips, nil
+}
+
+func (s *stubStore) GetClip(id string) (Clip, error) {
+	for _, clip := range s.clips {
+		if clip.ID == id {
+			return clip, nil
+		}
+	}
+
+	return Clip{}, pgx.ErrNoRows
+}
+
+func (s *stubStore) GetClipCaptions(clipID string) ([]Caption, error) {
+	return []Caption{{ID: "caption-1", ClipID: clipID, LanguageCode: "en", Name: "English"}}, nil
+}
+
+func (s *stubStore) GetAllGames() ([]Game, error) {
+	return s.games, nil
+}
+
+func newStubServer() *APIServer {
+	store := &stubStore{
+		clips: []Clip{
+			{ID: "clip-1", PlaybackID: "playback-1", DateUploaded: time.Now(), Description: "triple kill", GameID: "game-1", Game: "Apex Legends", Username: "alice", Visibility: VisibilityPublic},
+			{ID: "clip-2", PlaybackID: "playback-2", DateUploaded: time.Now(), Description: "members only", GameID: "game-1", Game: "Apex Legends", Username: "bob", Visibility: VisibilityMembers},
+		},
+		games: []Game{{ID: "game-1", Name: "Apex Legends"}, {ID: "game-2", Name: "Halo"}},
+	}
+
+	return NewAPIServer(store, &logger.StdLogger{})
+}
+
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	s := NewAPIServer(nil, &logger.StdLogger{})
+
+	undocumented, missing, err := checkOpenAPI(s.routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range undocumented {
+		t.Errorf("undocumented route: %s", route)
+	}
+	for _, route := range missing {
+		t.Errorf("documented route doesn't exist: %s", route)
+	}
+}
+
+func TestResponsesMatchSchemas(t *testing.T) {
+	router := newStubServer().routes()
+	doc := openAPIDocument()
+
+	tests := []struct {
+		path   string
+		op     string
+		status int
+	}{
+		{"/api/v1/clips", "/api/v1/clips", http.StatusOK},
+		{"/clips", "/api/v1/clips", http.StatusOK},
+		{"/api/v1/clips/clip-1", "/api/v1/clips/{id}", http.StatusOK},
+		{"/api/v1/clips/clip-2", "/api/v1/clips/{id}", http.StatusNotFound},
+		{"/api/v1/games", "/api/v1/games", http.StatusOK},
+		{"/healthHTTP", "/healthHTTP", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			schema := responseSchema(t, doc, tt.op, strings.HasPrefix(tt.path, "/api/v1"), tt.status)
+
+			var body interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response isn't JSON: %s", err)
+			}
+
+			for _, problem := range checkSchema(doc, schema, body, "body") {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+func TestValidationRunsAfterAuthentication(t *testing.T) {
+	t.Setenv("OPENAPI_VALIDATE", "true")
+	router := newStubServer().routes()
+
+	// An anonymous upload is refused before its form is looked at
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/clips/new", strings.NewReader("not a multipart body"))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous upload: status = %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+	}
+
+	// A request that gets through is checked against the spec
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/users/new", strings.NewReader(url.Values{"email": {"a@example.com"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("missing username: status = %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+	}
+
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Fields["username"] == "" {
+		t.Errorf("error = %+v, want a problem with username", body.Error)
+	}
+}
+
+// The schema of an operation's JSON response with the given status
+func responseSchema(t *testing.T, doc map[string]interface{}, path string, v1 bool, status int) interface{} {
+	t.Helper()
+
+	paths := doc["paths"].(map[string]interface{})
+	op, ok := paths[path].(map[string]interface{})["get"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s isn't documented", path)
+	}
+
+	response, ok := op["responses"].(map[string]interface{})[strconv.Itoa(status)].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s doesn't document a %d response", path, status)
+	}
+
+	schema := response["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"]
+
+	// Unprefixed routes return the bare data, or a LegacyError
+	if !v1 && status < 400 {
+		if wrapped, ok := schema.(jsonSchema)["allOf"].([]interface{}); ok {
+			return wrapped[1].(map[string]interface{})["properties"].(map[string]interface{})["data"]
+		}
+	}
+
+	return schema
+}
+
+// Problems with value against a subset of JSON Schema: $ref, allOf, nullable, type,
+// properties, required, items and additionalProperties
+func checkSchema(doc map[string]interface{}, schema interface{}, value interface{}, at string) []string {
+	s := toSchema(schema)
+
+	if ref, ok := s["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		return checkSchema(doc, schemas[name], value, at)
+	}
+
+	if value == nil {
+		if nullable, _ := s["nullable"].(bool); nullable || len(s) == 0 {
+			return nil
+		}
+	}
+
+	problems := []string{}
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, part := range all {
+			problems = append(problems, checkSchema(doc, part, value, at)...)
+		}
+	}
+
+	switch s["type"] {
+	case "object":
+		if _, ok := value.(map[string]interface{}); !ok {
+			return append(problems, fmt.Sprintf("%s: %v is not an object", at, value))
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: %v is not an array", at, value))
+		}
+		for i, item := range items {
+			problems = append(problems, checkSchema(doc, s["items"], item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+		return problems
+	case "string":
+		if _, ok := value.(string); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a string", at, value))
+		}
+		return problems
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (s["type"] == "integer" && n != float64(int64(n))) {
+			problems = append(problems, fmt.Sprintf("%s: %v is not an %s", at, value, s["type"]))
+		}
+		return problems
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a boolean", at, value))
+		}
+		return problems
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return problems
+	}
+
+	if required, ok := s["required"].([]string); ok {
+		for _, name := range required {
+			if _, ok := object[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing %s", at, name))
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	for name, property := range properties {
+		if field, ok := object[name]; ok {
+			problems = append(problems, checkSchema(doc, property, field, at+"."+name)...)
+		}
+	}
+
+	if additional, ok := s["additionalProperties"]; ok {
+		for name, field := range object {
+			problems = append(problems, checkSchema(doc, additional, field, at+"."+name)...)
+		}
+	}
+
+	return problems
+}
+
+func toSchema(schema interface{}) map[string]interface{} {
+	switch s := schema.(type) {
+	case jsonSchema:
+		return s
+	case map[string]interface{}:
+		return s
+	}
+
+	return map[string]interface{}{}
+}
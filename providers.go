@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	providerDiscord = "discord"
+	providerTwitch  = "twitch"
+	providerSteam   = "steam"
+)
+
+// A service people can log in with
+type loginProvider interface {
+	// Where to send the user to log in. verifier is the PKCE verifier, for providers that use it.
+	AuthURL(state string, verifier string) (string, error)
+
+	// Check the provider's callback and fetch the user's profile. Only Discord returns
+	// a token, since only its token is kept with the session.
+	Callback(r *http.Request, verifier string) (ProviderUser, *oauth2.Token, error)
+}
+
+// Providers that can be logged in with. Discord is always on; Twitch and Steam once configured.
+func loginProviders() map[string]loginProvider {
+	providers := map[string]loginProvider{
+		providerDiscord: discordProvider{},
+	}
+
+	if os.Getenv("TWITCH_OAUTH_ID") != "" {
+		providers[providerTwitch] = twitchProvider{}
+	}
+
+	if os.Getenv("STEAM_OPENID_RETURN") != "" {
+		providers[providerSteam] = steamProvider{}
+	}
+
+	return providers
+}
+
+// An environment variable, or fallback if it isn't set. Used for provider endpoints
+// so they can be pointed at a local stand-in.
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// GET a provider API URL and decode the JSON response into v
+func getProviderJSON(ctx context.Context, apiURL string, header http.Header, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request to %s: %w", apiURL, err)
+	}
+	req.Header = header
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error getting response from %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", req.URL.Host, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding response body: %w", err)
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * Discord
+ *
+ *
+ */
+
+type discordProvider struct{}
+
+func discordAPIURL() string {
+	return envOr("DISCORD_API_URL", "https://discord.com/api")
+}
+
+func discordOAuthConfig() *oauth2.Config {
+	scopes := []string{"identify", "email"}
+	if guildGatingEnabled() {
+		scopes = append(scopes, "guilds", "guilds.members.read")
+	}
+
+	return &oauth2.Config{
+		ClientID:     os.Getenv("DISCORD_OAUTH_ID"),
+		ClientSecret: os.Getenv("DISCORD_OAUTH_SECRET"),
+		RedirectURL:  os.Getenv("DISCORD_OAUTH_REDIRECT"),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  envOr("DISCORD_AUTH_URL", discordAPIURL()+"/oauth2/authorize"),
+			TokenURL: envOr("DISCORD_TOKEN_URL", discordAPIURL()+"/oauth2/token"),
+		},
+		Scopes: scopes,
+	}
+}
+
+func (discordProvider) AuthURL(state string, verifier string) (string, error) {
+	return discordOAuthConfig().AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier)), nil
+}
+
+func (discordProvider) Callback(r *http.Request, verifier string) (ProviderUser, *oauth2.Token, error) {
+	code := r.URL.Query().Get("code")
+	token, err := discordOAuthConfig().Exchange(r.Context(), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return ProviderUser{}, nil, fmt.Errorf("error exchanging code (%s) for token: %w", code, err)
+	}
+
+	// Get users Discord info
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+
+	discordUser := DiscordUser{}
+	if err := getProviderJSON(r.Context(), discordAPIURL()+"/users/@me", header, &discordUser); err != nil {
+		return ProviderUser{}, nil, err
+	}
+
+	if discordUser.ID == "" {
+		return ProviderUser{}, nil, fmt.Errorf("discord did not return a user id")
+	}
+
+	return ProviderUser{
+		Provider:    providerDiscord,
+		ID:          discordUser.ID,
+		Username:    discordUser.Username,
+		DisplayName: discordUser.GlobalName,
+		Avatar:      discordUser.Avatar,
+		Email:       discordUser.Email,
+		Verified:    discordUser.Verified,
+	}, token, nil
+}
+
+/*
+ *
+ *
+ * Twitch
+ *
+ *
+ */
+
+type twitchProvider struct{}
+
+// A user from the Twitch Helix API
+type twitchUser struct {
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+}
+
+func twitchAPIURL() string {
+	return envOr("TWITCH_API_URL", "https://api.twitch.tv/helix")
+}
+
+func twitchOAuthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     os.Getenv("TWITCH_OAUTH_ID"),
+		ClientSecret: os.Getenv("TWITCH_OAUTH_SECRET"),
+		RedirectURL:  os.Getenv("TWITCH_OAUTH_REDIRECT"),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   envOr("TWITCH_AUTH_URL", "https://id.twitch.tv/oauth2/authorize"),
+			TokenURL:  envOr("TWITCH_TOKEN_URL", "https://id.twitch.tv/oauth2/token"),
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		Scopes: []string{"user:read:email"},
+	}
+}
+
+// Twitch doesn't support PKCE, so the verifier goes unused
+func (twitchProvider) AuthURL(state string, verifier string) (string, error) {
+	return twitchOAuthConfig().AuthCodeURL(state), nil
+}
+
+func (twitchProvider) Callback(r *http.Request, verifier string) (ProviderUser, *oauth2.Token, error) {
+	code := r.URL.Query().Get("code")
+	token, err := twitchOAuthConfig().Exchange(r.Context(), code)
+	if err != nil {
+		return ProviderUser{}, nil, fmt.Errorf("error exchanging code (%s) for token: %w", code, err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	header.Set("Client-Id", os.Getenv("TWITCH_OAUTH_ID"))
+
+	users := struct {
+		Data []twitchUser `json:"data"`
+	}{}
+	if err := getProviderJSON(r.Context(), twitchAPIURL()+"/users", header, &users); err != nil {
+		return ProviderUser{}, nil, err
+	}
+
+	if len(users.Data) == 0 || users.Data[0].ID == "" {
+		return ProviderUser{}, nil, fmt.Errorf("twitch did not return a user")
+	}
+
+	// Twitch doesn't say whether the email is verified, so it is never used to link accounts
+	user := users.Data[0]
+	return ProviderUser{
+		Provider:    providerTwitch,
+		ID:          user.ID,
+		Username:    user.Login,
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+	}, nil, nil
+}
+
+/*
+ *
+ *
+ * Steam
+ *
+ *
+ */
+
+// Steam only offers OpenID 2.0: the user is sent to Steam, which redirects back with a
+// signed assertion of their Steam ID that we ask Steam to verify.
+type steamProvider struct{}
+
+const (
+	openIDNamespace      = "http://specs.openid.net/auth/2.0"
+	openIDIdentifierMode = "http://specs.openid.net/auth/2.0/identifier_select"
+)
+
+var steamIDPattern = regexp.MustCompile(`/openid/id/([0-9]{1,20})$`)
+
+// A player from the Steam Web API
+type steamPlayer struct {
+	SteamID     string `json:"steamid"`
+	PersonaName string `json:"personaname"`
+}
+
+func steamOpenIDURL() string {
+	return envOr("STEAM_OPENID_URL", "https://steamcommunity.com/openid/login")
+}
+
+func steamAPIURL() string {
+	return envOr("STEAM_API_URL", "https://api.steampowered.com")
+}
+
+// Our callback URL for a login attempt, with its state in the query
+func steamReturnTo(state string) (string, error) {
+	u, err := url.Parse(os.Getenv("STEAM_OPENID_RETURN"))
+	if err != nil {
+		return "", fmt.Errorf("STEAM_OPENID_RETURN is invalid: %w", err)
+	}
+
+	q := u.Query()
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// OpenID has no PKCE, so the verifier goes unused
+func (steamProvider) AuthURL(state string, verifier string) (string, error) {
+	returnTo, err := steamReturnTo(state)
+	if err != nil {
+		return "", err
+	}
+
+	u, _ := url.Parse(returnTo)
+	q := url.Values{}
+	q.Set("openid.ns", openIDNamespace)
+	q.Set("openid.mode", "checkid_setup")
+	q.Set("openid.return_to", returnTo)
+	q.Set("openid.realm", u.Scheme+"://"+u.Host)
+	q.Set("openid.identity", openIDIdentifierMode)
+	q.Set("openid.claimed_id", openIDIdentifierMode)
+
+	return steamOpenIDURL() + "?" + q.Encode(), nil
+}
+
+func (steamProvider) Callback(r *http.Request, verifier string) (ProviderUser, *oauth2.Token, error) {
+	q := r.URL.Query()
+	if q.Get("openid.mode") != "id_res" {
+		return ProviderUser{}, nil, fmt.Errorf("steam login was cancelled")
+	}
+
+	// The assertion must be from the endpoint we sent the user to, and for this login attempt
+	returnTo, err := steamReturnTo(q.Get("state"))
+	if err != nil {
+		return ProviderUser{}, nil, err
+	}
+
+	if q.Get("openid.op_endpoint") != steamOpenIDURL() || q.Get("openid.return_to") != returnTo {
+		return ProviderUser{}, nil, fmt.Errorf("invalid steam login response")
+	}
+
+	match := steamIDPattern.FindStringSubmatch(q.Get("openid.claimed_id"))
+	if match == nil {
+		return ProviderUser{}, nil, fmt.Errorf("invalid steam id")
+	}
+	steamID := match[1]
+
+	if err := verifySteamAssertion(r.Context(), q); err != nil {
+		return ProviderUser{}, nil, err
+	}
+
+	player, err := getSteamPlayer(r.Context(), steamID)
+	if err != nil {
+		return ProviderUser{}, nil, err
+	}
+
+	return ProviderUser{
+		Provider:    providerSteam,
+		ID:          steamID,
+		Username:    player.PersonaName,
+		DisplayName: player.PersonaName,
+	}, nil, nil
+}
+
+// Ask Steam whether it really signed an assertion, by posting it back in check_authentication mode
+func verifySteamAssertion(ctx context.Context, q url.Values) error {
+	form := url.Values{}
+	for key, values := range q {
+		if strings.HasPrefix(key, "openid.") {
+			form[key] = values
+		}
+	}
+	form.Set("openid.mode", "check_authentication")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", steamOpenIDURL(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("error creating request to Steam: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error getting response from Steam: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("error reading response from Steam: %w", err)
+	}
+
+	// The response is key:value lines
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.TrimSpace(line) == "is_valid:true" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("steam could not verify the login")
+}
+
+// A Steam user's public profile. Without STEAM_API_KEY only the ID is known, so the
+// user is named after it.
+func getSteamPlayer(ctx context.Context, steamID string) (steamPlayer, error) {
+	key := os.Getenv("STEAM_API_KEY")
+	if key == "" {
+		return steamPlayer{SteamID: steamID, PersonaName: "steam-" + steamID}, nil
+	}
+
+	q := url.Values{}
+	q.Set("key", key)
+	q.Set("steamids", steamID)
+
+	summaries := struct {
+		Response struct {
+			Players []steamPlayer `json:"players"`
+		} `json:"response"`
+	}{}
+	apiURL := steamAPIURL() + "/ISteamUser/GetPlayerSummaries/v0002/?" + q.Encode()
+	if err := getProviderJSON(ctx, apiURL, http.Header{}, &summaries); err != nil {
+		return steamPlayer{}, err
+	}
+
+	if len(summaries.Response.Players) == 0 {
+		return steamPlayer{}, fmt.Errorf("steam did not return a profile")
+	}
+
+	return summaries.Response.Players[0], nil
+}
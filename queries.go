@@ -1,35 +1,23 @@
 package main
 
-func buildGetAllClipsQuery() string {
-	return `SELECT
-        c.*,
-        string_agg(DISTINCT t.tag_name, ', ') AS returned_clip_tags,
-        string_agg(DISTINCT u.username, ', ') AS returned_featured_users,
-        g.name AS game_name,
-        u.username AS user_name
-    FROM
-        clips AS c
-    LEFT JOIN
-        clips_tags AS ct ON c.id = ct.clip_id
-    LEFT JOIN
-        tags AS t ON ct.tag_id = t.id
-    LEFT JOIN
-        clips_users AS cu ON c.id = cu.clip_id
-    LEFT JOIN
-        users AS u ON cu.user_id = u.id
-    LEFT JOIN
-        games AS g ON c.game_id = g.id
-    GROUP BY
-        c.id, c.description, g.name, u.username;`
-}
+import (
+	"fmt"
+	"strings"
+)
 
-func buildGetClipQuery() string {
-	return `SELECT
-	c.*,
-	string_agg(DISTINCT t.tag_name, ', ') AS returned_clip_tags,
-	string_agg(DISTINCT u.username, ', ') AS returned_featured_users,
+// Columns selected for a Clip, in the order scanned by clipScanFields
+const clipColumns = `c.id, c.playback_id, c.asset_id, c.date_uploaded, c.user_id, c.game_id, c.description,
+        c.object_key, c.visibility, c.mp4_support, c.mp4_rendition, c.content_hash, c.fingerprint,
+        c.size_bytes, c.duration_seconds`
+
+// Clips with their tags, featured users, game and uploader. Featured users and the
+// uploader are joined separately, so there is one row per clip.
+const clipSelect = `SELECT
+	` + clipColumns + `,
+	COALESCE(string_agg(DISTINCT t.tag_name, ', '), '') AS returned_clip_tags,
+	COALESCE(string_agg(DISTINCT fu.username, ', '), '') AS returned_featured_users,
 	g.name AS game_name,
-	u.username AS user_name
+	COALESCE(up.username, '') AS user_name
 FROM
 	clips AS c
 LEFT JOIN
@@ -39,15 +27,115 @@ LEFT JOIN
 LEFT JOIN
 	clips_users AS cu ON c.id = cu.clip_id
 LEFT JOIN
-	users AS u ON cu.user_id = u.id
+	users AS fu ON cu.user_id = fu.id
+LEFT JOIN
+	users AS up ON c.user_id = up.id
 LEFT JOIN
 	games AS g ON c.game_id = g.id
-WHERE
-	c.id = $1
-GROUP BY
-	c.id, c.description, g.name, u.username;`
+`
+
+const clipGroupBy = `GROUP BY
+	c.id, g.name, up.username
+`
+
+func buildGetAllClipsQuery() string {
+	return clipSelect + clipGroupBy + `;`
+}
+
+// Clips matching a condition on c, newest first
+func buildGetClipsWhereQuery(condition string) string {
+	return clipSelect + `WHERE
+	` + condition + `
+` + clipGroupBy + `ORDER BY
+	c.date_uploaded DESC;`
+}
+
+// The id, upload date and page key of every clip a ClipPageQuery lists, and the
+// query's arguments
+func buildListedClipsQuery(q ClipPageQuery) (string, []interface{}) {
+	args := []interface{}{q.Visibilities, q.PrivateOf}
+	conditions := []string{"(c.visibility = ANY($1) OR (c.visibility = 'private' AND c.user_id = $2))"}
+
+	key, join := "''", ""
+	switch q.By {
+	case "game":
+		key = "c.game_id"
+	case "uploader":
+		key = "c.user_id"
+	case "featured":
+		key, join = "f.user_id", "JOIN clips_users AS f ON f.clip_id = c.id AND f.user_id <> c.user_id"
+	case "tag":
+		key, join = "lower(kt.tag_name)", "JOIN clips_tags AS kct ON kct.clip_id = c.id JOIN tags AS kt ON kt.id = kct.tag_id"
+	}
+
+	if q.By != "" {
+		args = append(args, q.Keys)
+		conditions = append(conditions, fmt.Sprintf("%s = ANY($%d)", key, len(args)))
+	}
+
+	if q.GameID != "" {
+		args = append(args, q.GameID)
+		conditions = append(conditions, fmt.Sprintf("c.game_id = $%d", len(args)))
+	}
+
+	if q.Tag != "" {
+		args = append(args, q.Tag)
+		conditions = append(conditions, fmt.Sprintf(`EXISTS (
+		SELECT 1 FROM clips_tags AS ct JOIN tags AS t ON t.id = ct.tag_id
+		WHERE ct.clip_id = c.id AND lower(t.tag_name) = lower($%d)
+	)`, len(args)))
+	}
+
+	return fmt.Sprintf(`SELECT DISTINCT c.id, c.date_uploaded, %s AS key
+	FROM clips AS c
+	%s
+	WHERE %s`, key, join, strings.Join(conditions, "\n\tAND ")), args
+}
+
+func buildGetClipQuery() string {
+	return buildGetClipByColumnQuery("c.id")
+}
+
+func buildGetClipByAssetIDQuery() string {
+	return buildGetClipByColumnQuery("c.asset_id")
+}
+
+func buildGetClipByContentHashQuery() string {
+	return buildGetClipByColumnQuery("c.content_hash")
+}
+
+// Single clip lookup on one column. If several clips match, the first is returned.
+func buildGetClipByColumnQuery(column string) string {
+	return clipSelect + fmt.Sprintf(`WHERE
+	%s = $1
+`, column) + clipGroupBy + `ORDER BY
+	c.date_uploaded
+LIMIT 1;`
 }
 
 func buildCreateClipQuery() string {
-	return `INSERT INTO clips (id, playback_id, asset_id, date_uploaded, description, user_id, game_id) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	return `INSERT INTO clips (id, playback_id, asset_id, date_uploaded, description, user_id, game_id, object_key, visibility, mp4_support, content_hash, size_bytes) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+}
+
+// Pointers to the fields of a clip, in the order of buildGetClipQuery's columns
+func clipScanFields(clip *Clip) []interface{} {
+	return []interface{}{
+		&clip.ID, &clip.PlaybackID, &clip.AssetID, &clip.DateUploaded, &clip.UserID, &clip.GameID, &clip.Description,
+		&clip.ObjectKey, &clip.Visibility, &clip.Downloadable, &clip.MP4Rendition, &clip.ContentHash, &clip.Fingerprint,
+		&clip.SizeBytes, &clip.Duration,
+		&clip.Tags, &clip.FeaturedUsers, &clip.Game, &clip.Username,
+	}
+}
+
+// Columns selected for a User, in the order scanned by userScanFields
+const userColumns = `id, username, COALESCE(email, ''), COALESCE(role, 'viewer'), usage_bytes, usage_seconds,
+	quota_bytes, quota_seconds, quota_uploads_per_day, COALESCE(discord_id, ''), display_name, avatar, role_source`
+
+// Pointers to the fields of a user, in the order of userColumns
+func userScanFields(user *User) []interface{} {
+	return []interface{}{
+		&user.ID, &user.Username, &user.Email, &user.Role, &user.UsageBytes, &user.UsageSeconds,
+		&user.QuotaBytes, &user.QuotaSeconds, &user.QuotaUploadsPerDay, &user.DiscordID, &user.DisplayName, &user.Avatar,
+		&user.RoleSource,
+	}
 }
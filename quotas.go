@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A rejected upload, with the status code to report it with
+type quotaError struct {
+	Code    int
+	Message string
+}
+
+func (e *quotaError) Error() string {
+	return e.Message
+}
+
+// Usage and limits of a user, as shown on the admin quotas page
+type UserUsage struct {
+	User
+	Quota          Quota
+	UploadsToday   int
+	PercentBytes   int
+	PercentMinutes int
+}
+
+// The limits that apply to a user: their role's quota, with any per-user overrides on top
+func (s *APIServer) userQuota(user User) (Quota, error) {
+	quota, err := s.store.GetRoleQuota(user.Role)
+	if err != nil {
+		return quota, err
+	}
+
+	if user.QuotaBytes > 0 {
+		quota.MaxBytes = user.QuotaBytes
+	}
+
+	if user.QuotaSeconds > 0 {
+		quota.MaxSeconds = user.QuotaSeconds
+	}
+
+	if user.QuotaUploadsPerDay > 0 {
+		quota.MaxUploadsPerDay = user.QuotaUploadsPerDay
+	}
+
+	return quota, nil
+}
+
+// Check whether a user may upload another clip of sizeBytes and, if so, reserve the
+// bytes against their storage quota straight away so parallel uploads can't all pass.
+// Callers give the bytes back with releaseQuota if the upload doesn't become a clip.
+// Minutes are only known once Mux has encoded a clip, so that limit stops uploads once
+// it has been reached.
+func (s *APIServer) reserveQuota(user User, sizeBytes int64) error {
+	quota, err := s.userQuota(user)
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxSeconds > 0 && user.UsageSeconds >= quota.MaxSeconds {
+		return &quotaError{
+			Code: http.StatusForbidden,
+			Message: fmt.Sprintf("duration quota exceeded: %.1f of %.1f minutes used",
+				user.UsageSeconds/60, quota.MaxSeconds/60),
+		}
+	}
+
+	reserved, err := s.store.ReserveUsageBytes(user.ID, sizeBytes, quota.MaxBytes)
+	if err != nil {
+		return err
+	}
+
+	if !reserved {
+		return &quotaError{
+			Code: http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("storage quota exceeded: %s used of %s, this clip is %s",
+				formatBytes(user.UsageBytes), formatBytes(quota.MaxBytes), formatBytes(sizeBytes)),
+		}
+	}
+
+	return nil
+}
+
+// Give back bytes reserved by reserveQuota for an upload that was dropped or failed
+func (s *APIServer) releaseQuota(username string, sizeBytes int64) {
+	user, err := s.store.GetUserByUsername(username)
+	if err == nil {
+		err = s.store.ReleaseUsageBytes(user.ID, sizeBytes)
+	}
+
+	if err != nil {
+		s.log.Error(fmt.Sprintf("error releasing %s of quota for %s: %s", formatBytes(sizeBytes), username, err))
+	}
+}
+
+// Check the user is under their daily upload limit. Imports of old clips aren't held to it.
+func (s *APIServer) checkDailyUploads(user User) error {
+	quota, err := s.userQuota(user)
+	if err != nil || quota.MaxUploadsPerDay == 0 {
+		return err
+	}
+
+	count, err := s.store.CountUploadsSince(user.ID, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	if count >= quota.MaxUploadsPerDay {
+		return &quotaError{
+			Code:    http.StatusTooManyRequests,
+			Message: fmt.Sprintf("daily upload limit reached: %d of %d clips in the last 24 hours", count, quota.MaxUploadsPerDay),
+		}
+	}
+
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Share of a limit used, as a whole percentage. 0 for an unlimited quota.
+func percentOf(used float64, limit float64) int {
+	if limit <= 0 {
+		return 0
+	}
+
+	return int(used / limit * 100)
+}
+
+/*
+ *
+ *
+ * Admin handlers
+ *
+ *
+ */
+
+// Usage of every user against their quota, plus the role quotas
+func (s *APIServer) handleAdminQuotas(w http.ResponseWriter, r *http.Request) error {
+	users, err := s.store.GetAllUsers()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	roleQuotas, err := s.store.GetAllRoleQuotas()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	usages := []UserUsage{}
+	for _, user := range users {
+		quota, err := s.userQuota(user)
+		if err != nil {
+			return errInternal(err)
+		}
+
+		uploads, err := s.store.CountUploadsSince(user.ID, since)
+		if err != nil {
+			return errInternal(err)
+		}
+
+		usages = append(usages, UserUsage{
+			User:           user,
+			Quota:          quota,
+			UploadsToday:   uploads,
+			PercentBytes:   percentOf(float64(user.UsageBytes), float64(quota.MaxBytes)),
+			PercentMinutes: percentOf(user.UsageSeconds, quota.MaxSeconds),
+		})
+	}
+
+	data := struct {
+		Users []UserUsage
+		Roles []Quota
+	}{
+		Users: usages,
+		Roles: roleQuotas,
+	}
+
+	t, err := s.parsePage(r, "./templates/admin/quotas.html", template.FuncMap{
+		"bytes":   formatBytes,
+		"minutes": func(seconds float64) string { return fmt.Sprintf("%.1f", seconds/60) },
+	})
+	if err != nil {
+		return errInternal(err)
+	}
+
+	return renderPage(w, t, data)
+}
+
+// Route for setting a role's quota. Limits are given in MB, minutes and clips per day.
+func (s *APIServer) handleUpdateRoleQuota(w http.ResponseWriter, r *http.Request) error {
+	role := r.PostFormValue("role")
+	if role == "" {
+		return errValidation("role", "is required")
+	}
+
+	quota, err := parseQuotaForm(r)
+	if err != nil {
+		return err
+	}
+	quota.Role = role
+
+	if err := s.store.UpsertRoleQuota(quota); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "quota updated")
+}
+
+// Route for setting a user's quota overrides. A limit of 0 uses the role's quota.
+func (s *APIServer) handleUpdateUserQuota(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.store.GetUserByUsername(r.PostFormValue("username"))
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	quota, err := parseQuotaForm(r)
+	if err != nil {
+		return err
+	}
+
+	user.QuotaBytes = quota.MaxBytes
+	user.QuotaSeconds = quota.MaxSeconds
+	user.QuotaUploadsPerDay = quota.MaxUploadsPerDay
+
+	if err := s.store.UpdateUserQuota(user); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "quota updated")
+}
+
+// Read max_mb, max_minutes and max_uploads_per_day. Blank fields are 0.
+func parseQuotaForm(r *http.Request) (Quota, error) {
+	quota := Quota{}
+
+	if v := r.PostFormValue("max_mb"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb < 0 {
+			return quota, errValidation("max_mb", "is invalid")
+		}
+		quota.MaxBytes = mb << 20
+	}
+
+	if v := r.PostFormValue("max_minutes"); v != "" {
+		minutes, err := strconv.ParseFloat(v, 64)
+		if err != nil || minutes < 0 {
+			return quota, errValidation("max_minutes", "is invalid")
+		}
+		quota.MaxSeconds = minutes * 60
+	}
+
+	if v := r.PostFormValue("max_uploads_per_day"); v != "" {
+		uploads, err := strconv.Atoi(v)
+		if err != nil || uploads < 0 {
+			return quota, errValidation("max_uploads_per_day", "is invalid")
+		}
+		quota.MaxUploadsPerDay = uploads
+	}
+
+	return quota, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token bucket: Burst requests at once, refilled at Rate per second. Each can be
+// overridden with RATE_LIMIT_<NAME>, e.g. RATE_LIMIT_UPLOADS=20/h.
+type ratePolicy struct {
+	Name  string
+	Rate  float64
+	Burst float64
+}
+
+var (
+	// Clip uploads, per user
+	uploadRatePolicy = ratePolicy{Name: "uploads", Rate: 20.0 / 3600, Burst: 20}
+	// Registrations, per IP
+	registerRatePolicy = ratePolicy{Name: "register", Rate: 5.0 / 3600, Burst: 5}
+	// Logins and their callbacks, per IP
+	loginRatePolicy = ratePolicy{Name: "login", Rate: 10.0 / 60, Burst: 10}
+	// Mux webhooks, per IP. Mux sends bursts when many assets change at once.
+	webhookRatePolicy = ratePolicy{Name: "webhook", Rate: 600.0 / 60, Burst: 600}
+)
+
+// Buckets idle this long are full again and can be forgotten
+const rateLimitIdle = 24 * time.Hour
+
+const rateLimitSweepInterval = 10 * time.Minute
+
+// Rejected requests by policy, served with the other metrics at /admin/metrics
+var rateLimitRejected = expvar.NewMap("rate_limit_rejected")
+
+// Where buckets are kept: in memory for a single instance, or in Postgres so every
+// replica shares them. Picked with RATE_LIMIT_STORE=memory|postgres.
+type rateLimitStore interface {
+	// Take a token from a bucket. If none is left, returns how long until there is one.
+	Take(key string, policy ratePolicy) (bool, time.Duration, error)
+
+	// Forget buckets untouched for idle
+	Sweep(idle time.Duration) error
+}
+
+func (s *APIServer) newRateLimitStore() rateLimitStore {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		return &postgresRateLimitStore{store: s.store}
+	}
+
+	return newMemoryRateLimitStore()
+}
+
+// A policy with any RATE_LIMIT_<NAME> override applied. The override is "N/unit", with
+// unit one of s, m, h or d, and N is also the burst.
+func (p ratePolicy) configured() ratePolicy {
+	value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(p.Name))
+	if value == "" {
+		return p
+	}
+
+	count, unit, ok := strings.Cut(value, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || n <= 0 {
+		return p
+	}
+
+	periods := map[string]float64{"s": 1, "m": 60, "h": 3600, "d": 86400}
+	period, ok := periods[unit]
+	if !ok {
+		return p
+	}
+
+	return ratePolicy{Name: p.Name, Rate: n / period, Burst: n}
+}
+
+// How long until a bucket holding tokens has a whole one
+func retryAfter(tokens float64, policy ratePolicy) time.Duration {
+	return time.Duration((1 - tokens) / policy.Rate * float64(time.Second))
+}
+
+// Middleware limiting requests by policy, per user when authenticate found one and per
+// IP otherwise. Rejections get a 429 with Retry-After. If the store fails the request
+// is let through, so an outage of the limiter isn't an outage of the site.
+func (s *APIServer) rateLimit(policy ratePolicy) func(http.Handler) http.Handler {
+	policy = policy.configured()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := policy.Name + ":ip:" + clientIP(r)
+			if user, ok := s.viewer(r); ok {
+				key = policy.Name + ":user:" + user.ID
+			}
+
+			allowed, wait, err := s.rateLimits.Take(key, policy)
+			if err != nil {
+				s.log.Warn(fmt.Sprintf("rate limit %s: %s", policy.Name, err))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !allowed {
+				rateLimitRejected.Add(policy.Name, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				responseWithError(w, http.StatusTooManyRequests, "too many requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Forget idle buckets now and then
+func (s *APIServer) sweepRateLimits() {
+	for range time.Tick(rateLimitSweepInterval) {
+		if err := s.rateLimits.Sweep(rateLimitIdle); err != nil {
+			s.log.Warn(err.Error())
+		}
+	}
+}
+
+/*
+ *
+ *
+ * In-memory store
+ *
+ *
+ */
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (m *memoryRateLimitStore) Take(key string, policy ratePolicy) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: policy.Burst, updatedAt: now}
+		m.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(policy.Burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*policy.Rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, retryAfter(bucket.tokens, policy), nil
+	}
+
+	bucket.tokens--
+	return true, 0, nil
+}
+
+func (m *memoryRateLimitStore) Sweep(idle time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, bucket := range m.buckets {
+		if time.Since(bucket.updatedAt) > idle {
+			delete(m.buckets, key)
+		}
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * Postgres store
+ *
+ *
+ */
+
+type postgresRateLimitStore struct {
+	store Storage
+}
+
+func (p *postgresRateLimitStore) Take(key string, policy ratePolicy) (bool, time.Duration, error) {
+	allowed, tokens, err := p.store.TakeRateLimitToken(key, policy.Rate, policy.Burst)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !allowed {
+		return false, retryAfter(tokens, policy), nil
+	}
+
+	return true, 0, nil
+}
+
+func (p *postgresRateLimitStore) Sweep(idle time.Duration) error {
+	return p.store.DeleteIdleRateLimits(idle)
+}
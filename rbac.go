@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Roles stored in users.role, from least to most trusted
+const (
+	RoleViewer    = "viewer"
+	RoleUploader  = "uploader"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Where a user's role comes from. Manual roles, set by an admin, win over the Discord mapping.
+const (
+	roleSourceDiscord = "discord"
+	roleSourceManual  = "manual"
+)
+
+// Roles in order of trust, for picking the highest of several
+var roleRanks = []string{RoleViewer, RoleUploader, RoleModerator, RoleAdmin}
+
+// Permissions checked by RequirePermission
+const (
+	PermClipsCreate       = "clips:create"
+	PermClipsCreateOthers = "clips:create:others"
+	PermClipsManageOwn    = "clips:manage:own"
+	PermClipsEdit         = "clips:edit"
+	PermClipsDelete       = "clips:delete"
+	PermClipsViewPrivate  = "clips:view:private"
+	PermCaptionsCreate    = "captions:create"
+	PermCaptionsDelete    = "captions:delete"
+	PermDuplicatesResolve = "duplicates:resolve"
+	PermGamesCreate       = "games:create"
+	PermUsersManage       = "users:manage"
+	PermAdminAccess       = "admin:access"
+)
+
+// Permissions granted to each role. Each role has everything the one before it has.
+var rolePermissions = map[string][]string{
+	RoleViewer: {},
+	RoleUploader: {
+		PermClipsCreate, PermCaptionsCreate, PermGamesCreate, PermClipsManageOwn,
+	},
+	RoleModerator: {
+		PermClipsCreate, PermCaptionsCreate, PermGamesCreate, PermClipsManageOwn,
+		PermClipsEdit, PermClipsDelete, PermClipsViewPrivate, PermCaptionsDelete, PermDuplicatesResolve,
+	},
+	RoleAdmin: {
+		PermClipsCreate, PermCaptionsCreate, PermGamesCreate, PermClipsManageOwn,
+		PermClipsEdit, PermClipsDelete, PermClipsViewPrivate, PermCaptionsDelete, PermDuplicatesResolve,
+		PermClipsCreateOthers, PermUsersManage, PermAdminAccess,
+	},
+}
+
+type contextKey string
+
+const authContextKey contextKey = "auth"
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleRank(role string) int {
+	for i, r := range roleRanks {
+		if r == role {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Whether a role grants a permission. Unknown roles grant nothing.
+func hasPermission(role string, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Who a request is from: a user with either a browser session or an API token
+type authInfo struct {
+	User    User
+	Session *Session
+	Token   *APIToken
+}
+
+// Middleware that works out who the request is from, from an API token in the
+// Authorization header or the session JWT, and makes them available through
+// viewer. Anonymous requests are let through; requests with a bad API token are not.
+func (s *APIServer) authenticate(next http.Handler) http.Handler {
+	fromSession := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := s.sessionFromJWT(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := s.store.GetUserByID(session.UserID)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A cookie is sent by the browser whoever made the page, so cookie requests must
+		// prove they came from us. A JWT in the Authorization header can't be forged that
+		// way, but any other Authorization header leaves the cookie in use.
+		if _, fromHeader := sessionJWT(r); !fromHeader {
+			if err := s.checkCSRF(r, session); err != nil {
+				s.log.Warn(fmt.Sprintf("user %s: %s %s rejected: %s", user.Username, r.Method, r.URL.Path, err))
+				responseWithError(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), authContextKey, &authInfo{User: user, Session: &session})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := bearerAPIToken(r)
+		if !ok {
+			fromSession.ServeHTTP(w, r)
+			return
+		}
+
+		token, user, err := s.apiTokenUser(secret)
+		if err != nil {
+			responseWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), authContextKey, &authInfo{User: user, Token: &token})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Middleware that rejects anonymous requests. Must run after authenticate.
+func (s *APIServer) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.viewer(r); !ok {
+			responseWithError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware that rejects the request unless the user's role grants permission
+// and, for API tokens, the token's scopes include it. Must run after authenticate.
+func (s *APIServer) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := s.viewer(r)
+			if !ok {
+				responseWithError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+
+			if !s.can(r, permission) {
+				writeAPIError(w, asAPIError(s.forbid(user, permission)))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Whether the request may do something needing permission
+func (s *APIServer) can(r *http.Request, permission string) bool {
+	auth, ok := r.Context().Value(authContextKey).(*authInfo)
+	if !ok {
+		return false
+	}
+
+	if auth.Token != nil && !auth.Token.hasScope(permission) {
+		return false
+	}
+
+	return hasPermission(auth.User.Role, permission)
+}
+
+// Whether the request may change a clip: its uploader may with clips:manage:own, and
+// anyone else needs permission
+func (s *APIServer) canModifyClip(r *http.Request, clip Clip, permission string) bool {
+	viewer, ok := s.viewer(r)
+	if !ok {
+		return false
+	}
+
+	if clip.UserID == viewer.ID && s.can(r, PermClipsManageOwn) {
+		return true
+	}
+
+	return s.can(r, permission)
+}
+
+// Refuse a request the user isn't allowed to make. Every refusal looks the same.
+func (s *APIServer) forbid(user User, action string) error {
+	s.log.Warn(fmt.Sprintf("user %s (%s) denied %s", user.Username, user.Role, action))
+	return errForbidden("forbidden")
+}
+
+// The user the request is from, if authenticate found one
+func (s *APIServer) viewer(r *http.Request) (User, bool) {
+	return userFromContext(r.Context())
+}
+
+func userFromContext(ctx context.Context) (User, bool) {
+	auth, ok := ctx.Value(authContextKey).(*authInfo)
+	if !ok {
+		return User{}, false
+	}
+
+	return auth.User, true
+}
+
+// Change a user's role and record who did it. Does nothing if neither the role nor its source changes.
+func (s *APIServer) setUserRole(user User, role string, source string, changedBy string) error {
+	if user.Role == role && user.RoleSource == source {
+		return nil
+	}
+
+	return s.store.UpdateUserRole(RoleChange{
+		UserID:     user.ID,
+		OldRole:    user.Role,
+		NewRole:    role,
+		RoleSource: source,
+		ChangedBy:  changedBy,
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/majesticbeast/lostsons.tv/mux"
+)
+
+const defaultReconcileMinAge = time.Hour
+
+type ReconcileOptions struct {
+	// Report drift without changing anything
+	DryRun bool `json:"dry_run"`
+	// Queue cleanup jobs for orphaned Mux assets and bucket objects
+	DeleteOrphans bool `json:"delete_orphans"`
+	// Re-create clips rows for orphaned assets whose upload metadata is still in the jobs table
+	RecreateRows bool `json:"recreate_rows"`
+	// Ignore anything younger than this; it may still be moving through the upload pipeline
+	MinAge time.Duration `json:"min_age"`
+}
+
+type ReconcileReport struct {
+	StartedAt        time.Time `json:"started_at"`
+	DryRun           bool      `json:"dry_run"`
+	OrphanAssets     []string  `json:"orphan_assets"`
+	OrphanObjects    []string  `json:"orphan_objects"`
+	MissingAssets    []string  `json:"missing_assets"`
+	MissingObjects   []string  `json:"missing_objects"`
+	DeletedAssets    []string  `json:"deleted_assets"`
+	DeletedObjects   []string  `json:"deleted_objects"`
+	RecreatedAssets  []string  `json:"recreated_assets"`
+	UntrackedClips   int       `json:"untracked_clips"`
+	Errors           []string  `json:"errors"`
+	ObjectsProtected bool      `json:"objects_protected"`
+}
+
+// Compare Mux assets and bucket objects against the clips table, report drift and,
+// unless this is a dry run, repair what it safely can.
+//
+// Orphan deletion goes through cleanup jobs so it is retried like any other cleanup.
+// Clips uploaded before object keys were recorded have an empty object_key; while any
+// exist, orphan objects are reported but never deleted, since they may be those files.
+func (s *APIServer) reconcile(opts ReconcileOptions) (ReconcileReport, error) {
+	report := ReconcileReport{
+		StartedAt:       time.Now(),
+		DryRun:          opts.DryRun,
+		OrphanAssets:    []string{},
+		OrphanObjects:   []string{},
+		MissingAssets:   []string{},
+		MissingObjects:  []string{},
+		DeletedAssets:   []string{},
+		DeletedObjects:  []string{},
+		RecreatedAssets: []string{},
+		Errors:          []string{},
+	}
+	cutoff := report.StartedAt.Add(-opts.MinAge)
+
+	clips, err := s.store.GetAllClips()
+	if err != nil {
+		return report, fmt.Errorf("error getting clips: %w", err)
+	}
+
+	captions, err := s.store.GetAllCaptions()
+	if err != nil {
+		return report, fmt.Errorf("error getting captions: %w", err)
+	}
+
+	clipAssets := map[string]Clip{}
+	for _, clip := range clips {
+		clipAssets[clip.AssetID] = clip
+		if clip.ObjectKey == "" {
+			report.UntrackedClips++
+		}
+	}
+	report.ObjectsProtected = report.UntrackedClips > 0
+	referenced := referencedObjects(clips, captions)
+
+	client := mux.NewMuxClient()
+	assets, err := mux.ListAllAssets(client)
+	if err != nil {
+		return report, fmt.Errorf("error listing mux assets: %w", err)
+	}
+
+	sess, err := NewDigitalOceanSession()
+	if err != nil {
+		return report, err
+	}
+
+	svc, err := NewS3Client(sess)
+	if err != nil {
+		return report, err
+	}
+
+	objects, err := ListSpacesObjects(svc)
+	if err != nil {
+		return report, err
+	}
+
+	// Assets and objects nobody refers to
+	liveAssets := map[string]bool{}
+	for _, asset := range assets {
+		liveAssets[asset.Id] = true
+
+		if _, ok := clipAssets[asset.Id]; ok {
+			continue
+		}
+
+		createdAt, err := strconv.ParseInt(asset.CreatedAt, 10, 64)
+		if err == nil && time.Unix(createdAt, 0).After(cutoff) {
+			continue
+		}
+
+		report.OrphanAssets = append(report.OrphanAssets, asset.Id)
+		if opts.DryRun {
+			continue
+		}
+
+		if opts.RecreateRows && asset.Passthrough != "" && len(asset.PlaybackIds) > 0 {
+			err := s.recreateClipRow(asset.Id, asset.PlaybackIds[0].Id, asset.Passthrough)
+			if err == nil {
+				report.RecreatedAssets = append(report.RecreatedAssets, asset.Id)
+				referenced[asset.Passthrough] = true
+				continue
+			}
+			report.Errors = append(report.Errors, err.Error())
+		}
+
+		if opts.DeleteOrphans {
+			if _, err := s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{AssetID: asset.Id}); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			report.DeletedAssets = append(report.DeletedAssets, asset.Id)
+		}
+	}
+
+	liveObjects := map[string]bool{}
+	for _, object := range objects {
+		liveObjects[*object.Key] = true
+	}
+
+	for _, key := range orphanObjects(objects, referenced, cutoff) {
+		report.OrphanObjects = append(report.OrphanObjects, key)
+		if opts.DryRun || !opts.DeleteOrphans || report.ObjectsProtected {
+			continue
+		}
+
+		if _, err := s.enqueueJob(jobTypeCleanup, defaultJobQueue, cleanupJobPayload{ObjectKey: key}); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.DeletedObjects = append(report.DeletedObjects, key)
+	}
+
+	// Clips pointing at things that no longer exist
+	for _, clip := range clips {
+		if !liveAssets[clip.AssetID] {
+			report.MissingAssets = append(report.MissingAssets, clip.ID)
+		}
+		if clip.ObjectKey != "" && !liveObjects[clip.ObjectKey] {
+			report.MissingObjects = append(report.MissingObjects, clip.ID)
+		}
+	}
+
+	return report, nil
+}
+
+// Bucket keys the database refers to: clip uploads and caption files
+func referencedObjects(clips []Clip, captions []Caption) map[string]bool {
+	referenced := map[string]bool{}
+	for _, clip := range clips {
+		if clip.ObjectKey != "" {
+			referenced[clip.ObjectKey] = true
+		}
+	}
+
+	for _, caption := range captions {
+		if caption.ObjectKey != "" {
+			referenced[caption.ObjectKey] = true
+		}
+	}
+
+	return referenced
+}
+
+// Keys of the objects last modified before cutoff that nothing refers to
+func orphanObjects(objects []*s3.Object, referenced map[string]bool, cutoff time.Time) []string {
+	orphans := []string{}
+	for _, object := range objects {
+		if referenced[*object.Key] {
+			continue
+		}
+
+		if object.LastModified != nil && object.LastModified.After(cutoff) {
+			continue
+		}
+
+		orphans = append(orphans, *object.Key)
+	}
+
+	return orphans
+}
+
+// Re-insert the clips row for an asset using the metadata from its create_asset job
+func (s *APIServer) recreateClipRow(assetID string, playbackID string, objectKey string) error {
+	job, err := s.store.GetLatestJobForObjectKey(jobTypeCreateAsset, objectKey)
+	if err != nil {
+		return fmt.Errorf("no upload metadata for asset %s: %w", assetID, err)
+	}
+
+	payload := createAssetJobPayload{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("error unmarshalling create_asset payload: %w", err)
+	}
+
+	clip := Clip{
+		PlaybackID:    playbackID,
+		AssetID:       assetID,
+		ObjectKey:     objectKey,
+		ContentHash:   payload.ContentHash,
+		SizeBytes:     payload.SizeBytes,
+		Description:   payload.Form.Description,
+		Game:          payload.Form.Game,
+		Username:      payload.Form.Username,
+		Tags:          payload.Form.Tags,
+		FeaturedUsers: payload.Form.FeaturedUsers,
+		Visibility:    payload.Form.Visibility,
+		Downloadable:  payload.Form.Downloadable,
+		DateUploaded:  payload.DateUploaded,
+	}
+
+	if err := s.store.CreateClip(clip); err != nil {
+		return fmt.Errorf("error re-creating clip for asset %s: %w", assetID, err)
+	}
+
+	return nil
+}
+
+// Reconcile as a job, then schedule the next run
+func (s *APIServer) handleReconcileJob(job Job) error {
+	opts := ReconcileOptions{}
+	if err := json.Unmarshal(job.Payload, &opts); err != nil {
+		return fmt.Errorf("error unmarshalling reconcile payload: %w", err)
+	}
+
+	report, err := s.reconcile(opts)
+	if err != nil {
+		return err
+	}
+	s.logReconcileReport(report)
+
+	if interval := reconcileInterval(); interval > 0 {
+		if _, err := s.enqueueJobAfter(jobTypeReconcile, defaultJobQueue, opts, interval); err != nil {
+			s.log.Error(err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Make sure a reconcile job is queued when RECONCILE_INTERVAL is set. The job janitor
+// calls this every minute, so one failed run doesn't end the schedule.
+func (s *APIServer) scheduleReconcile() {
+	if reconcileInterval() <= 0 {
+		return
+	}
+
+	pending, err := s.store.HasPendingJob(jobTypeReconcile)
+	if err != nil {
+		s.log.Warn(err.Error())
+		return
+	}
+
+	if pending {
+		return
+	}
+
+	if _, err := s.enqueueJob(jobTypeReconcile, defaultJobQueue, scheduledReconcileOptions()); err != nil {
+		s.log.Warn(err.Error())
+	}
+}
+
+func (s *APIServer) logReconcileReport(report ReconcileReport) {
+	s.log.Info(fmt.Sprintf("reconcile (dry run: %t): %d orphan assets, %d orphan objects, %d clips missing assets, %d clips missing objects, %d assets and %d objects queued for deletion, %d clips re-created",
+		report.DryRun, len(report.OrphanAssets), len(report.OrphanObjects), len(report.MissingAssets), len(report.MissingObjects),
+		len(report.DeletedAssets), len(report.DeletedObjects), len(report.RecreatedAssets)))
+
+	if report.ObjectsProtected && len(report.OrphanObjects) > 0 {
+		s.log.Warn(fmt.Sprintf("reconcile: %d clips have no recorded object key, orphan objects were not deleted", report.UntrackedClips))
+	}
+
+	for _, msg := range report.Errors {
+		s.log.Warn("reconcile: " + msg)
+	}
+}
+
+func reconcileInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL"))
+	if err != nil {
+		return 0
+	}
+
+	return interval
+}
+
+// Scheduled runs only report unless repairs are switched on explicitly
+func scheduledReconcileOptions() ReconcileOptions {
+	opts := ReconcileOptions{
+		DeleteOrphans: os.Getenv("RECONCILE_DELETE_ORPHANS") == "true",
+		RecreateRows:  os.Getenv("RECONCILE_RECREATE_ROWS") == "true",
+		MinAge:        defaultReconcileMinAge,
+	}
+	opts.DryRun = !opts.DeleteOrphans && !opts.RecreateRows
+
+	return opts
+}
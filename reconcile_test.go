@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCaptionObjectsAreNotOrphans(t *testing.T) {
+	clips := []Clip{{ID: "clip-1", ObjectKey: "clips/clip-1.mp4"}, {ID: "clip-2"}}
+	captions := []Caption{{ID: "caption-1", ClipID: "clip-1", ObjectKey: "captions/clip-1/caption-1.vtt"}}
+
+	old := aws.Time(time.Now().Add(-24 * time.Hour))
+	objects := []*s3.Object{
+		{Key: aws.String("clips/clip-1.mp4"), LastModified: old},
+		{Key: aws.String("captions/clip-1/caption-1.vtt"), LastModified: old},
+		{Key: aws.String("captions/clip-9/caption-9.vtt"), LastModified: old},
+		{Key: aws.String("clips/orphan.mp4"), LastModified: old},
+		{Key: aws.String("clips/new.mp4"), LastModified: aws.Time(time.Now())},
+	}
+
+	got := orphanObjects(objects, referencedObjects(clips, captions), time.Now().Add(-defaultReconcileMinAge))
+	want := []string{"captions/clip-9/caption-9.vtt", "clips/orphan.mp4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("orphans = %v, want %v", got, want)
+	}
+}
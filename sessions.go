@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Name of the session cookie holding the JWT
+	sessionCookie = "jwt"
+
+	sessionTTL = 7 * 24 * time.Hour
+
+	// last_seen_at is only written when it is older than this, not on every request
+	sessionTouchInterval = 5 * time.Minute
+)
+
+// Start a session for a user who just logged in and set its cookie. The Discord
+// token, if they logged in with Discord, is kept encrypted with the session rather
+// than in the cookie.
+func (s *APIServer) createSession(w http.ResponseWriter, r *http.Request, user User, token *oauth2.Token) error {
+	if err := s.store.DeleteDeadSessions(user.ID); err != nil {
+		s.log.Warn(err.Error())
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		return fmt.Errorf("error generating session id: %w", err)
+	}
+
+	var discordToken []byte
+	if token != nil {
+		tokenJSON, err := json.Marshal(token)
+		if err != nil {
+			return fmt.Errorf("error marshalling discord token: %w", err)
+		}
+
+		discordToken, err = encryptSecret(tokenJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	userAgent := truncate(r.UserAgent(), 255)
+
+	session := Session{
+		ID:           id,
+		UserID:       user.ID,
+		DiscordToken: discordToken,
+		UserAgent:    userAgent,
+		IP:           clientIP(r),
+		ExpiresAt:    time.Now().Add(sessionTTL),
+	}
+
+	if err := s.store.CreateSession(session); err != nil {
+		return err
+	}
+
+	jwtString, err := jwtKeys().sign(jwt.MapClaims{
+		"typ":      jwtTypeSession,
+		"sid":      session.ID,
+		"user_id":  user.ID,
+		"username": user.Username,
+		"exp":      session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Create and set the JWT as a secure cookie. Lax so it survives the redirect back
+	// from Discord at the end of login; forms are guarded by the session's CSRF token
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    jwtString,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// The browser session the request is from, if any. API token requests have none.
+func (s *APIServer) currentSession(r *http.Request) (Session, bool) {
+	auth, ok := r.Context().Value(authContextKey).(*authInfo)
+	if !ok || auth.Session == nil {
+		return Session{}, false
+	}
+
+	return *auth.Session, true
+}
+
+// The session JWT from an "Authorization: Bearer" header or, failing that, the session
+// cookie, and whether it came from the header
+func sessionJWT(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "BEARER ") {
+		return strings.TrimSpace(header[7:]), true
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value, false
+	}
+
+	return "", false
+}
+
+// The session named by the request's JWT, if it is still active
+func (s *APIServer) sessionFromJWT(r *http.Request) (Session, bool) {
+	value, _ := sessionJWT(r)
+	if value == "" {
+		return Session{}, false
+	}
+
+	claims, err := jwtKeys().parse(value, jwtTypeSession)
+	if err != nil {
+		return Session{}, false
+	}
+
+	sid, ok := claims["sid"].(string)
+	if !ok {
+		return Session{}, false
+	}
+
+	session, err := s.store.GetSession(sid)
+	if err != nil {
+		return Session{}, false
+	}
+
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return Session{}, false
+	}
+
+	if userID, _ := claims["user_id"].(string); userID != session.UserID {
+		return Session{}, false
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if err := s.store.TouchSession(session.ID); err != nil {
+			s.log.Warn(err.Error())
+		}
+	}
+
+	return session, true
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// AES-256-GCM key for secrets stored with sessions, from SESSION_ENCRYPTION_KEY
+// or, if that isn't set, JWT_SECRET
+func sessionEncryptionKey() []byte {
+	secret := os.Getenv("SESSION_ENCRYPTION_KEY")
+	if secret == "" {
+		secret = os.Getenv("JWT_SECRET")
+	}
+
+	key := sha256.Sum256([]byte("lostsons.tv session:" + secret))
+	return key[:]
+}
+
+// Encrypt with AES-GCM; the nonce is prepended to the ciphertext
+func encryptSecret(plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(sessionEncryptionKey())
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcm: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptSecret(ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(sessionEncryptionKey())
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcm: %w", err)
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting secret: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// Proxies allowed to say who the client is, from TRUSTED_PROXIES: comma-separated
+// IPs or CIDRs, e.g. the load balancer's "10.244.0.0/16". Empty trusts none.
+func trustedProxies() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, value := range splitEnvList("TRUSTED_PROXIES") {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		if _, ipNet, err := net.ParseCIDR(value); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+
+	return nets
+}
+
+func isTrustedProxy(ip string, proxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, ipNet := range proxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The client's address. X-Forwarded-For is only read when the connection is from a
+// trusted proxy, and then from the right: each proxy appends the address it saw, so
+// the right-most hop that isn't one of ours is the first a client couldn't forge.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	proxies := trustedProxies()
+	if !isTrustedProxy(ip, proxies) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		if !isTrustedProxy(hop, proxies) {
+			return hop
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+/*
+ *
+ *
+ * Handlers
+ *
+ *
+ */
+
+// Route for logging out: revokes the current session and clears the cookie
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	if session, ok := s.currentSession(r); ok {
+		if err := s.store.RevokeSession(session.ID); err != nil {
+			return err
+		}
+	}
+
+	clearSessionCookie(w)
+
+	return responseWithJSON(w, http.StatusOK, "logged out")
+}
+
+// Route for listing the logged in user's active sessions
+func (s *APIServer) handleGetSessions(w http.ResponseWriter, r *http.Request) error {
+	current, ok := s.currentSession(r)
+	if !ok {
+		return errUnauthorized()
+	}
+
+	sessions, err := s.store.GetUserSessions(current.UserID)
+	if err != nil {
+		return err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current.ID
+	}
+
+	return responseWithJSON(w, http.StatusOK, sessions)
+}
+
+// Route for revoking one of the logged in user's sessions, e.g. a lost device
+func (s *APIServer) handleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	current, ok := s.currentSession(r)
+	if !ok {
+		return errUnauthorized()
+	}
+
+	session, err := s.store.GetSession(r.PostFormValue("id"))
+	if err != nil || session.UserID != current.UserID {
+		return errNotFound("session")
+	}
+
+	if err := s.store.RevokeSession(session.ID); err != nil {
+		return err
+	}
+
+	if session.ID == current.ID {
+		clearSessionCookie(w)
+	}
+
+	return responseWithJSON(w, http.StatusOK, "session revoked")
+}
+
+// Admin route for revoking every session of a user, logging them out everywhere
+func (s *APIServer) handleRevokeUserSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.store.GetUserByUsername(r.PostFormValue("username"))
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	count, err := s.store.RevokeUserSessions(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, fmt.Sprintf("revoked %d sessions", count))
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -18,15 +21,95 @@ type Storage interface {
 	DeleteClipsTagsClipID(string) error
 	CreateClip(Clip) error
 	GetClip(string) (Clip, error)
+	GetClipByAssetID(string) (Clip, error)
+	UpdateClipMP4Rendition(string, string) error
+	GetClipByContentHash(string) (Clip, error)
+	UpdateClipFingerprint(string, string) error
+	CreateClipDuplicate(ClipDuplicate) error
+	GetClipDuplicate(string) (ClipDuplicate, error)
+	GetAllClipDuplicates() ([]ClipDuplicate, error)
+	GetPendingClipDuplicatesForUploader(string) ([]ClipDuplicate, error)
+	UpdateClipDuplicateStatus(string, string) error
+	DeleteClipDuplicatesClipID(string) error
+	CreateCaption(Caption) error
+	GetCaption(string) (Caption, error)
+	GetClipCaptions(string) ([]Caption, error)
+	GetCaptionsForClips([]string) ([]Caption, error)
+	GetAllCaptions() ([]Caption, error)
+	DeleteCaption(string) error
+	DeleteClipCaptionsClipID(string) error
 	GetAllClips() ([]Clip, error)
+	GetUserClips(string) ([]Clip, error)
+	GetClipsFeaturingUser(string) ([]Clip, error)
+	GetGameClips(string) ([]Clip, error)
+	GetClipPages(ClipPageQuery) (map[string]ClipPage, error)
+	CountListedClips(ClipPageQuery) (map[string]int, error)
+	GetListedTags(ClipPageQuery) ([]string, error)
+	GetClipFeatures([]string) (map[string][]string, error)
+	UpdateClipTags(string, []string) error
 	CreateUser(User) error
 	DeleteUser(User) error
 	GetAllUsers() ([]User, error)
+	GetUserByID(string) (User, error)
+	GetUsersByIDs([]string) ([]User, error)
+	GetUserByDiscordID(string) (User, error)
 	GetUserByUsername(string) (User, error)
 	GetUserByEmail(string) (User, error)
+	UpdateUserQuota(User) error
+	UpdateUserRole(RoleChange) error
+	GetRoleChanges(int) ([]RoleChange, error)
+	UpdateUserDiscordProfile(User) error
+	GetRoleQuota(string) (Quota, error)
+	GetAllRoleQuotas() ([]Quota, error)
+	UpsertRoleQuota(Quota) error
+	RecordUpload(string, int64) error
+	ReserveUsageBytes(string, int64, int64) (bool, error)
+	ReleaseUsageBytes(string, int64) error
+	CountUploadsSince(string, time.Time) (int, error)
+	UpdateClipDuration(string, float64) error
+	UpdateClipDetails(string, string, string) error
 	CreateGame(Game) error
 	GetAllGames() ([]Game, error)
 	GetGameByName(string) (Game, error)
+	GetGame(string) (Game, error)
+	EnqueueJob(Job) (string, error)
+	ClaimJob([]string) (Job, error)
+	CompleteJob(string) error
+	RetryJob(string, time.Duration, string) error
+	DeadLetterJob(string, string) error
+	RequeueStaleJobs(time.Duration) (int64, error)
+	DeadLetterStaleJobs(time.Duration) ([]Job, error)
+	TouchJob(string) error
+	HasPendingJob(string) (bool, error)
+	CreateSession(Session) error
+	GetSession(string) (Session, error)
+	GetUserSessions(string) ([]Session, error)
+	GetUserIDsWithAccess() ([]string, error)
+	UpdateSessionDiscordToken(string, []byte) error
+	TouchSession(string) error
+	RevokeSession(string) error
+	RevokeUserSessions(string) (int64, error)
+	DeleteDeadSessions(string) error
+	CreateAPIToken(APIToken) error
+	GetAPIToken(string) (APIToken, error)
+	GetAPITokenByHash(string) (APIToken, error)
+	GetUserAPITokens(string) ([]APIToken, error)
+	TouchAPIToken(string) error
+	RevokeAPIToken(string) error
+	RevokeUserAPITokens(string) (int64, error)
+	CreateInvite(Invite) error
+	GetInvite(string) (Invite, error)
+	GetAllInvites() ([]Invite, error)
+	GetAllInviteRedemptions() ([]InviteRedemption, error)
+	RevokeInvite(string) error
+	CreateUserWithInvite(User, string) (User, error)
+	SaveUserIdentity(UserIdentity) error
+	GetUserByIdentity(string, string) (User, error)
+	GetUserIdentities(string) ([]UserIdentity, error)
+	DeleteUserIdentity(string, string) error
+	TakeRateLimitToken(string, float64, float64) (bool, float64, error)
+	DeleteIdleRateLimits(time.Duration) error
+	GetLatestJobForObjectKey(string, string) (Job, error)
 }
 
 type PostgresStore struct {
@@ -68,6 +151,11 @@ func (s *PostgresStore) Init() error {
 		return err
 	}
 
+	err = s.migrateUsersTable()
+	if err != nil {
+		return err
+	}
+
 	err = s.createTagsTable()
 	if err != nil {
 		return err
@@ -78,6 +166,11 @@ func (s *PostgresStore) Init() error {
 		return err
 	}
 
+	err = s.migrateClipsTable()
+	if err != nil {
+		return err
+	}
+
 	err = s.createClipsTagsTable()
 	if err != nil {
 		return err
@@ -88,6 +181,61 @@ func (s *PostgresStore) Init() error {
 		return err
 	}
 
+	err = s.createJobsTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createClipCaptionsTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createClipDuplicatesTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createRoleQuotasTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createUserUploadsTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createSessionsTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createRoleChangesTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createAPITokensTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createInvitesTables()
+	if err != nil {
+		return err
+	}
+
+	err = s.createUserIdentitiesTable()
+	if err != nil {
+		return err
+	}
+
+	err = s.createRateLimitsTable()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -100,6 +248,14 @@ func (s *PostgresStore) createClipsTable() error {
 		user_id varchar(128) NOT NULL,
 		game_id varchar(128) NOT NULL,
 		description varchar(120) NOT NULL,
+		object_key varchar(200) NOT NULL DEFAULT '',
+		visibility varchar(10) NOT NULL DEFAULT 'public',
+		mp4_support boolean NOT NULL DEFAULT false,
+		mp4_rendition varchar(20) NOT NULL DEFAULT '',
+		content_hash varchar(64) NOT NULL DEFAULT '',
+		fingerprint varchar(80) NOT NULL DEFAULT '',
+		size_bytes bigint NOT NULL DEFAULT 0,
+		duration_seconds double precision NOT NULL DEFAULT 0,
 		PRIMARY KEY (id),
 		CONSTRAINT fk_game_id FOREIGN KEY (game_id) REFERENCES games(id),
 		CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id)
@@ -109,6 +265,34 @@ func (s *PostgresStore) createClipsTable() error {
 	return err
 }
 
+// Columns added to clips after the table was first created
+func (s *PostgresStore) migrateClipsTable() error {
+	queries := []string{
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS object_key varchar(200) NOT NULL DEFAULT ''`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS visibility varchar(10) NOT NULL DEFAULT 'public'`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS mp4_support boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS mp4_rendition varchar(20) NOT NULL DEFAULT ''`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS content_hash varchar(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS fingerprint varchar(80) NOT NULL DEFAULT ''`,
+		`CREATE INDEX IF NOT EXISTS clips_content_hash_idx ON clips (content_hash)`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS size_bytes bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE clips ADD COLUMN IF NOT EXISTS duration_seconds double precision NOT NULL DEFAULT 0`,
+		// Users' usage was only counted from when their columns were added, so total up
+		// the clips of anyone still at zero
+		`UPDATE users u SET usage_bytes = c.bytes, usage_seconds = c.seconds
+		FROM (SELECT user_id, SUM(size_bytes) AS bytes, SUM(duration_seconds) AS seconds FROM clips GROUP BY user_id) c
+		WHERE u.id = c.user_id AND u.usage_bytes = 0 AND u.usage_seconds = 0`,
+	}
+
+	for _, query := range queries {
+		if _, err := s.db.Exec(context.Background(), query); err != nil {
+			return fmt.Errorf("error migrating clips table: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (s *PostgresStore) createTagsTable() error {
 	query := `CREATE TABLE IF NOT EXISTS tags (
 		id varchar(128) UNIQUE NOT NULL,
@@ -135,14 +319,55 @@ func (s *PostgresStore) createUsersTable() error {
 	query := `CREATE TABLE IF NOT EXISTS users (
 		id varchar(128) UNIQUE NOT NULL,
 		username varchar(35) UNIQUE NOT NULL,
-		email varchar(60) UNIQUE NOT NULL,
-		role varchar(10) DEFAULT 'user'
+		email varchar(60) UNIQUE,
+		role varchar(10) DEFAULT 'viewer',
+		usage_bytes bigint NOT NULL DEFAULT 0,
+		usage_seconds double precision NOT NULL DEFAULT 0,
+		quota_bytes bigint NOT NULL DEFAULT 0,
+		quota_seconds double precision NOT NULL DEFAULT 0,
+		quota_uploads_per_day integer NOT NULL DEFAULT 0,
+		discord_id varchar(32) UNIQUE,
+		display_name varchar(64) NOT NULL DEFAULT '',
+		avatar varchar(64) NOT NULL DEFAULT '',
+		role_source varchar(10) NOT NULL DEFAULT 'discord'
 	)`
 
 	_, err := s.db.Exec(context.Background(), query)
 	return err
 }
 
+// Columns added to users after the table was first created
+func (s *PostgresStore) migrateUsersTable() error {
+	queries := []string{
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS usage_bytes bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS usage_seconds double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_bytes bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_seconds double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_uploads_per_day integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ALTER COLUMN role SET DEFAULT 'viewer'`,
+		// Everyone could upload before roles existed
+		`UPDATE users SET role = 'uploader' WHERE role IS NULL OR role IN ('', 'user')`,
+		// Existing rows are linked to their Discord account on first login by verified email, or by the link-discord command
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS discord_id varchar(32) UNIQUE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name varchar(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar varchar(64) NOT NULL DEFAULT ''`,
+		// Roles given before the Discord mapping existed are kept as manual ones
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role_source varchar(10) NOT NULL DEFAULT 'manual'`,
+		`ALTER TABLE users ALTER COLUMN role_source SET DEFAULT 'discord'`,
+		// Steam doesn't give us an email address
+		`ALTER TABLE users ALTER COLUMN email DROP NOT NULL`,
+		`UPDATE users SET email = NULL WHERE email = ''`,
+	}
+
+	for _, query := range queries {
+		if _, err := s.db.Exec(context.Background(), query); err != nil {
+			return fmt.Errorf("error migrating users table: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (s *PostgresStore) createGamesTable() error {
 	query := `CREATE TABLE IF NOT EXISTS games (
 		id varchar(128) UNIQUE NOT NULL,
@@ -165,6 +390,271 @@ func (s *PostgresStore) createClipsUsersTable() error {
 	return err
 }
 
+func (s *PostgresStore) createJobsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS jobs (
+		id varchar(128) UNIQUE NOT NULL,
+		type varchar(40) NOT NULL,
+		queue varchar(128) NOT NULL DEFAULT 'default',
+		payload jsonb NOT NULL DEFAULT '{}',
+		status varchar(20) NOT NULL DEFAULT 'queued',
+		attempts integer NOT NULL DEFAULT 0,
+		max_attempts integer NOT NULL DEFAULT 8,
+		run_at timestamptz NOT NULL DEFAULT now(),
+		locked_at timestamptz,
+		last_error text NOT NULL DEFAULT '',
+		created_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (id)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	// Job times used to be timestamps without a time zone, so times from the app and
+	// from now() disagreed unless the session was in UTC. Altering a column to the type
+	// it already has changes nothing.
+	timesQuery := `ALTER TABLE jobs
+		ALTER COLUMN run_at TYPE timestamptz,
+		ALTER COLUMN locked_at TYPE timestamptz,
+		ALTER COLUMN created_at TYPE timestamptz`
+	_, err = s.db.Exec(context.Background(), timesQuery)
+	if err != nil {
+		return err
+	}
+
+	indexQuery := `CREATE INDEX IF NOT EXISTS jobs_status_run_at_idx ON jobs (status, run_at)`
+	_, err = s.db.Exec(context.Background(), indexQuery)
+	if err != nil {
+		return err
+	}
+
+	// Uploads used to be staged on the receiving host's disk for an ingest job. Those
+	// jobs can't be run anywhere else, so stop them waiting forever.
+	ingestQuery := `UPDATE jobs SET status = 'dead', locked_at = NULL, last_error = 'ingest jobs are no longer run'
+	WHERE type = 'ingest' AND status IN ('queued', 'running')`
+	_, err = s.db.Exec(context.Background(), ingestQuery)
+	return err
+}
+
+func (s *PostgresStore) createSessionsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS sessions (
+		id varchar(128) UNIQUE NOT NULL,
+		user_id varchar(128) NOT NULL,
+		discord_token bytea,
+		user_agent varchar(255) NOT NULL DEFAULT '',
+		ip varchar(64) NOT NULL DEFAULT '',
+		created_at timestamp NOT NULL DEFAULT now(),
+		last_seen_at timestamp NOT NULL DEFAULT now(),
+		expires_at timestamp NOT NULL,
+		revoked_at timestamp,
+		PRIMARY KEY (id)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	indexQuery := `CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id)`
+	_, err = s.db.Exec(context.Background(), indexQuery)
+	return err
+}
+
+func (s *PostgresStore) createRoleChangesTable() error {
+	query := `CREATE TABLE IF NOT EXISTS role_changes (
+		id varchar(128) UNIQUE NOT NULL,
+		user_id varchar(128) NOT NULL,
+		old_role varchar(10) NOT NULL,
+		new_role varchar(10) NOT NULL,
+		role_source varchar(10) NOT NULL,
+		changed_by varchar(64) NOT NULL,
+		created_at timestamp NOT NULL DEFAULT now(),
+		PRIMARY KEY (id)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	return err
+}
+
+func (s *PostgresStore) createAPITokensTable() error {
+	query := `CREATE TABLE IF NOT EXISTS api_tokens (
+		id varchar(128) UNIQUE NOT NULL,
+		user_id varchar(128) NOT NULL,
+		name varchar(60) NOT NULL,
+		token_hash varchar(64) UNIQUE NOT NULL,
+		scopes text[] NOT NULL DEFAULT '{}',
+		created_at timestamp NOT NULL DEFAULT now(),
+		expires_at timestamp NOT NULL,
+		last_used_at timestamp,
+		revoked_at timestamp,
+		PRIMARY KEY (id)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	indexQuery := `CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id)`
+	_, err = s.db.Exec(context.Background(), indexQuery)
+	return err
+}
+
+func (s *PostgresStore) createRateLimitsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS rate_limits (
+		key varchar(200) NOT NULL,
+		tokens double precision NOT NULL,
+		allowed boolean NOT NULL DEFAULT true,
+		updated_at timestamp NOT NULL DEFAULT now(),
+		PRIMARY KEY (key)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	return err
+}
+
+func (s *PostgresStore) createUserIdentitiesTable() error {
+	query := `CREATE TABLE IF NOT EXISTS user_identities (
+		provider varchar(20) NOT NULL,
+		subject varchar(64) NOT NULL,
+		user_id varchar(128) NOT NULL,
+		username varchar(64) NOT NULL DEFAULT '',
+		created_at timestamp NOT NULL DEFAULT now(),
+		PRIMARY KEY (provider, subject),
+		CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	indexQuery := `CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id)`
+	_, err = s.db.Exec(context.Background(), indexQuery)
+	return err
+}
+
+func (s *PostgresStore) createInvitesTables() error {
+	query := `CREATE TABLE IF NOT EXISTS invites (
+		code varchar(20) UNIQUE NOT NULL,
+		role varchar(10) NOT NULL DEFAULT '',
+		max_uses integer NOT NULL DEFAULT 1,
+		uses integer NOT NULL DEFAULT 0,
+		expires_at timestamp NOT NULL,
+		created_by varchar(128) NOT NULL,
+		created_at timestamp NOT NULL DEFAULT now(),
+		revoked_at timestamp,
+		PRIMARY KEY (code)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	redemptionsQuery := `CREATE TABLE IF NOT EXISTS invite_redemptions (
+		invite_code varchar(20) NOT NULL,
+		user_id varchar(128) NOT NULL,
+		redeemed_at timestamp NOT NULL DEFAULT now(),
+		CONSTRAINT fk_invite_code FOREIGN KEY (invite_code) REFERENCES invites(code)
+	)`
+
+	_, err = s.db.Exec(context.Background(), redemptionsQuery)
+	return err
+}
+
+func (s *PostgresStore) createClipCaptionsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS clip_captions (
+		id varchar(128) UNIQUE NOT NULL,
+		clip_id varchar(128) NOT NULL,
+		language_code varchar(35) NOT NULL,
+		name varchar(60) NOT NULL DEFAULT '',
+		closed_captions boolean NOT NULL DEFAULT false,
+		object_key varchar(200) NOT NULL,
+		track_id varchar(200) NOT NULL,
+		created_at timestamp NOT NULL DEFAULT now(),
+		PRIMARY KEY (id),
+		CONSTRAINT fk_clip_id FOREIGN KEY (clip_id) REFERENCES clips(id)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	return err
+}
+
+func (s *PostgresStore) createClipDuplicatesTable() error {
+	query := `CREATE TABLE IF NOT EXISTS clip_duplicates (
+		id varchar(128) UNIQUE NOT NULL,
+		clip_id varchar(128) NOT NULL,
+		duplicate_of varchar(128) NOT NULL,
+		distance integer NOT NULL,
+		status varchar(10) NOT NULL DEFAULT 'pending',
+		created_at timestamp NOT NULL DEFAULT now(),
+		PRIMARY KEY (id),
+		CONSTRAINT fk_clip_id FOREIGN KEY (clip_id) REFERENCES clips(id),
+		CONSTRAINT fk_duplicate_of FOREIGN KEY (duplicate_of) REFERENCES clips(id)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	// Each pair is flagged once. Tables made before that was enforced may hold
+	// repeats, so keep one of each, preferring a resolved row, before adding the index.
+	queries := []string{
+		`DELETE FROM clip_duplicates WHERE id IN (
+			SELECT id FROM (
+				SELECT id, row_number() OVER (
+					PARTITION BY clip_id, duplicate_of
+					ORDER BY status = 'pending', created_at, id
+				) AS n
+				FROM clip_duplicates
+			) ranked
+			WHERE n > 1
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS clip_duplicates_pair_idx ON clip_duplicates (clip_id, duplicate_of)`,
+	}
+
+	for _, query := range queries {
+		if _, err := s.db.Exec(context.Background(), query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) createRoleQuotasTable() error {
+	query := `CREATE TABLE IF NOT EXISTS role_quotas (
+		role varchar(20) UNIQUE NOT NULL,
+		max_bytes bigint NOT NULL DEFAULT 0,
+		max_seconds double precision NOT NULL DEFAULT 0,
+		max_uploads_per_day integer NOT NULL DEFAULT 0,
+		PRIMARY KEY (role)
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	return err
+}
+
+func (s *PostgresStore) createUserUploadsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS user_uploads (
+		user_id varchar(128) NOT NULL,
+		size_bytes bigint NOT NULL,
+		created_at timestamp NOT NULL DEFAULT now()
+	)`
+
+	_, err := s.db.Exec(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	indexQuery := `CREATE INDEX IF NOT EXISTS user_uploads_user_id_created_at_idx ON user_uploads (user_id, created_at)`
+	_, err = s.db.Exec(context.Background(), indexQuery)
+	return err
+}
+
 /*
  *
  *
@@ -173,15 +663,37 @@ func (s *PostgresStore) createClipsUsersTable() error {
  *
  */
 
-// Function to delete a clip by id
+// Function to delete a clip by id, handing its storage back to the uploader's usage
 func (s *PostgresStore) DeleteClip(id string) error {
-	query := `DELETE FROM clips WHERE id = $1`
-	_, err := s.db.Exec(context.Background(), query, id)
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		err = fmt.Errorf("error starting delete transaction: %w", err)
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	query := `DELETE FROM clips WHERE id = $1 RETURNING user_id, size_bytes, duration_seconds`
+	var userID string
+	var sizeBytes int64
+	var duration float64
+	err = tx.QueryRow(context.Background(), query, id).Scan(&userID, &sizeBytes, &duration)
 	if err != nil {
 		err = fmt.Errorf("error deleting clip: %w", err)
 		return err
 	}
 
+	usageQuery := `UPDATE users SET usage_bytes = GREATEST(usage_bytes - $2, 0), usage_seconds = GREATEST(usage_seconds - $3, 0) WHERE id = $1`
+	_, err = tx.Exec(context.Background(), usageQuery, userID, sizeBytes, duration)
+	if err != nil {
+		err = fmt.Errorf("error updating user usage: %w", err)
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		err = fmt.Errorf("error committing clip delete: %w", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -236,10 +748,7 @@ func (s *PostgresStore) GetClip(id string) (Clip, error) {
 
 	query := buildGetClipQuery()
 
-	err := s.db.QueryRow(context.Background(), query, id).Scan(&clip.ID, &clip.PlaybackID, &clip.AssetID,
-		&clip.DateUploaded, &clip.UserID, &clip.GameID,
-		&clip.Description, &clip.Tags, &clip.FeaturedUsers, &clip.Game, &clip.Username,
-	)
+	err := s.db.QueryRow(context.Background(), query, id).Scan(clipScanFields(&clip)...)
 
 	if err != nil {
 		err = fmt.Errorf("error running GetClip: %w", err)
@@ -249,226 +758,1873 @@ func (s *PostgresStore) GetClip(id string) (Clip, error) {
 	return clip, nil
 }
 
-func (s *PostgresStore) GetAllClips() ([]Clip, error) {
-	clips := []Clip{}
+func (s *PostgresStore) GetClipByAssetID(assetID string) (Clip, error) {
+	clip := Clip{}
 
-	query := buildGetAllClipsQuery()
+	query := buildGetClipByAssetIDQuery()
+
+	err := s.db.QueryRow(context.Background(), query, assetID).Scan(clipScanFields(&clip)...)
 
-	rows, err := s.db.Query(context.Background(), query)
 	if err != nil {
-		err = fmt.Errorf("error running GetAllClips: %w", err)
-		return nil, err
+		err = fmt.Errorf("error running GetClipByAssetID: %w", err)
+		return clip, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		clip := new(Clip)
-		if err := rows.Scan(&clip.ID, &clip.PlaybackID, &clip.AssetID, &clip.DateUploaded, &clip.UserID, &clip.GameID, &clip.Description, &clip.Tags, &clip.FeaturedUsers, &clip.Game, &clip.Username); err != nil {
-			fmt.Printf("Scanned values: ID=%v, PlaybackID=%v, AssetID=%v, DateUploaded=%v, UserID=%v, GameID=%v, Description=%v, Tags=%v, FeaturedUsers=%v, Game=%v, Username=%v\n",
-				clip.ID, clip.PlaybackID, clip.AssetID, clip.DateUploaded, clip.UserID, clip.GameID, clip.Description, clip.Tags, clip.FeaturedUsers, clip.Game, clip.Username)
-			err = fmt.Errorf("error scanning rows: %w", err)
-			return nil, err
-		}
+	return clip, nil
+}
 
-		clips = append(clips, *clip)
+// Record the MP4 rendition Mux generated for a clip's asset
+func (s *PostgresStore) UpdateClipMP4Rendition(assetID string, rendition string) error {
+	query := `UPDATE clips SET mp4_rendition = $2 WHERE asset_id = $1`
+	tag, err := s.db.Exec(context.Background(), query, assetID, rendition)
+	if err != nil {
+		err = fmt.Errorf("error updating clip mp4 rendition: %w", err)
+		return err
 	}
-	return clips, nil
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no clip with asset id %s", assetID)
+	}
+
+	return nil
 }
 
-func (s *PostgresStore) CreateClip(clip Clip) error {
+func (s *PostgresStore) GetClipByContentHash(hash string) (Clip, error) {
+	clip := Clip{}
 
-	//
-	// SECTION: Clip insertion
-	//
-	// Check if user exists -> user_id
-	user_id, err := s.getIDFromString(clip.Username, "users", "username")
+	query := buildGetClipByContentHashQuery()
+
+	err := s.db.QueryRow(context.Background(), query, hash).Scan(clipScanFields(&clip)...)
 	if err != nil {
-		err = fmt.Errorf("error selecting user: %w", err)
-		return err
+		err = fmt.Errorf("error running GetClipByContentHash: %w", err)
+		return clip, err
 	}
 
-	// Check if game exists -> game_id
-	game_id, err := s.getIDFromString(clip.Game, "games", "name")
+	return clip, nil
+}
+
+// Store the perceptual fingerprint of a clip
+func (s *PostgresStore) UpdateClipFingerprint(clipID string, fingerprint string) error {
+	query := `UPDATE clips SET fingerprint = $2 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, clipID, fingerprint)
 	if err != nil {
-		err = fmt.Errorf("error selecting game: %w", err)
+		err = fmt.Errorf("error updating clip fingerprint: %w", err)
 		return err
 	}
 
-	// Game and user exists, complete the clip object and insert the clip
-	clip.ID = uuid.New().String()
-	clip.UserID = user_id
+	return nil
+}
+
+// Update the details of a clip its uploader can edit
+func (s *PostgresStore) UpdateClipDetails(id string, description string, gameID string) error {
+	query := `UPDATE clips SET description = $2, game_id = $3 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id, description, gameID)
+	if err != nil {
+		err = fmt.Errorf("error updating clip details: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Record a clip's duration once Mux knows it, and count it against the uploader
+func (s *PostgresStore) UpdateClipDuration(assetID string, duration float64) error {
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		err = fmt.Errorf("error starting duration transaction: %w", err)
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Lock the clip so concurrent webhooks don't both add the difference
+	var userID string
+	var previous float64
+	query := `SELECT user_id, duration_seconds FROM clips WHERE asset_id = $1 FOR UPDATE`
+	err = tx.QueryRow(context.Background(), query, assetID).Scan(&userID, &previous)
+	if err != nil {
+		err = fmt.Errorf("error getting clip duration: %w", err)
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), `UPDATE clips SET duration_seconds = $2 WHERE asset_id = $1`, assetID, duration)
+	if err != nil {
+		err = fmt.Errorf("error updating clip duration: %w", err)
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), `UPDATE users SET usage_seconds = GREATEST(usage_seconds + $2, 0) WHERE id = $1`, userID, duration-previous)
+	if err != nil {
+		err = fmt.Errorf("error updating user usage: %w", err)
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		err = fmt.Errorf("error committing clip duration: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetAllClips() ([]Clip, error) {
+	clips := []Clip{}
+
+	query := buildGetAllClipsQuery()
+
+	rows, err := s.db.Query(context.Background(), query)
+	if err != nil {
+		err = fmt.Errorf("error running GetAllClips: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		clip := new(Clip)
+		if err := rows.Scan(clipScanFields(clip)...); err != nil {
+			fmt.Printf("Scanned values: ID=%v, PlaybackID=%v, AssetID=%v, DateUploaded=%v, UserID=%v, GameID=%v, Description=%v, Tags=%v, FeaturedUsers=%v, Game=%v, Username=%v\n",
+				clip.ID, clip.PlaybackID, clip.AssetID, clip.DateUploaded, clip.UserID, clip.GameID, clip.Description, clip.Tags, clip.FeaturedUsers, clip.Game, clip.Username)
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		clips = append(clips, *clip)
+	}
+	return clips, nil
+}
+
+// Clips uploaded by a user, newest first
+func (s *PostgresStore) GetUserClips(userID string) ([]Clip, error) {
+	clips, err := s.queryClips(buildGetClipsWhereQuery("c.user_id = $1"), userID)
+	if err != nil {
+		err = fmt.Errorf("error running GetUserClips: %w", err)
+		return nil, err
+	}
+
+	return clips, nil
+}
+
+// Clips a user is featured in but didn't upload, newest first
+func (s *PostgresStore) GetClipsFeaturingUser(userID string) ([]Clip, error) {
+	query := buildGetClipsWhereQuery("c.id IN (SELECT clip_id FROM clips_users WHERE user_id = $1) AND c.user_id <> $1")
+	clips, err := s.queryClips(query, userID)
+	if err != nil {
+		err = fmt.Errorf("error running GetClipsFeaturingUser: %w", err)
+		return nil, err
+	}
+
+	return clips, nil
+}
+
+// Clips of a game, newest first
+func (s *PostgresStore) GetGameClips(gameID string) ([]Clip, error) {
+	clips, err := s.queryClips(buildGetClipsWhereQuery("c.game_id = $1"), gameID)
+	if err != nil {
+		err = fmt.Errorf("error running GetGameClips: %w", err)
+		return nil, err
+	}
+
+	return clips, nil
+}
+
+// A page of the clips q lists for each of q.Keys, newest first. Keys without clips
+// are left out.
+func (s *PostgresStore) GetClipPages(q ClipPageQuery) (map[string]ClipPage, error) {
+	counts, err := s.CountListedClips(q)
+	if err != nil {
+		return nil, err
+	}
+
+	listed, args := buildListedClipsQuery(q)
+
+	after := ""
+	if q.After != nil {
+		args = append(args, q.After.DateUploaded, q.After.ID)
+		after = fmt.Sprintf("WHERE (date_uploaded, id) < ($%d::timestamp, $%d::varchar)", len(args)-1, len(args))
+	}
+
+	// One more than a page, to tell whether there is a next one
+	args = append(args, q.First+1)
+	query := fmt.Sprintf(`SELECT id, key FROM (
+		SELECT id, key, row_number() OVER (PARTITION BY key ORDER BY date_uploaded DESC, id DESC) AS n
+		FROM (%s) AS listed
+		%s
+	) AS ranked
+	WHERE n <= $%d
+	ORDER BY key, n`, listed, after, len(args))
+
+	rows, err := s.db.Query(context.Background(), query, args...)
+	if err != nil {
+		err = fmt.Errorf("error getting clip pages: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	pageIDs := map[string][]string{}
+	for rows.Next() {
+		var id, key string
+		if err := rows.Scan(&id, &key); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		ids = append(ids, id)
+		pageIDs[key] = append(pageIDs[key], id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	clips, err := s.queryClips(buildGetClipsWhereQuery("c.id = ANY($1)"), ids)
+	if err != nil {
+		err = fmt.Errorf("error getting paged clips: %w", err)
+		return nil, err
+	}
+
+	byID := map[string]Clip{}
+	for _, clip := range clips {
+		byID[clip.ID] = clip
+	}
+
+	pages := map[string]ClipPage{}
+	for key, count := range counts {
+		page := ClipPage{Clips: []Clip{}, TotalCount: count}
+		for i, id := range pageIDs[key] {
+			if i == q.First {
+				page.HasNextPage = true
+				break
+			}
+			page.Clips = append(page.Clips, byID[id])
+		}
+
+		pages[key] = page
+	}
+
+	return pages, nil
+}
+
+// How many clips q lists for each of q.Keys. Keys without clips are left out.
+func (s *PostgresStore) CountListedClips(q ClipPageQuery) (map[string]int, error) {
+	counts := map[string]int{}
+
+	listed, args := buildListedClipsQuery(q)
+	query := `SELECT key, count(*) FROM (` + listed + `) AS listed GROUP BY key`
+	rows, err := s.db.Query(context.Background(), query, args...)
+	if err != nil {
+		err = fmt.Errorf("error counting listed clips: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		counts[key] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// Names of the tags on the clips q lists, once each ignoring case, by name. With
+// q.Tag, only that tag.
+func (s *PostgresStore) GetListedTags(q ClipPageQuery) ([]string, error) {
+	tags := []string{}
+
+	listed, args := buildListedClipsQuery(q)
+	query := `SELECT min(t.tag_name) FROM (` + listed + `) AS listed
+	JOIN clips_tags AS ct ON ct.clip_id = listed.id
+	JOIN tags AS t ON t.id = ct.tag_id
+	`
+	if q.Tag != "" {
+		args = append(args, q.Tag)
+		query += fmt.Sprintf("WHERE lower(t.tag_name) = lower($%d)\n\t", len(args))
+	}
+	query += `GROUP BY lower(t.tag_name)
+	ORDER BY lower(t.tag_name)`
+
+	rows, err := s.db.Query(context.Background(), query, args...)
+	if err != nil {
+		err = fmt.Errorf("error getting listed tags: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// The users featured in each of the clips, other than its uploader, by clip ID
+func (s *PostgresStore) GetClipFeatures(clipIDs []string) (map[string][]string, error) {
+	features := map[string][]string{}
+
+	query := `SELECT cu.clip_id, cu.user_id FROM clips_users AS cu
+	JOIN clips AS c ON c.id = cu.clip_id
+	WHERE cu.clip_id = ANY($1) AND cu.user_id <> c.user_id`
+	rows, err := s.db.Query(context.Background(), query, clipIDs)
+	if err != nil {
+		err = fmt.Errorf("error getting clip features: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var clipID, userID string
+		if err := rows.Scan(&clipID, &userID); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		features[clipID] = append(features[clipID], userID)
+	}
+
+	return features, rows.Err()
+}
+
+// Replace a clip's tags
+func (s *PostgresStore) UpdateClipTags(clipID string, tags []string) error {
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		err = fmt.Errorf("error starting tags transaction: %w", err)
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), `DELETE FROM clips_tags WHERE clip_id = $1`, clipID); err != nil {
+		err = fmt.Errorf("error deleting clips_tags: %w", err)
+		return err
+	}
+
+	for _, tag := range tags {
+		tagID := uuid.New().String()
+
+		insertTagsQuery := `INSERT INTO tags (id, tag_name) VALUES ($1, $2) ON CONFLICT (tag_name) DO UPDATE SET tag_name = EXCLUDED.tag_name RETURNING id`
+		if err := tx.QueryRow(context.Background(), insertTagsQuery, tagID, tag).Scan(&tagID); err != nil {
+			err = fmt.Errorf("error inserting tags: %w", err)
+			return err
+		}
+
+		insertClipsTagsQuery := `INSERT INTO clips_tags (clip_id, tag_id) VALUES ($1, $2)`
+		if _, err := tx.Exec(context.Background(), insertClipsTagsQuery, clipID, tagID); err != nil {
+			err = fmt.Errorf("error inserting clips_tags: %w", err)
+			return err
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		err = fmt.Errorf("error committing tags transaction: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) queryClips(query string, args ...interface{}) ([]Clip, error) {
+	clips := []Clip{}
+
+	rows, err := s.db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		clip := Clip{}
+		if err := rows.Scan(clipScanFields(&clip)...); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		clips = append(clips, clip)
+	}
+
+	return clips, rows.Err()
+}
+
+func (s *PostgresStore) CreateClip(clip Clip) error {
+
+	//
+	// SECTION: Clip insertion
+	//
+	// Check if user exists -> user_id
+	user_id, err := s.getIDFromString(clip.Username, "users", "username")
+	if err != nil {
+		err = fmt.Errorf("error selecting user: %w", err)
+		return err
+	}
+
+	// Check if game exists -> game_id
+	game_id, err := s.getIDFromString(clip.Game, "games", "name")
+	if err != nil {
+		err = fmt.Errorf("error selecting game: %w", err)
+		return err
+	}
+
+	// Game and user exists, complete the clip object and insert the clip
+	clip.ID = uuid.New().String()
+	clip.UserID = user_id
 	clip.GameID = game_id
+	if clip.Visibility == "" {
+		clip.Visibility = VisibilityPublic
+	}
 	insertClipQuery := buildCreateClipQuery()
 
-	_, err = s.db.Exec(context.Background(), insertClipQuery,
-		clip.ID,
-		clip.PlaybackID,
-		clip.AssetID,
-		clip.DateUploaded,
-		clip.Description,
-		clip.UserID,
-		clip.GameID,
+	// Insert the clip, its tags and clips_users together so a failure leaves nothing behind
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		err = fmt.Errorf("error starting clip transaction: %w", err)
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), insertClipQuery,
+		clip.ID,
+		clip.PlaybackID,
+		clip.AssetID,
+		clip.DateUploaded,
+		clip.Description,
+		clip.UserID,
+		clip.GameID,
+		clip.ObjectKey,
+		clip.Visibility,
+		clip.Downloadable,
+		clip.ContentHash,
+		clip.SizeBytes,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting clip: %w", err)
+		return err
+	}
+
+	//
+	// SECTION: Tags insertion
+	//
+	// Insert the tags into the tags table. If the tag already exists, do nothing.
+	tags := strings.Split(clip.Tags, ",")
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+
+		// Skip tag if it is just whitespace
+		if len(tag) == 0 {
+			continue
+		}
+
+		tagID := uuid.New().String()
+
+		insertTagsQuery := `INSERT INTO tags (id, tag_name) VALUES ($1, $2) ON CONFLICT (tag_name) DO UPDATE SET tag_name = EXCLUDED.tag_name RETURNING id`
+		err = tx.QueryRow(context.Background(), insertTagsQuery, tagID, tag).Scan(&tagID)
+
+		if err != nil {
+			err = fmt.Errorf("error inserting tags: %w", err)
+			return err
+		}
+
+		// Insert the clip_id and tag_id into the clips_tags table
+		insertClipsTagsQuery := `INSERT INTO clips_tags (clip_id, tag_id) VALUES ($1, $2)`
+		_, err = tx.Exec(context.Background(), insertClipsTagsQuery,
+			clip.ID,
+			tagID,
+		)
+
+		if err != nil {
+			err = fmt.Errorf("error inserting clips_tags: %w", err)
+			return err
+		}
+	}
+
+	//
+	// SECTION: Clips_Users insertion
+	//
+	// Insert the clip_id and user_id into the clips_users table
+	insertClipsUsersQuery := `INSERT INTO clips_users (clip_id, user_id) VALUES ($1, $2)`
+	_, err = tx.Exec(context.Background(), insertClipsUsersQuery,
+		clip.ID,
+		clip.UserID,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting clips_users: %w", err)
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		err = fmt.Errorf("error committing clip: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) getIDFromString(name string, table string, column string) (string, error) {
+	query := fmt.Sprintf("SELECT id FROM %s WHERE %s = $1", table, column)
+
+	var uuid string
+	err := s.db.QueryRow(context.Background(), query, name).Scan(&uuid)
+	if err != nil {
+		err = fmt.Errorf("error selecting %s: %s", name, err)
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+/*
+ *
+ *
+ * Duplicates
+ *
+ *
+ */
+
+// Flag a clip as a suspected duplicate of another. A pair already flagged is left as it is.
+func (s *PostgresStore) CreateClipDuplicate(duplicate ClipDuplicate) error {
+	duplicate.ID = uuid.New().String()
+
+	query := `INSERT INTO clip_duplicates (id, clip_id, duplicate_of, distance) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (clip_id, duplicate_of) DO NOTHING`
+	_, err := s.db.Exec(context.Background(), query,
+		duplicate.ID,
+		duplicate.ClipID,
+		duplicate.DuplicateOf,
+		duplicate.Distance,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting clip duplicate: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get a suspected duplicate by id
+func (s *PostgresStore) GetClipDuplicate(id string) (ClipDuplicate, error) {
+	duplicate := ClipDuplicate{}
+
+	query := `SELECT id, clip_id, duplicate_of, distance, status, created_at FROM clip_duplicates WHERE id = $1`
+	err := s.db.QueryRow(context.Background(), query, id).Scan(&duplicate.ID, &duplicate.ClipID, &duplicate.DuplicateOf,
+		&duplicate.Distance, &duplicate.Status, &duplicate.CreatedAt,
+	)
+	if err != nil {
+		err = fmt.Errorf("error getting clip duplicate: %w", err)
+		return duplicate, err
+	}
+
+	return duplicate, nil
+}
+
+// Get list of all suspected duplicates, closest first
+func (s *PostgresStore) GetAllClipDuplicates() ([]ClipDuplicate, error) {
+	query := `SELECT id, clip_id, duplicate_of, distance, status, created_at FROM clip_duplicates ORDER BY distance, created_at`
+	duplicates, err := s.queryClipDuplicates(query)
+	if err != nil {
+		err = fmt.Errorf("error getting all clip duplicates: %w", err)
+		return nil, err
+	}
+
+	return duplicates, nil
+}
+
+// Unresolved flags on clips a user uploaded
+func (s *PostgresStore) GetPendingClipDuplicatesForUploader(userID string) ([]ClipDuplicate, error) {
+	query := `SELECT d.id, d.clip_id, d.duplicate_of, d.distance, d.status, d.created_at
+	FROM clip_duplicates AS d
+	JOIN clips AS c ON c.id = d.clip_id
+	WHERE c.user_id = $1 AND d.status = 'pending'
+	ORDER BY d.distance, d.created_at`
+	duplicates, err := s.queryClipDuplicates(query, userID)
+	if err != nil {
+		err = fmt.Errorf("error getting uploader clip duplicates: %w", err)
+		return nil, err
+	}
+
+	return duplicates, nil
+}
+
+func (s *PostgresStore) queryClipDuplicates(query string, args ...interface{}) ([]ClipDuplicate, error) {
+	duplicates := []ClipDuplicate{}
+
+	rows, err := s.db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		duplicate := new(ClipDuplicate)
+		if err := rows.Scan(&duplicate.ID, &duplicate.ClipID, &duplicate.DuplicateOf, &duplicate.Distance,
+			&duplicate.Status, &duplicate.CreatedAt); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		duplicates = append(duplicates, *duplicate)
+	}
+
+	return duplicates, rows.Err()
+}
+
+// Record what the uploader decided about a suspected duplicate
+func (s *PostgresStore) UpdateClipDuplicateStatus(id string, status string) error {
+	query := `UPDATE clip_duplicates SET status = $2 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id, status)
+	if err != nil {
+		err = fmt.Errorf("error updating clip duplicate: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Delete every duplicate flag involving a clip
+func (s *PostgresStore) DeleteClipDuplicatesClipID(clipID string) error {
+	query := `DELETE FROM clip_duplicates WHERE clip_id = $1 OR duplicate_of = $1`
+	_, err := s.db.Exec(context.Background(), query, clipID)
+	if err != nil {
+		err = fmt.Errorf("error deleting clip_duplicates: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * Captions
+ *
+ *
+ */
+
+// Enter a new caption into database
+func (s *PostgresStore) CreateCaption(caption Caption) error {
+	query := `INSERT INTO clip_captions (id, clip_id, language_code, name, closed_captions, object_key, track_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := s.db.Exec(context.Background(), query,
+		caption.ID,
+		caption.ClipID,
+		caption.LanguageCode,
+		caption.Name,
+		caption.ClosedCaptions,
+		caption.ObjectKey,
+		caption.TrackID,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting caption: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get a caption by id
+func (s *PostgresStore) GetCaption(id string) (Caption, error) {
+	caption := Caption{}
+
+	query := `SELECT id, clip_id, language_code, name, closed_captions, object_key, track_id, created_at
+	FROM clip_captions WHERE id = $1`
+	err := s.db.QueryRow(context.Background(), query, id).Scan(&caption.ID, &caption.ClipID, &caption.LanguageCode,
+		&caption.Name, &caption.ClosedCaptions, &caption.ObjectKey, &caption.TrackID, &caption.CreatedAt,
+	)
+	if err != nil {
+		err = fmt.Errorf("error getting caption: %w", err)
+		return caption, err
+	}
+
+	return caption, nil
+}
+
+// Get the captions of one clip
+func (s *PostgresStore) GetClipCaptions(clipID string) ([]Caption, error) {
+	query := `SELECT id, clip_id, language_code, name, closed_captions, object_key, track_id, created_at
+	FROM clip_captions WHERE clip_id = $1 ORDER BY language_code`
+	return s.queryCaptions(query, clipID)
+}
+
+// Captions of several clips at once
+func (s *PostgresStore) GetCaptionsForClips(clipIDs []string) ([]Caption, error) {
+	query := `SELECT id, clip_id, language_code, name, closed_captions, object_key, track_id, created_at
+	FROM clip_captions WHERE clip_id = ANY($1) ORDER BY clip_id, language_code`
+	return s.queryCaptions(query, clipIDs)
+}
+
+// Get list of all captions
+func (s *PostgresStore) GetAllCaptions() ([]Caption, error) {
+	query := `SELECT id, clip_id, language_code, name, closed_captions, object_key, track_id, created_at
+	FROM clip_captions ORDER BY clip_id, language_code`
+	return s.queryCaptions(query)
+}
+
+func (s *PostgresStore) queryCaptions(query string, args ...interface{}) ([]Caption, error) {
+	captions := []Caption{}
+
+	rows, err := s.db.Query(context.Background(), query, args...)
+	if err != nil {
+		err = fmt.Errorf("error getting captions: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		caption := new(Caption)
+		if err := rows.Scan(&caption.ID, &caption.ClipID, &caption.LanguageCode, &caption.Name,
+			&caption.ClosedCaptions, &caption.ObjectKey, &caption.TrackID, &caption.CreatedAt); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		captions = append(captions, *caption)
+	}
+
+	return captions, nil
+}
+
+// Delete a caption by id
+func (s *PostgresStore) DeleteCaption(id string) error {
+	query := `DELETE FROM clip_captions WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id)
+	if err != nil {
+		err = fmt.Errorf("error deleting caption: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Delete all captions of a clip
+func (s *PostgresStore) DeleteClipCaptionsClipID(clipID string) error {
+	query := `DELETE FROM clip_captions WHERE clip_id = $1`
+	_, err := s.db.Exec(context.Background(), query, clipID)
+	if err != nil {
+		err = fmt.Errorf("error deleting clip_captions: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * Users
+ *
+ *
+ */
+
+// Enter a new user into database
+func (s *PostgresStore) CreateUser(user User) error {
+	user.ID = uuid.New().String()
+
+	if user.Role == "" {
+		user.Role = RoleViewer
+	}
+
+	if user.RoleSource == "" {
+		user.RoleSource = roleSourceDiscord
+	}
+
+	query := `INSERT INTO users (id, username, email, role, discord_id, display_name, avatar, role_source) VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), $6, $7, $8)`
+	_, err := s.db.Exec(context.Background(), query,
+		user.ID,
+		user.Username,
+		user.Email,
+		user.Role,
+		user.DiscordID,
+		user.DisplayName,
+		user.Avatar,
+		user.RoleSource,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting user: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Delete a user from database
+func (s *PostgresStore) DeleteUser(user User) error {
+	query := `DELETE FROM users WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, user.ID)
+	if err != nil {
+		err = fmt.Errorf("error deleting user: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get list of all users
+func (s *PostgresStore) GetAllUsers() ([]User, error) {
+	users := []User{}
+
+	query := `SELECT ` + userColumns + ` FROM users`
+	rows, err := s.db.Query(context.Background(), query)
+	if err != nil {
+		err = fmt.Errorf("error getting all users: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := new(User)
+		if err := rows.Scan(userScanFields(user)...); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		users = append(users, *user)
+	}
+
+	return users, nil
+}
+
+// Get a user by id
+func (s *PostgresStore) GetUserByID(id string) (User, error) {
+	user := User{}
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	err := s.db.QueryRow(context.Background(), query, id).Scan(userScanFields(&user)...)
+	if err != nil {
+		err = fmt.Errorf("error getting user by id: %w", err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Get several users by id at once. Unknown ids are left out.
+func (s *PostgresStore) GetUsersByIDs(ids []string) ([]User, error) {
+	users := []User{}
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ANY($1)`
+	rows, err := s.db.Query(context.Background(), query, ids)
+	if err != nil {
+		err = fmt.Errorf("error getting users by id: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := User{}
+		if err := rows.Scan(userScanFields(&user)...); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Get a user by the snowflake ID of their linked Discord account
+func (s *PostgresStore) GetUserByDiscordID(discordID string) (User, error) {
+	user := User{}
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE discord_id = $1`
+	err := s.db.QueryRow(context.Background(), query, discordID).Scan(userScanFields(&user)...)
+	if err != nil {
+		err = fmt.Errorf("error getting user by discord id: %w", err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Link a user to a Discord account and store its current profile
+func (s *PostgresStore) UpdateUserDiscordProfile(user User) error {
+	query := `UPDATE users SET discord_id = NULLIF($2, ''), username = $3, email = NULLIF($4, ''), display_name = $5, avatar = $6 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, user.ID, user.DiscordID, user.Username, user.Email, user.DisplayName, user.Avatar)
+	if err != nil {
+		err = fmt.Errorf("error updating user discord profile: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get a user by username
+func (s *PostgresStore) GetUserByUsername(username string) (User, error) {
+	user := User{}
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
+	err := s.db.QueryRow(context.Background(), query, username).Scan(userScanFields(&user)...)
+	if err != nil {
+		err = fmt.Errorf("error getting user by username: %w", err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Get a user by email
+func (s *PostgresStore) GetUserByEmail(email string) (User, error) {
+	user := User{}
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = $1`
+	err := s.db.QueryRow(context.Background(), query, email).Scan(userScanFields(&user)...)
+	if err != nil {
+		err = fmt.Errorf("error getting user by email: %w", err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Set a user's quota overrides
+func (s *PostgresStore) UpdateUserQuota(user User) error {
+	query := `UPDATE users SET quota_bytes = $2, quota_seconds = $3, quota_uploads_per_day = $4 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, user.ID, user.QuotaBytes, user.QuotaSeconds, user.QuotaUploadsPerDay)
+	if err != nil {
+		err = fmt.Errorf("error updating user quota: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Set a user's role and where it comes from, recording the change in the audit trail
+func (s *PostgresStore) UpdateUserRole(change RoleChange) error {
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		err = fmt.Errorf("error starting role transaction: %w", err)
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	query := `UPDATE users SET role = $2, role_source = $3 WHERE id = $1`
+	_, err = tx.Exec(context.Background(), query, change.UserID, change.NewRole, change.RoleSource)
+	if err != nil {
+		err = fmt.Errorf("error updating user role: %w", err)
+		return err
+	}
+
+	auditQuery := `INSERT INTO role_changes (id, user_id, old_role, new_role, role_source, changed_by) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.Exec(context.Background(), auditQuery,
+		uuid.New().String(),
+		change.UserID,
+		change.OldRole,
+		change.NewRole,
+		change.RoleSource,
+		change.ChangedBy,
+	)
+	if err != nil {
+		err = fmt.Errorf("error recording role change: %w", err)
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		err = fmt.Errorf("error committing role change: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get the most recent role changes, newest first
+func (s *PostgresStore) GetRoleChanges(limit int) ([]RoleChange, error) {
+	changes := []RoleChange{}
+
+	query := `SELECT rc.id, rc.user_id, COALESCE(u.username, ''), rc.old_role, rc.new_role, rc.role_source, rc.changed_by, rc.created_at
+	FROM role_changes rc
+	LEFT JOIN users u ON u.id = rc.user_id
+	ORDER BY rc.created_at DESC
+	LIMIT $1`
+	rows, err := s.db.Query(context.Background(), query, limit)
+	if err != nil {
+		err = fmt.Errorf("error getting role changes: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		change := new(RoleChange)
+		if err := rows.Scan(&change.ID, &change.UserID, &change.Username, &change.OldRole, &change.NewRole,
+			&change.RoleSource, &change.ChangedBy, &change.CreatedAt); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		changes = append(changes, *change)
+	}
+
+	return changes, nil
+}
+
+// Log an accepted upload for the daily upload limit
+func (s *PostgresStore) RecordUpload(userID string, sizeBytes int64) error {
+	query := `INSERT INTO user_uploads (user_id, size_bytes) VALUES ($1, $2)`
+	_, err := s.db.Exec(context.Background(), query, userID, sizeBytes)
+	if err != nil {
+		err = fmt.Errorf("error recording upload: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Add sizeBytes to a user's storage usage unless that would take it over maxBytes.
+// A maxBytes of 0 is unlimited. Reports whether the bytes were reserved.
+func (s *PostgresStore) ReserveUsageBytes(userID string, sizeBytes int64, maxBytes int64) (bool, error) {
+	query := `UPDATE users SET usage_bytes = usage_bytes + $2 WHERE id = $1 AND ($3::bigint = 0 OR usage_bytes + $2 <= $3::bigint)`
+	tag, err := s.db.Exec(context.Background(), query, userID, sizeBytes, maxBytes)
+	if err != nil {
+		err = fmt.Errorf("error reserving user usage: %w", err)
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// Give back storage reserved for an upload that never became a clip
+func (s *PostgresStore) ReleaseUsageBytes(userID string, sizeBytes int64) error {
+	query := `UPDATE users SET usage_bytes = GREATEST(usage_bytes - $2, 0) WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, userID, sizeBytes)
+	if err != nil {
+		err = fmt.Errorf("error releasing user usage: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Count a user's uploads since a point in time
+func (s *PostgresStore) CountUploadsSince(userID string, since time.Time) (int, error) {
+	var count int
+
+	query := `SELECT count(*) FROM user_uploads WHERE user_id = $1 AND created_at >= $2`
+	err := s.db.QueryRow(context.Background(), query, userID, since).Scan(&count)
+	if err != nil {
+		err = fmt.Errorf("error counting uploads: %w", err)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+/*
+ *
+ *
+ * Quotas
+ *
+ *
+ */
+
+// Get the quota of a role. A role without a row is unlimited.
+func (s *PostgresStore) GetRoleQuota(role string) (Quota, error) {
+	quota := Quota{Role: role}
+
+	query := `SELECT role, max_bytes, max_seconds, max_uploads_per_day FROM role_quotas WHERE role = $1`
+	err := s.db.QueryRow(context.Background(), query, role).Scan(&quota.Role, &quota.MaxBytes, &quota.MaxSeconds, &quota.MaxUploadsPerDay)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return quota, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("error getting role quota: %w", err)
+		return quota, err
+	}
+
+	return quota, nil
+}
+
+// Get list of all role quotas
+func (s *PostgresStore) GetAllRoleQuotas() ([]Quota, error) {
+	quotas := []Quota{}
+
+	query := `SELECT role, max_bytes, max_seconds, max_uploads_per_day FROM role_quotas ORDER BY role`
+	rows, err := s.db.Query(context.Background(), query)
+	if err != nil {
+		err = fmt.Errorf("error getting all role quotas: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		quota := new(Quota)
+		if err := rows.Scan(&quota.Role, &quota.MaxBytes, &quota.MaxSeconds, &quota.MaxUploadsPerDay); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		quotas = append(quotas, *quota)
+	}
+
+	return quotas, nil
+}
+
+// Create or replace the quota of a role
+func (s *PostgresStore) UpsertRoleQuota(quota Quota) error {
+	query := `INSERT INTO role_quotas (role, max_bytes, max_seconds, max_uploads_per_day) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (role) DO UPDATE SET max_bytes = EXCLUDED.max_bytes, max_seconds = EXCLUDED.max_seconds,
+	max_uploads_per_day = EXCLUDED.max_uploads_per_day`
+	_, err := s.db.Exec(context.Background(), query, quota.Role, quota.MaxBytes, quota.MaxSeconds, quota.MaxUploadsPerDay)
+	if err != nil {
+		err = fmt.Errorf("error upserting role quota: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * Games
+ *
+ *
+ */
+
+// Get list of all games
+func (s *PostgresStore) GetAllGames() ([]Game, error) {
+	games := []Game{}
+
+	query := `SELECT * FROM games`
+	rows, err := s.db.Query(context.Background(), query)
+	if err != nil {
+		err = fmt.Errorf("error getting all games: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		game := new(Game)
+		if err := rows.Scan(&game.ID, &game.Name); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		games = append(games, *game)
+	}
+
+	return games, nil
+}
+
+// Get a game by name
+func (s *PostgresStore) GetGameByName(name string) (Game, error) {
+	game := Game{}
+
+	query := `SELECT * FROM games WHERE name = $1`
+	err := s.db.QueryRow(context.Background(), query, name).Scan(&game.ID, &game.Name)
+	if err != nil {
+		err = fmt.Errorf("error getting game by name: %w", err)
+		return game, err
+	}
+
+	return game, nil
+}
+
+// Get a game by ID
+func (s *PostgresStore) GetGame(id string) (Game, error) {
+	game := Game{}
+
+	query := `SELECT id, name FROM games WHERE id = $1`
+	err := s.db.QueryRow(context.Background(), query, id).Scan(&game.ID, &game.Name)
+	if err != nil {
+		err = fmt.Errorf("error getting game: %w", err)
+		return game, err
+	}
+
+	return game, nil
+}
+
+// Enter a new game into database
+func (s *PostgresStore) CreateGame(game Game) error {
+	game.ID = uuid.New().String()
+
+	query := `INSERT INTO games (id, name) VALUES ($1, $2)`
+	_, err := s.db.Exec(context.Background(), query,
+		game.ID,
+		game.Name,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting game: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * Jobs
+ *
+ *
+ */
+
+// Add a job to the queue, returning its id. Every job time is taken from the
+// database's clock, so app hosts whose clocks drift still agree on them.
+func (s *PostgresStore) EnqueueJob(job Job) (string, error) {
+	job.ID = uuid.New().String()
+
+	if job.Queue == "" {
+		job.Queue = defaultJobQueue
+	}
+
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = defaultJobMaxAttempts
+	}
+
+	query := `INSERT INTO jobs (id, type, queue, payload, max_attempts, run_at)
+	VALUES ($1, $2, $3, $4, $5, now() + $6::float8 * interval '1 second')`
+	_, err := s.db.Exec(context.Background(), query,
+		job.ID,
+		job.Type,
+		job.Queue,
+		job.Payload,
+		job.MaxAttempts,
+		job.Delay.Seconds(),
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting job: %w", err)
+		return "", err
+	}
+
+	return job.ID, nil
+}
+
+// Claim the next runnable job from any of the given queues. Returns pgx.ErrNoRows
+// (wrapped) when there is nothing to do. SKIP LOCKED lets several workers, on one or
+// many replicas, poll the same table without handing out a job twice.
+func (s *PostgresStore) ClaimJob(queues []string) (Job, error) {
+	job := Job{}
+
+	query := `UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_at = now()
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = 'queued' AND run_at <= now() AND queue = ANY($1)
+		ORDER BY run_at
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	)
+	RETURNING id, type, queue, payload, status, attempts, max_attempts, run_at, last_error, created_at`
+
+	err := s.db.QueryRow(context.Background(), query, queues).Scan(&job.ID, &job.Type, &job.Queue, &job.Payload,
+		&job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error claiming job: %w", err)
+		return job, err
+	}
+
+	return job, nil
+}
+
+// Mark a job as done
+func (s *PostgresStore) CompleteJob(id string) error {
+	query := `UPDATE jobs SET status = 'done', locked_at = NULL WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id)
+	if err != nil {
+		err = fmt.Errorf("error completing job: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Put a failed job back in the queue to run again after delay
+func (s *PostgresStore) RetryJob(id string, delay time.Duration, lastError string) error {
+	query := `UPDATE jobs SET status = 'queued', locked_at = NULL, run_at = now() + $2::float8 * interval '1 second', last_error = $3 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id, delay.Seconds(), lastError)
+	if err != nil {
+		err = fmt.Errorf("error retrying job: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Move a job that has run out of attempts to the dead-letter state
+func (s *PostgresStore) DeadLetterJob(id string, lastError string) error {
+	query := `UPDATE jobs SET status = 'dead', locked_at = NULL, last_error = $2 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id, lastError)
+	if err != nil {
+		err = fmt.Errorf("error dead-lettering job: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Requeue jobs whose worker died mid-run (not touched for longer than olderThan) and
+// that have attempts left
+func (s *PostgresStore) RequeueStaleJobs(olderThan time.Duration) (int64, error) {
+	query := `UPDATE jobs SET status = 'queued', locked_at = NULL
+	WHERE status = 'running' AND locked_at < now() - $1::float8 * interval '1 second' AND attempts < max_attempts`
+	tag, err := s.db.Exec(context.Background(), query, olderThan.Seconds())
+	if err != nil {
+		err = fmt.Errorf("error requeueing stale jobs: %w", err)
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// Dead-letter running jobs whose worker stopped heartbeating on their last attempt,
+// returning them so the caller can clean up after them
+func (s *PostgresStore) DeadLetterStaleJobs(olderThan time.Duration) ([]Job, error) {
+	query := `UPDATE jobs SET status = 'dead', locked_at = NULL, last_error = 'worker stopped on the last attempt'
+	WHERE status = 'running' AND locked_at < now() - $1::float8 * interval '1 second' AND attempts >= max_attempts
+	RETURNING id, type, queue, payload, status, attempts, max_attempts, run_at, last_error, created_at`
+
+	rows, err := s.db.Query(context.Background(), query, olderThan.Seconds())
+	if err != nil {
+		err = fmt.Errorf("error dead-lettering stale jobs: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job := Job{}
+		err := rows.Scan(&job.ID, &job.Type, &job.Queue, &job.Payload,
+			&job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt,
+		)
+		if err != nil {
+			err = fmt.Errorf("error scanning job: %w", err)
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// Push back a running job's lock so the janitor knows its worker is still alive
+func (s *PostgresStore) TouchJob(id string) error {
+	query := `UPDATE jobs SET locked_at = now() WHERE id = $1 AND status = 'running'`
+	_, err := s.db.Exec(context.Background(), query, id)
+	if err != nil {
+		err = fmt.Errorf("error touching job: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Report whether a job of the given type is queued or running
+func (s *PostgresStore) HasPendingJob(jobType string) (bool, error) {
+	var exists bool
+
+	query := `SELECT EXISTS (SELECT 1 FROM jobs WHERE type = $1 AND status IN ('queued', 'running'))`
+	err := s.db.QueryRow(context.Background(), query, jobType).Scan(&exists)
+	if err != nil {
+		err = fmt.Errorf("error checking for pending %s job: %w", jobType, err)
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// Get the most recent job of a type whose payload refers to objectKey
+func (s *PostgresStore) GetLatestJobForObjectKey(jobType string, objectKey string) (Job, error) {
+	job := Job{}
+
+	query := `SELECT id, type, queue, payload, status, attempts, max_attempts, run_at, last_error, created_at
+	FROM jobs WHERE type = $1 AND payload->>'object_key' = $2
+	ORDER BY created_at DESC
+	LIMIT 1`
+
+	err := s.db.QueryRow(context.Background(), query, jobType, objectKey).Scan(&job.ID, &job.Type, &job.Queue, &job.Payload,
+		&job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error getting %s job for object %s: %w", jobType, objectKey, err)
+		return job, err
+	}
+
+	return job, nil
+}
+
+/*
+ *
+ *
+ * Sessions
+ *
+ *
+ */
+
+const sessionColumns = `id, user_id, discord_token, user_agent, ip, created_at, last_seen_at, expires_at, revoked_at`
+
+func sessionScanFields(session *Session) []interface{} {
+	return []interface{}{
+		&session.ID, &session.UserID, &session.DiscordToken, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.RevokedAt,
+	}
+}
+
+// Enter a new session into database
+func (s *PostgresStore) CreateSession(session Session) error {
+	query := `INSERT INTO sessions (id, user_id, discord_token, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := s.db.Exec(context.Background(), query,
+		session.ID,
+		session.UserID,
+		session.DiscordToken,
+		session.UserAgent,
+		session.IP,
+		session.ExpiresAt,
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error inserting session: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get a session by id, whether or not it is still active
+func (s *PostgresStore) GetSession(id string) (Session, error) {
+	session := Session{}
+
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+	err := s.db.QueryRow(context.Background(), query, id).Scan(sessionScanFields(&session)...)
+	if err != nil {
+		err = fmt.Errorf("error getting session: %w", err)
+		return session, err
+	}
+
+	return session, nil
+}
+
+// Get a user's active sessions, most recently used first
+func (s *PostgresStore) GetUserSessions(userID string) ([]Session, error) {
+	sessions := []Session{}
+
+	query := `SELECT ` + sessionColumns + ` FROM sessions
+	WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+	ORDER BY last_seen_at DESC`
+	rows, err := s.db.Query(context.Background(), query, userID)
+	if err != nil {
+		err = fmt.Errorf("error getting user sessions: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session := new(Session)
+		if err := rows.Scan(sessionScanFields(session)...); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, nil
+}
+
+// IDs of users who can still get in: with a session or API token that hasn't
+// expired or been revoked
+func (s *PostgresStore) GetUserIDsWithAccess() ([]string, error) {
+	ids := []string{}
+
+	query := `SELECT user_id FROM sessions WHERE revoked_at IS NULL AND expires_at > now()
+	UNION
+	SELECT user_id FROM api_tokens WHERE revoked_at IS NULL AND expires_at > now()`
+	rows, err := s.db.Query(context.Background(), query)
+	if err != nil {
+		err = fmt.Errorf("error getting users with access: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Replace a session's encrypted Discord token, e.g. after refreshing it
+func (s *PostgresStore) UpdateSessionDiscordToken(id string, discordToken []byte) error {
+	query := `UPDATE sessions SET discord_token = $2 WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id, discordToken)
+	if err != nil {
+		err = fmt.Errorf("error updating session discord token: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Record that a session was just used
+func (s *PostgresStore) TouchSession(id string) error {
+	query := `UPDATE sessions SET last_seen_at = now() WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id)
+	if err != nil {
+		err = fmt.Errorf("error touching session: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Revoke a session and forget its Discord token
+func (s *PostgresStore) RevokeSession(id string) error {
+	query := `UPDATE sessions SET revoked_at = now(), discord_token = NULL WHERE id = $1 AND revoked_at IS NULL`
+	_, err := s.db.Exec(context.Background(), query, id)
+	if err != nil {
+		err = fmt.Errorf("error revoking session: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// Revoke every active session of a user, returning how many were revoked
+func (s *PostgresStore) RevokeUserSessions(userID string) (int64, error) {
+	query := `UPDATE sessions SET revoked_at = now(), discord_token = NULL WHERE user_id = $1 AND revoked_at IS NULL`
+	tag, err := s.db.Exec(context.Background(), query, userID)
+	if err != nil {
+		err = fmt.Errorf("error revoking user sessions: %w", err)
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// Remove a user's expired and revoked sessions
+func (s *PostgresStore) DeleteDeadSessions(userID string) error {
+	query := `DELETE FROM sessions WHERE user_id = $1 AND (revoked_at IS NOT NULL OR expires_at <= now())`
+	_, err := s.db.Exec(context.Background(), query, userID)
+	if err != nil {
+		err = fmt.Errorf("error deleting dead sessions: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ *
+ *
+ * API tokens
+ *
+ *
+ */
+
+const apiTokenColumns = `id, user_id, name, token_hash, scopes, created_at, expires_at, last_used_at, revoked_at`
+
+func apiTokenScanFields(token *APIToken) []interface{} {
+	return []interface{}{
+		&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.Scopes,
+		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.RevokedAt,
+	}
+}
+
+// Enter a new API token into database
+func (s *PostgresStore) CreateAPIToken(token APIToken) error {
+	query := `INSERT INTO api_tokens (id, user_id, name, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := s.db.Exec(context.Background(), query,
+		token.ID,
+		token.UserID,
+		token.Name,
+		token.TokenHash,
+		token.Scopes,
+		token.ExpiresAt,
 	)
 
 	if err != nil {
-		err = fmt.Errorf("error inserting clip: %w", err)
+		err = fmt.Errorf("error inserting api token: %w", err)
 		return err
 	}
 
-	//
-	// SECTION: Tags insertion
-	//
-	// Insert the tags into the tags table. If the tag already exists, do nothing.
-	tags := strings.Split(clip.Tags, ",")
+	return nil
+}
 
-	for _, tag := range tags {
-		tag = strings.TrimSpace(tag)
+// Get an API token by id
+func (s *PostgresStore) GetAPIToken(id string) (APIToken, error) {
+	token := APIToken{}
 
-		// Skip tag if it is just whitespace
-		if len(tag) == 0 {
-			continue
-		}
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE id = $1`
+	err := s.db.QueryRow(context.Background(), query, id).Scan(apiTokenScanFields(&token)...)
+	if err != nil {
+		err = fmt.Errorf("error getting api token: %w", err)
+		return token, err
+	}
 
-		tagID := uuid.New().String()
+	return token, nil
+}
 
-		insertTagsQuery := `INSERT INTO tags (id, tag_name) VALUES ($1, $2) ON CONFLICT (tag_name) DO UPDATE SET tag_name = EXCLUDED.tag_name RETURNING id`
-		err = s.db.QueryRow(context.Background(), insertTagsQuery, tagID, tag).Scan(&tagID)
+// Get an API token by the hash of its secret
+func (s *PostgresStore) GetAPITokenByHash(hash string) (APIToken, error) {
+	token := APIToken{}
 
-		if err != nil {
-			err = fmt.Errorf("error inserting tags: %w", err)
-			return err
-		}
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE token_hash = $1`
+	err := s.db.QueryRow(context.Background(), query, hash).Scan(apiTokenScanFields(&token)...)
+	if err != nil {
+		err = fmt.Errorf("error getting api token by hash: %w", err)
+		return token, err
+	}
 
-		// Insert the clip_id and tag_id into the clips_tags table
-		insertClipsTagsQuery := `INSERT INTO clips_tags (clip_id, tag_id) VALUES ($1, $2)`
-		_, err = s.db.Exec(context.Background(), insertClipsTagsQuery,
-			clip.ID,
-			tagID,
-		)
+	return token, nil
+}
 
-		if err != nil {
-			err = fmt.Errorf("error inserting clips_tags: %w", err)
-			return err
+// Get a user's tokens that haven't been revoked, newest first
+func (s *PostgresStore) GetUserAPITokens(userID string) ([]APIToken, error) {
+	tokens := []APIToken{}
+
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC`
+	rows, err := s.db.Query(context.Background(), query, userID)
+	if err != nil {
+		err = fmt.Errorf("error getting user api tokens: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		token := new(APIToken)
+		if err := rows.Scan(apiTokenScanFields(token)...); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
 		}
+
+		tokens = append(tokens, *token)
 	}
 
-	//
-	// SECTION: Clips_Users insertion
-	//
-	// Insert the clip_id and user_id into the clips_users table
-	insertClipsUsersQuery := `INSERT INTO clips_users (clip_id, user_id) VALUES ($1, $2)`
-	_, err = s.db.Exec(context.Background(), insertClipsUsersQuery,
-		clip.ID,
-		clip.UserID,
-	)
+	return tokens, nil
+}
 
+// Record that an API token was just used
+func (s *PostgresStore) TouchAPIToken(id string) error {
+	query := `UPDATE api_tokens SET last_used_at = now() WHERE id = $1`
+	_, err := s.db.Exec(context.Background(), query, id)
 	if err != nil {
-		err = fmt.Errorf("error inserting clips_users: %w", err)
+		err = fmt.Errorf("error touching api token: %w", err)
 		return err
 	}
 
 	return nil
 }
 
-func (s *PostgresStore) getIDFromString(name string, table string, column string) (string, error) {
-	query := fmt.Sprintf("SELECT id FROM %s WHERE %s = $1", table, column)
+// Revoke an API token
+func (s *PostgresStore) RevokeAPIToken(id string) error {
+	query := `UPDATE api_tokens SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`
+	_, err := s.db.Exec(context.Background(), query, id)
+	if err != nil {
+		err = fmt.Errorf("error revoking api token: %w", err)
+		return err
+	}
 
-	var uuid string
-	err := s.db.QueryRow(context.Background(), query, name).Scan(&uuid)
+	return nil
+}
+
+// Revoke every API token of a user, returning how many were revoked
+func (s *PostgresStore) RevokeUserAPITokens(userID string) (int64, error) {
+	query := `UPDATE api_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+	tag, err := s.db.Exec(context.Background(), query, userID)
 	if err != nil {
-		err = fmt.Errorf("error selecting %s: %s", name, err)
-		return "", err
+		err = fmt.Errorf("error revoking user api tokens: %w", err)
+		return 0, err
 	}
 
-	return uuid, nil
+	return tag.RowsAffected(), nil
 }
 
 /*
  *
  *
- * Users
+ * Invites
  *
  *
  */
 
-// Enter a new user into database
-func (s *PostgresStore) CreateUser(user User) error {
-	user.ID = uuid.New().String()
+const inviteColumns = `code, role, max_uses, uses, expires_at, created_by, created_at, revoked_at`
 
-	query := `INSERT INTO users (id, username, email) VALUES ($1, $2, $3)`
+func inviteScanFields(invite *Invite) []interface{} {
+	return []interface{}{
+		&invite.Code, &invite.Role, &invite.MaxUses, &invite.Uses, &invite.ExpiresAt,
+		&invite.CreatedBy, &invite.CreatedAt, &invite.RevokedAt,
+	}
+}
+
+// Enter a new invite into database
+func (s *PostgresStore) CreateInvite(invite Invite) error {
+	query := `INSERT INTO invites (code, role, max_uses, expires_at, created_by) VALUES ($1, $2, $3, $4, $5)`
 	_, err := s.db.Exec(context.Background(), query,
-		user.ID,
-		user.Username,
-		user.Email,
+		invite.Code,
+		invite.Role,
+		invite.MaxUses,
+		invite.ExpiresAt,
+		invite.CreatedBy,
 	)
 
 	if err != nil {
-		err = fmt.Errorf("error inserting user: %w", err)
+		err = fmt.Errorf("error inserting invite: %w", err)
 		return err
 	}
 
 	return nil
 }
 
-// Delete a user from database
-func (s *PostgresStore) DeleteUser(user User) error {
-	query := `DELETE FROM users WHERE id = $1`
-	_, err := s.db.Exec(context.Background(), query, user.ID)
+// Get an invite by code
+func (s *PostgresStore) GetInvite(code string) (Invite, error) {
+	invite := Invite{}
+
+	query := `SELECT ` + inviteColumns + ` FROM invites WHERE code = $1`
+	err := s.db.QueryRow(context.Background(), query, code).Scan(inviteScanFields(&invite)...)
 	if err != nil {
-		err = fmt.Errorf("error deleting user: %w", err)
-		return err
+		err = fmt.Errorf("error getting invite: %w", err)
+		return invite, err
 	}
 
-	return nil
+	return invite, nil
 }
 
-// Get list of all users
-func (s *PostgresStore) GetAllUsers() ([]User, error) {
-	users := []User{}
+// Get list of all invites, newest first
+func (s *PostgresStore) GetAllInvites() ([]Invite, error) {
+	invites := []Invite{}
 
-	query := `SELECT * FROM users`
+	query := `SELECT ` + inviteColumns + ` FROM invites ORDER BY created_at DESC`
 	rows, err := s.db.Query(context.Background(), query)
 	if err != nil {
-		err = fmt.Errorf("error getting all users: %w", err)
+		err = fmt.Errorf("error getting all invites: %w", err)
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		user := new(User)
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role); err != nil {
+		invite := new(Invite)
+		if err := rows.Scan(inviteScanFields(invite)...); err != nil {
 			err = fmt.Errorf("error scanning rows: %w", err)
 			return nil, err
 		}
 
-		users = append(users, *user)
+		invites = append(invites, *invite)
 	}
 
-	return users, nil
+	return invites, nil
 }
 
-// Get a user by username
-func (s *PostgresStore) GetUserByUsername(username string) (User, error) {
-	user := User{}
+// Get list of all invite redemptions with the redeeming user's name
+func (s *PostgresStore) GetAllInviteRedemptions() ([]InviteRedemption, error) {
+	redemptions := []InviteRedemption{}
 
-	query := `SELECT * FROM users WHERE username = $1`
-	err := s.db.QueryRow(context.Background(), query, username).Scan(&user.ID, &user.Username, &user.Email)
+	query := `SELECT ir.invite_code, ir.user_id, COALESCE(u.username, ''), ir.redeemed_at
+	FROM invite_redemptions ir
+	LEFT JOIN users u ON u.id = ir.user_id
+	ORDER BY ir.redeemed_at`
+	rows, err := s.db.Query(context.Background(), query)
 	if err != nil {
-		err = fmt.Errorf("error getting user by username: %w", err)
-		return user, err
+		err = fmt.Errorf("error getting invite redemptions: %w", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return user, nil
+	for rows.Next() {
+		redemption := new(InviteRedemption)
+		if err := rows.Scan(&redemption.InviteCode, &redemption.UserID, &redemption.Username, &redemption.RedeemedAt); err != nil {
+			err = fmt.Errorf("error scanning rows: %w", err)
+			return nil, err
+		}
+
+		redemptions = append(redemptions, *redemption)
+	}
+
+	return redemptions, nil
 }
 
-// Get a user by email
-func (s *PostgresStore) GetUserByEmail(email string) (User, error) {
-	user := User{}
+// Revoke an invite so it can't be redeemed any more
+func (s *PostgresStore) RevokeInvite(code string) error {
+	query := `UPDATE invites SET revoked_at = now() WHERE code = $1 AND revoked_at IS NULL`
+	_, err := s.db.Exec(context.Background(), query, code)
+	if err != nil {
+		err = fmt.Errorf("error revoking invite: %w", err)
+		return err
+	}
 
-	query := `SELECT * FROM users WHERE email = $1`
-	err := s.db.QueryRow(context.Background(), query, email).Scan(&user.ID, &user.Username, &user.Email)
+	return nil
+}
+
+// Create a user and redeem an invite for them in one transaction, so two people
+// can't both take the last use of an invite
+func (s *PostgresStore) CreateUserWithInvite(user User, code string) (User, error) {
+	tx, err := s.db.Begin(context.Background())
 	if err != nil {
-		err = fmt.Errorf("error getting user by email: %w", err)
+		err = fmt.Errorf("error starting invite transaction: %w", err)
+		return user, err
+	}
+	defer tx.Rollback(context.Background())
+
+	invite := Invite{}
+	query := `SELECT ` + inviteColumns + ` FROM invites WHERE code = $1 FOR UPDATE`
+	err = tx.QueryRow(context.Background(), query, code).Scan(inviteScanFields(&invite)...)
+	if err != nil {
+		err = fmt.Errorf("error getting invite: %w", err)
+		return user, err
+	}
+
+	if err := validateInvite(invite); err != nil {
+		return user, err
+	}
+
+	user.ID = uuid.New().String()
+	if user.Role == "" {
+		user.Role = RoleViewer
+	}
+	if user.RoleSource == "" {
+		user.RoleSource = roleSourceDiscord
+	}
+
+	userQuery := `INSERT INTO users (id, username, email, role, discord_id, display_name, avatar, role_source) VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), $6, $7, $8)`
+	_, err = tx.Exec(context.Background(), userQuery,
+		user.ID,
+		user.Username,
+		user.Email,
+		user.Role,
+		user.DiscordID,
+		user.DisplayName,
+		user.Avatar,
+		user.RoleSource,
+	)
+	if err != nil {
+		err = fmt.Errorf("error inserting user: %w", err)
+		return user, err
+	}
+
+	_, err = tx.Exec(context.Background(), `UPDATE invites SET uses = uses + 1 WHERE code = $1`, code)
+	if err != nil {
+		err = fmt.Errorf("error using invite: %w", err)
+		return user, err
+	}
+
+	_, err = tx.Exec(context.Background(), `INSERT INTO invite_redemptions (invite_code, user_id) VALUES ($1, $2)`, code, user.ID)
+	if err != nil {
+		err = fmt.Errorf("error recording invite redemption: %w", err)
+		return user, err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		err = fmt.Errorf("error committing invite redemption: %w", err)
 		return user, err
 	}
 
@@ -478,62 +2634,113 @@ func (s *PostgresStore) GetUserByEmail(email string) (User, error) {
 /*
  *
  *
- * Games
+ * User identities
  *
  *
  */
 
-// Get list of all games
-func (s *PostgresStore) GetAllGames() ([]Game, error) {
-	games := []Game{}
+// Link an account at a login provider to a user, or refresh its username if it already is
+func (s *PostgresStore) SaveUserIdentity(identity UserIdentity) error {
+	query := `INSERT INTO user_identities (provider, subject, user_id, username) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (provider, subject) DO UPDATE SET username = EXCLUDED.username
+	WHERE user_identities.user_id = EXCLUDED.user_id`
+	_, err := s.db.Exec(context.Background(), query, identity.Provider, identity.Subject, identity.UserID, identity.Username)
+	if err != nil {
+		err = fmt.Errorf("error saving user identity: %w", err)
+		return err
+	}
 
-	query := `SELECT * FROM games`
-	rows, err := s.db.Query(context.Background(), query)
+	return nil
+}
+
+// Get the user an account at a login provider is linked to
+func (s *PostgresStore) GetUserByIdentity(provider string, subject string) (User, error) {
+	user := User{}
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)`
+	err := s.db.QueryRow(context.Background(), query, provider, subject).Scan(userScanFields(&user)...)
 	if err != nil {
-		err = fmt.Errorf("error getting all games: %w", err)
+		err = fmt.Errorf("error getting user by identity: %w", err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Get the accounts linked to a user
+func (s *PostgresStore) GetUserIdentities(userID string) ([]UserIdentity, error) {
+	identities := []UserIdentity{}
+
+	query := `SELECT provider, subject, user_id, username, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at`
+	rows, err := s.db.Query(context.Background(), query, userID)
+	if err != nil {
+		err = fmt.Errorf("error getting user identities: %w", err)
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		game := new(Game)
-		if err := rows.Scan(&game.ID, &game.Name); err != nil {
+		identity := new(UserIdentity)
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Username, &identity.CreatedAt); err != nil {
 			err = fmt.Errorf("error scanning rows: %w", err)
 			return nil, err
 		}
 
-		games = append(games, *game)
+		identities = append(identities, *identity)
 	}
 
-	return games, nil
+	return identities, nil
 }
 
-// Get a game by name
-func (s *PostgresStore) GetGameByName(name string) (Game, error) {
-	game := Game{}
-
-	query := `SELECT * FROM games WHERE name = $1`
-	err := s.db.QueryRow(context.Background(), query, name).Scan(&game.ID, &game.Name)
+// Unlink a user's account at a login provider
+func (s *PostgresStore) DeleteUserIdentity(userID string, provider string) error {
+	query := `DELETE FROM user_identities WHERE user_id = $1 AND provider = $2`
+	_, err := s.db.Exec(context.Background(), query, userID, provider)
 	if err != nil {
-		err = fmt.Errorf("error getting game by name: %w", err)
-		return game, err
+		err = fmt.Errorf("error deleting user identity: %w", err)
+		return err
 	}
 
-	return game, nil
+	return nil
 }
 
-// Enter a new game into database
-func (s *PostgresStore) CreateGame(game Game) error {
-	game.ID = uuid.New().String()
+/*
+ *
+ *
+ * Rate limits
+ *
+ *
+ */
 
-	query := `INSERT INTO games (id, name) VALUES ($1, $2)`
-	_, err := s.db.Exec(context.Background(), query,
-		game.ID,
-		game.Name,
-	)
+// Refill a token bucket for the time since it was last used and take a token if there
+// is a whole one, in one statement so replicas can't both take the last token. Returns
+// whether a token was taken and how many are left.
+func (s *PostgresStore) TakeRateLimitToken(key string, rate float64, burst float64) (bool, float64, error) {
+	query := `INSERT INTO rate_limits (key, tokens, allowed, updated_at) VALUES ($1, $3::double precision - 1, true, now())
+	ON CONFLICT (key) DO UPDATE SET
+		allowed = LEAST($3::double precision, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at)::double precision * $2::double precision) >= 1,
+		tokens = LEAST($3::double precision, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at)::double precision * $2::double precision)
+			- CASE WHEN LEAST($3::double precision, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at)::double precision * $2::double precision) >= 1 THEN 1 ELSE 0 END,
+		updated_at = now()
+	RETURNING allowed, tokens`
+
+	var allowed bool
+	var tokens float64
+	err := s.db.QueryRow(context.Background(), query, key, rate, burst).Scan(&allowed, &tokens)
+	if err != nil {
+		err = fmt.Errorf("error taking rate limit token: %w", err)
+		return false, 0, err
+	}
+
+	return allowed, tokens, nil
+}
 
+// Delete buckets untouched for idle; they would be full again anyway
+func (s *PostgresStore) DeleteIdleRateLimits(idle time.Duration) error {
+	query := `DELETE FROM rate_limits WHERE updated_at < $1`
+	_, err := s.db.Exec(context.Background(), query, time.Now().Add(-idle))
 	if err != nil {
-		err = fmt.Errorf("error inserting game: %w", err)
+		err = fmt.Errorf("error deleting idle rate limits: %w", err)
 		return err
 	}
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Prefix of every API token, so they can be told apart from JWTs and spotted in leaks
+const apiTokenPrefix = "lstv_"
+
+const (
+	defaultAPITokenDays = 90
+	maxAPITokenDays     = 365
+)
+
+// last_used_at is only written when it is older than this, not on every request
+const apiTokenTouchInterval = 5 * time.Minute
+
+func (t APIToken) hasScope(permission string) bool {
+	for _, scope := range t.Scopes {
+		if scope == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tokens are stored as their SHA-256; the secret is only shown when it is created
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// The API token in an "Authorization: Bearer" header, if there is one. JWTs sent
+// the same way are left for sessionFromJWT.
+func bearerAPIToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "BEARER ") {
+		return "", false
+	}
+
+	secret := strings.TrimSpace(header[7:])
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return "", false
+	}
+
+	return secret, true
+}
+
+// Look up an API token and its user, rejecting revoked and expired tokens
+func (s *APIServer) apiTokenUser(secret string) (APIToken, User, error) {
+	token, err := s.store.GetAPITokenByHash(hashAPIToken(secret))
+	if err != nil {
+		return token, User{}, fmt.Errorf("invalid api token")
+	}
+
+	if token.RevokedAt != nil {
+		return token, User{}, fmt.Errorf("api token has been revoked")
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return token, User{}, fmt.Errorf("api token has expired")
+	}
+
+	user, err := s.store.GetUserByID(token.UserID)
+	if err != nil {
+		return token, User{}, fmt.Errorf("invalid api token")
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > apiTokenTouchInterval {
+		if err := s.store.TouchAPIToken(token.ID); err != nil {
+			s.log.Warn(err.Error())
+		}
+	}
+
+	return token, user, nil
+}
+
+func (s *APIServer) settingsRouter() chi.Router {
+	r := chi.NewRouter()
+
+	// Tokens are managed from a browser session; a token can't mint or revoke tokens
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Use(s.requireSession)
+		r.Get("/tokens", makeHTTPHandleFunc(s.handleSettingsTokens))
+		r.Post("/tokens/new", makeHTTPHandleFunc(s.handleCreateAPIToken))
+		r.Post("/tokens/revoke", makeHTTPHandleFunc(s.handleRevokeAPIToken))
+	})
+
+	return r
+}
+
+// Middleware that only lets browser sessions through. Must run after authenticate.
+func (s *APIServer) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.currentSession(r); !ok {
+			responseWithError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Settings page listing the user's API tokens
+func (s *APIServer) handleSettingsTokens(w http.ResponseWriter, r *http.Request) error {
+	user, _ := s.viewer(r)
+
+	tokens, err := s.store.GetUserAPITokens(user.ID)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	data := struct {
+		User   User
+		Tokens []APIToken
+		Scopes []string
+	}{
+		User:   user,
+		Tokens: tokens,
+		Scopes: rolePermissions[user.Role],
+	}
+
+	t, err := s.parsePage(r, "./templates/settings/tokens.html", nil)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	return renderPage(w, t, data)
+}
+
+// Route for creating an API token. The secret is in the response and can't be shown again.
+func (s *APIServer) handleCreateAPIToken(w http.ResponseWriter, r *http.Request) error {
+	user, _ := s.viewer(r)
+
+	if err := r.ParseForm(); err != nil {
+		return errBadRequest("error parsing form: %s", err)
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > 60 {
+		return errValidation("name", "must be 1 to 60 characters")
+	}
+
+	// A token can only be given permissions its owner has
+	scopes := r.PostForm["scopes"]
+	if len(scopes) == 0 {
+		return errValidation("scopes", "needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !hasPermission(user.Role, scope) {
+			return errValidation("scopes", fmt.Sprintf("%s is invalid", scope))
+		}
+	}
+
+	days := defaultAPITokenDays
+	if v := r.PostFormValue("expires_in_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAPITokenDays {
+			return errValidation("expires_in_days", fmt.Sprintf("must be between 1 and %d", maxAPITokenDays))
+		}
+		days = n
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return fmt.Errorf("error generating api token: %w", err)
+	}
+	secret = apiTokenPrefix + secret
+
+	token := APIToken{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Name:      name,
+		TokenHash: hashAPIToken(secret),
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour),
+	}
+
+	if err := s.store.CreateAPIToken(token); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, map[string]interface{}{
+		"id":         token.ID,
+		"name":       token.Name,
+		"scopes":     token.Scopes,
+		"expires_at": token.ExpiresAt,
+		"token":      secret,
+	})
+}
+
+// Route for revoking one of the user's API tokens
+func (s *APIServer) handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) error {
+	user, _ := s.viewer(r)
+
+	token, err := s.store.GetAPIToken(r.PostFormValue("id"))
+	if err != nil || token.UserID != user.ID {
+		return errNotFound("token")
+	}
+
+	if err := s.store.RevokeAPIToken(token.ID); err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, "token revoked")
+}
@@ -7,7 +7,7 @@ import (
 type Clip struct {
 	ID            string    `json:"id"`
 	PlaybackID    string    `json:"playback_id"`
-	AssetID       string    `json:"asset_id"`
+	AssetID       string    `json:"-"`
 	DateUploaded  time.Time `json:"date_uploaded"`
 	Description   string    `json:"description"`
 	UserID        string    `json:"user_id"`
@@ -16,6 +16,100 @@ type Clip struct {
 	FeaturedUsers string    `json:"featured_users"`
 	Game          string    `json:"game"`
 	Username      string    `json:"username"`
+	ObjectKey     string    `json:"-"`
+	Visibility    string    `json:"visibility"`
+	Downloadable  bool      `json:"downloadable"`
+	MP4Rendition  string    `json:"mp4_rendition"`
+	ContentHash   string    `json:"content_hash"`
+	SizeBytes     int64     `json:"size_bytes"`
+	Duration      float64   `json:"duration"`
+	Fingerprint   string    `json:"-"`
+	Captions      []Caption `json:"captions,omitempty"`
+}
+
+// Who can see a clip
+const (
+	// Listed and playable by anyone
+	VisibilityPublic = "public"
+	// Playable by anyone with the link, but left out of listings
+	VisibilityUnlisted = "unlisted"
+	// Listed and playable for logged in users only, with signed playback
+	VisibilityMembers = "members"
+	// Uploader and admins only, with signed playback
+	VisibilityPrivate = "private"
+)
+
+// Everything a player needs to play a clip. Tokens are only set for signed clips.
+type ClipPlayback struct {
+	PlaybackID     string    `json:"playback_id"`
+	Visibility     string    `json:"visibility"`
+	PlaybackURL    string    `json:"playback_url"`
+	ThumbnailURL   string    `json:"thumbnail_url"`
+	PlaybackToken  string    `json:"playback_token,omitempty"`
+	ThumbnailToken string    `json:"thumbnail_token,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at,omitempty"`
+}
+
+// A subtitles file attached to a clip as a Mux text track
+type Caption struct {
+	ID             string    `json:"id"`
+	ClipID         string    `json:"clip_id"`
+	LanguageCode   string    `json:"language_code"`
+	Name           string    `json:"name"`
+	ClosedCaptions bool      `json:"closed_captions"`
+	ObjectKey      string    `json:"-"`
+	TrackID        string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Which listed clips to page through, newest first. Only clips with one of
+// Visibilities, or private clips uploaded by PrivateOf, are listed.
+type ClipPageQuery struct {
+	Visibilities []string
+	PrivateOf    string
+
+	// Split the clips into a page per key: by "game", "uploader", "featured" (users
+	// featured other than the uploader) or "tag" (lowercased names). Empty is a single
+	// page of every listed clip, under the key "".
+	By   string
+	Keys []string
+
+	// Only clips of this game, and with this tag in any case. Empty matches every clip.
+	GameID string
+	Tag    string
+
+	After *ClipCursor
+	First int
+}
+
+// Where a page of clips starts: after this clip, newest first
+type ClipCursor struct {
+	DateUploaded time.Time
+	ID           string
+}
+
+// A page of clips and how many clips there are in all
+type ClipPage struct {
+	Clips       []Clip
+	TotalCount  int
+	HasNextPage bool
+}
+
+// A pair of clips that look alike. Pending until the uploader keeps or deletes the clip.
+type ClipDuplicate struct {
+	ID          string    `json:"id"`
+	ClipID      string    `json:"clip_id"`
+	DuplicateOf string    `json:"duplicate_of"`
+	Distance    int       `json:"distance"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type NewCaptionForm struct {
+	ClipID         string
+	LanguageCode   string
+	Name           string
+	ClosedCaptions bool
 }
 
 type NewClipForm struct {
@@ -24,6 +118,8 @@ type NewClipForm struct {
 	Game          string
 	Tags          string
 	FeaturedUsers string
+	Visibility    string
+	Downloadable  bool
 }
 
 type User struct {
@@ -31,18 +127,172 @@ type User struct {
 	Username string
 	Email    string
 	Role     string
+
+	// Whether Role follows the user's Discord server roles or was set by an admin
+	RoleSource string
+
+	// Discord account the user logs in with, synced on each login
+	DiscordID   string
+	DisplayName string
+	Avatar      string
+
+	// Storage used by the user's clips
+	UsageBytes   int64
+	UsageSeconds float64
+
+	// Per-user quota overrides; 0 falls back to the role's quota
+	QuotaBytes         int64
+	QuotaSeconds       float64
+	QuotaUploadsPerDay int
+}
+
+// Upload limits. 0 means unlimited.
+type Quota struct {
+	Role             string
+	MaxBytes         int64
+	MaxSeconds       float64
+	MaxUploadsPerDay int
+}
+
+// Discord's /users/@me response
+type DiscordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Avatar     string `json:"avatar"`
+	Email      string `json:"email"`
+	Verified   bool   `json:"verified"`
+}
+
+// A user's profile at a login provider
+type ProviderUser struct {
+	Provider    string
+	ID          string
+	Username    string
+	DisplayName string
+	Avatar      string
+	Email       string
+	Verified    bool
+}
+
+// A user as anyone can see them: no email, usage or quotas
+type UserProfile struct {
+	Username      string `json:"username"`
+	DisplayName   string `json:"display_name"`
+	AvatarURL     string `json:"avatar_url"`
+	Role          string `json:"role"`
+	Clips         []Clip `json:"clips"`
+	FeaturedClips []Clip `json:"featured_clips"`
+}
+
+// A Twitch or Steam account linked to a user. Discord accounts are kept on users.discord_id.
+type UserIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    string    `json:"-"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// An entry in the audit trail of role changes
+type RoleChange struct {
+	ID         string
+	UserID     string
+	Username   string
+	OldRole    string
+	NewRole    string
+	RoleSource string
+	ChangedBy  string
+	CreatedAt  time.Time
+}
+
+// A login. The cookie carries a JWT naming the session, so it can be revoked here.
+type Session struct {
+	ID           string     `json:"id"`
+	UserID       string     `json:"-"`
+	DiscordToken []byte     `json:"-"`
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastSeenAt   time.Time  `json:"last_seen_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"-"`
+	Current      bool       `json:"current"`
+}
+
+// A personal API token. Only the hash of the secret is stored.
+type APIToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// A registration invite. Redeemable MaxUses times before it expires.
+type Invite struct {
+	Code        string             `json:"code"`
+	Role        string             `json:"role"`
+	MaxUses     int                `json:"max_uses"`
+	Uses        int                `json:"uses"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	CreatedBy   string             `json:"created_by"`
+	CreatedAt   time.Time          `json:"created_at"`
+	RevokedAt   *time.Time         `json:"-"`
+	Redemptions []InviteRedemption `json:"redemptions,omitempty"`
+}
+
+type InviteRedemption struct {
+	InviteCode string    `json:"invite_code"`
+	UserID     string    `json:"user_id"`
+	Username   string    `json:"username"`
+	RedeemedAt time.Time `json:"redeemed_at"`
 }
 
 type NewUserForm struct {
 	Username string
 	Email    string
+	Role     string
 }
 
 type Game struct {
-	ID   string
-	Name string
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// A game with how many clips of it the requester can see
+type GameSummary struct {
+	Game
+	ClipCount int `json:"clip_count"`
+}
+
+// A game and its newest clips
+type GameDetail struct {
+	GameSummary
+	RecentClips []Clip `json:"recent_clips"`
 }
 
 type NewGameForm struct {
 	Name string
 }
+
+type Job struct {
+	ID          string
+	Type        string
+	Queue       string
+	Payload     []byte
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LastError   string
+	CreatedAt   time.Time
+
+	// How long after it is queued the job may run. EnqueueJob adds it to the
+	// database's clock, not the app's.
+	Delay time.Duration
+}
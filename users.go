@@ -3,40 +3,94 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"unicode/utf8"
 
 	ev "github.com/AfterShip/email-verifier"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/jwtauth"
 )
 
 func (s *APIServer) usersRouter() chi.Router {
 	r := chi.NewRouter()
-	r.Post("/new", makeHTTPHandleFunc(s.handleCreateUser))
+
+	// Anyone with an invite code can register; user managers don't need one.
+	// Profiles list the clips the requester may see.
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.With(s.rateLimit(registerRatePolicy)).Post("/new", makeHTTPHandleFunc(s.handleCreateUser))
+		r.Get("/{username}", makeHTTPHandleFunc(s.handleGetUser))
+	})
 
 	// Protected routes
 	r.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(jwtauth.Authenticator)
+		r.Use(s.authenticate)
+		r.Use(s.requireAuth)
+		r.Use(s.RequirePermission(PermUsersManage))
 		r.Post("/delete", makeHTTPHandleFunc(s.handleDeleteUser))
 	})
 
 	return r
 }
 
-// Route for creating a new user
+// Route for a user's profile, with the clips they uploaded and the ones they're featured in
+func (s *APIServer) handleGetUser(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.store.GetUserByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	clips, err := s.store.GetUserClips(user.ID)
+	if err != nil {
+		return err
+	}
+
+	featured, err := s.store.GetClipsFeaturingUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return responseWithJSON(w, http.StatusOK, UserProfile{
+		Username:      user.Username,
+		DisplayName:   user.DisplayName,
+		AvatarURL:     user.AvatarURL(),
+		Role:          user.Role,
+		Clips:         s.listedClips(r, clips),
+		FeaturedClips: s.listedClips(r, featured),
+	})
+}
+
+// Route for creating a new user. Without the users:manage permission an invite code
+// is required, and the role comes from the invite rather than the form.
 func (s *APIServer) handleCreateUser(w http.ResponseWriter, r *http.Request) error {
 	user, err := parseUserForm(r)
 	if err != nil {
 		return err
 	}
 
+	manager := s.can(r, PermUsersManage)
+	inviteCode := r.PostFormValue("invite_code")
+	if !manager {
+		if inviteCode == "" {
+			return errForbidden(errInviteRequired.Error())
+		}
+		user.Role = ""
+		user.RoleSource = ""
+	}
+
 	// Check if user or email already exists
 	if _, err := s.store.GetUserByUsername(user.Username); err == nil {
-		return fmt.Errorf("user already exists")
+		return errConflict("user already exists")
 	}
 
 	if _, err := s.store.GetUserByEmail(user.Email); err == nil {
-		return fmt.Errorf("email already exists")
+		return errConflict("email already exists")
+	}
+
+	if !manager {
+		if _, err := s.registerWithInvite(user, inviteCode); err != nil {
+			return err
+		}
+
+		return responseWithJSON(w, http.StatusOK, "success")
 	}
 
 	// Create user
@@ -49,15 +103,19 @@ func (s *APIServer) handleCreateUser(w http.ResponseWriter, r *http.Request) err
 
 // Route for deleting a user
 func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) error {
-	user := User{
-		ID:       r.PostFormValue("id"),
-		Username: r.PostFormValue("username"),
-		Email:    r.PostFormValue("email"),
+	// Everything below works on the ID of the user found, never one from the form
+	user, err := s.store.GetUserByUsername(r.PostFormValue("username"))
+	if err != nil {
+		return errNotFound("user")
 	}
 
-	// Check if user exists
-	if _, err := s.store.GetUserByUsername(user.Username); err != nil {
-		return fmt.Errorf("user does not exist")
+	// Log them out everywhere
+	if _, err := s.store.RevokeUserSessions(user.ID); err != nil {
+		return fmt.Errorf("error revoking user sessions: %w", err)
+	}
+
+	if _, err := s.store.RevokeUserAPITokens(user.ID); err != nil {
+		return fmt.Errorf("error revoking user api tokens: %w", err)
 	}
 
 	// Need to delete foreign key references first
@@ -77,11 +135,52 @@ func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) err
 	return responseWithJSON(w, http.StatusOK, "success")
 }
 
+// Route for changing a user's role. A role set here overrides the Discord mapping;
+// role "discord" hands the user back to the mapping, applied at their next login or sync.
+func (s *APIServer) handleUpdateUserRole(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.store.GetUserByUsername(r.PostFormValue("username"))
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	current, _ := userFromContext(r.Context())
+
+	role, source := r.PostFormValue("role"), roleSourceManual
+	if role == roleSourceDiscord {
+		role, source = user.Role, roleSourceDiscord
+	}
+
+	if !isValidRole(role) {
+		return errValidation("role", "is invalid")
+	}
+
+	// Keep at least one way into the admin panel
+	if current.ID == user.ID && (role != RoleAdmin || source != roleSourceManual) {
+		return errConflict("cannot remove your own admin role")
+	}
+
+	if err := s.setUserRole(user, role, source, current.Username); err != nil {
+		return fmt.Errorf("error updating user role: %w", err)
+	}
+
+	return responseWithJSON(w, http.StatusOK, "success")
+}
+
+// URL of the user's Discord avatar, or "" if they don't have one
+func (u User) AvatarURL() string {
+	if u.DiscordID == "" || u.Avatar == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", u.DiscordID, u.Avatar)
+}
+
 func parseUserForm(r *http.Request) (User, error) {
 	userForm := new(NewUserForm)
 
 	userForm.Username = r.PostFormValue("username")
 	userForm.Email = r.PostFormValue("email")
+	userForm.Role = r.PostFormValue("role")
 
 	err := validateUserForm(*userForm)
 	if err != nil {
@@ -91,14 +190,24 @@ func parseUserForm(r *http.Request) (User, error) {
 	user := User{
 		Username: userForm.Username,
 		Email:    userForm.Email,
+		Role:     userForm.Role,
+	}
+
+	// A role picked by an admin isn't replaced by the Discord mapping
+	if user.Role != "" {
+		user.RoleSource = roleSourceManual
 	}
 
 	return user, nil
 }
 
 func validateUserForm(userForm NewUserForm) error {
-	if userForm.Username != "majesticbeast" && userForm.Username != "devient" && userForm.Username != "ivorygun" {
-		return fmt.Errorf("username is invalid")
+	if userForm.Username == "" || utf8.RuneCountInString(userForm.Username) > 35 {
+		return errValidation("username", "is invalid")
+	}
+
+	if userForm.Role != "" && !isValidRole(userForm.Role) {
+		return errValidation("role", "is invalid")
 	}
 
 	ev := ev.NewVerifier()
@@ -108,7 +217,7 @@ func validateUserForm(userForm NewUserForm) error {
 	}
 
 	if !ret.Syntax.Valid {
-		return fmt.Errorf("email is invalid")
+		return errValidation("email", "is invalid")
 	}
 
 	return nil